@@ -0,0 +1,55 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package anomaly_processor // import "angrychow/otel/anomaly-processor"
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/collector/component"
+)
+
+// Config defines configuration for the anomaly processor.
+type Config struct {
+	// The attribute the score of an anomalous span is written to (default: "anomaly.score").
+	ScoreAttribute string `mapstructure:"score_attribute"`
+
+	// The attribute the reason of an anomalous span is written to (default: "anomaly.reason").
+	ReasonAttribute string `mapstructure:"reason_attribute"`
+
+	// The score from which a span is annotated, from 0 to 1 (default: 0.9). A span scores 0.9
+	// when its name or attribute path is seen 10 times less than the average of its siblings.
+	MinScore float64 `mapstructure:"min_score"`
+
+	// The attribute keys making the levels of the trie under the span name, in order. If omitted
+	// every attribute of the span is a level, from the lowest number of values seen to the
+	// highest. Listing the low cardinality keys keeps the identifiers out of the trie.
+	Attributes []string `mapstructure:"attributes"`
+
+	// The number of span names, and of values per level, tracked (default: 1024). The values
+	// beyond are not scored.
+	MaxChildren int `mapstructure:"max_children"`
+
+	// The number of trie nodes kept (default: 65536). When it is reached every count is halved
+	// and the nodes left without a span are dropped.
+	MaxNodes int `mapstructure:"max_nodes"`
+}
+
+var _ component.Config = (*Config)(nil)
+
+// Validate checks if the processor configuration is valid
+func (cfg *Config) Validate() error {
+	if cfg.ScoreAttribute == "" || cfg.ReasonAttribute == "" {
+		return errors.New("score_attribute and reason_attribute must be specified")
+	}
+	if cfg.MinScore < 0 || cfg.MinScore > 1 {
+		return errors.New("min_score must be between 0 and 1")
+	}
+	if cfg.MaxChildren <= 0 {
+		return errors.New("max_children must be positive")
+	}
+	if cfg.MaxNodes <= 0 {
+		return errors.New("max_nodes must be positive")
+	}
+	return nil
+}
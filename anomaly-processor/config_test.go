@@ -0,0 +1,65 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package anomaly_processor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(*Config)
+		wantErr string
+	}{
+		{
+			name:   "default",
+			mutate: func(*Config) {},
+		},
+		{
+			name:    "no score attribute",
+			mutate:  func(cfg *Config) { cfg.ScoreAttribute = "" },
+			wantErr: "score_attribute and reason_attribute must be specified",
+		},
+		{
+			name:    "no reason attribute",
+			mutate:  func(cfg *Config) { cfg.ReasonAttribute = "" },
+			wantErr: "score_attribute and reason_attribute must be specified",
+		},
+		{
+			name:    "min score above 1",
+			mutate:  func(cfg *Config) { cfg.MinScore = 1.5 },
+			wantErr: "min_score must be between 0 and 1",
+		},
+		{
+			name:    "negative min score",
+			mutate:  func(cfg *Config) { cfg.MinScore = -0.1 },
+			wantErr: "min_score must be between 0 and 1",
+		},
+		{
+			name:    "no children",
+			mutate:  func(cfg *Config) { cfg.MaxChildren = 0 },
+			wantErr: "max_children must be positive",
+		},
+		{
+			name:    "no nodes",
+			mutate:  func(cfg *Config) { cfg.MaxNodes = 0 },
+			wantErr: "max_nodes must be positive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createDefaultConfig().(*Config)
+			tt.mutate(cfg)
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package anomaly_processor // import "angrychow/otel/anomaly-processor"
+
+import (
+	"context"
+
+	"angrychow/otel/anomaly-processor/internal/metadata"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/processor"
+	"go.opentelemetry.io/collector/processor/processorhelper"
+)
+
+const (
+	defaultScoreAttribute  = "anomaly.score"
+	defaultReasonAttribute = "anomaly.reason"
+	defaultMinScore        = 0.9
+	defaultMaxChildren     = 1024
+	defaultMaxNodes        = 65536
+)
+
+// NewFactory creates a factory for the anomaly processor.
+func NewFactory() processor.Factory {
+	return processor.NewFactory(
+		metadata.Type,
+		createDefaultConfig,
+		processor.WithTraces(createTracesProcessor, metadata.TracesStability),
+	)
+}
+
+func createDefaultConfig() component.Config {
+	return &Config{
+		ScoreAttribute:  defaultScoreAttribute,
+		ReasonAttribute: defaultReasonAttribute,
+		MinScore:        defaultMinScore,
+		MaxChildren:     defaultMaxChildren,
+		MaxNodes:        defaultMaxNodes,
+	}
+}
+
+func createTracesProcessor(
+	ctx context.Context,
+	set processor.CreateSettings,
+	cfg component.Config,
+	nextConsumer consumer.Traces,
+) (processor.Traces, error) {
+	p := newAnomalyProcessor(cfg.(*Config), set.Logger)
+	return processorhelper.NewTracesProcessor(ctx, set, cfg, nextConsumer,
+		p.processTraces,
+		processorhelper.WithCapabilities(consumer.Capabilities{MutatesData: true}))
+}
@@ -0,0 +1,41 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package anomaly_processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.opentelemetry.io/collector/component/componenttest"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/processor/processortest"
+)
+
+func TestCreateDefaultConfig(t *testing.T) {
+	cfg := NewFactory().CreateDefaultConfig()
+	assert.NoError(t, componenttest.CheckConfigStruct(cfg))
+	assert.Equal(t, &Config{
+		ScoreAttribute:  "anomaly.score",
+		ReasonAttribute: "anomaly.reason",
+		MinScore:        0.9,
+		MaxChildren:     1024,
+		MaxNodes:        65536,
+	}, cfg)
+}
+
+func TestCreateTracesProcessor(t *testing.T) {
+	factory := NewFactory()
+	sink := new(consumertest.TracesSink)
+	tp, err := factory.CreateTracesProcessor(context.Background(), processortest.NewNopCreateSettings(), factory.CreateDefaultConfig(), sink)
+	require.NoError(t, err)
+	assert.True(t, tp.Capabilities().MutatesData)
+
+	require.NoError(t, tp.Start(context.Background(), componenttest.NewNopHost()))
+	require.NoError(t, tp.ConsumeTraces(context.Background(), newTestTraces("GET", "GET")))
+	require.NoError(t, tp.Shutdown(context.Background()))
+	assert.Equal(t, 2, sink.SpanCount())
+}
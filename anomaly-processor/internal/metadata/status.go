@@ -0,0 +1,25 @@
+package metadata
+
+import (
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"go.opentelemetry.io/collector/component"
+)
+
+var (
+	Type      = component.MustNewType("anomaly")
+	scopeName = "angrychow/otel/anomaly-processor"
+)
+
+const (
+	TracesStability = component.StabilityLevelDevelopment
+)
+
+func Meter(settings component.TelemetrySettings) metric.Meter {
+	return settings.MeterProvider.Meter(scopeName)
+}
+
+func Tracer(settings component.TelemetrySettings) trace.Tracer {
+	return settings.TracerProvider.Tracer(scopeName)
+}
@@ -0,0 +1,59 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package anomaly_processor // import "angrychow/otel/anomaly-processor"
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// anomalyProcessor scores every span against the frequency trie of the spans seen before it and
+// annotates the anomalous ones, for the exporters, samplers and routing rules down the pipeline.
+type anomalyProcessor struct {
+	config *Config
+	logger *zap.Logger
+
+	mu   sync.Mutex
+	trie *frequencyTrie
+}
+
+func newAnomalyProcessor(cfg *Config, logger *zap.Logger) *anomalyProcessor {
+	return &anomalyProcessor{
+		config: cfg,
+		logger: logger,
+		// The annotations of a processor before this one are not levels.
+		trie: newFrequencyTrie(cfg.Attributes, []string{cfg.ScoreAttribute, cfg.ReasonAttribute}, cfg.MaxChildren, cfg.MaxNodes),
+	}
+}
+
+func (p *anomalyProcessor) processTraces(_ context.Context, td ptrace.Traces) (ptrace.Traces, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	anomalies := 0
+	rss := td.ResourceSpans()
+	for i := 0; i < rss.Len(); i++ {
+		sss := rss.At(i).ScopeSpans()
+		for j := 0; j < sss.Len(); j++ {
+			spans := sss.At(j).Spans()
+			for k := 0; k < spans.Len(); k++ {
+				span := spans.At(k)
+				score, reason := p.trie.score(span.Name(), span.Attributes())
+				if score < p.config.MinScore || score == 0 {
+					continue
+				}
+				span.Attributes().PutDouble(p.config.ScoreAttribute, score)
+				span.Attributes().PutStr(p.config.ReasonAttribute, reason)
+				anomalies++
+			}
+		}
+	}
+	if anomalies > 0 {
+		p.logger.Debug("Annotated anomalous spans", zap.Int("spans", anomalies))
+	}
+	return td, nil
+}
@@ -0,0 +1,82 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package anomaly_processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func newTestTraces(methods ...string) ptrace.Traces {
+	td := ptrace.NewTraces()
+	spans := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	for _, method := range methods {
+		span := spans.AppendEmpty()
+		span.SetName("cart")
+		span.Attributes().PutStr("http.method", method)
+		span.Attributes().PutStr("user.id", method+"-user")
+	}
+	return td
+}
+
+func TestProcessTraces(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.Attributes = []string{"http.method"}
+	p := newAnomalyProcessor(cfg, zap.NewNop())
+
+	methods := make([]string, 19, 20)
+	for i := range methods {
+		methods[i] = "GET"
+	}
+	td, err := p.processTraces(context.Background(), newTestTraces(append(methods, "DELETE")...))
+	require.NoError(t, err)
+
+	spans := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	for i := 0; i < 19; i++ {
+		_, ok := spans.At(i).Attributes().Get(cfg.ScoreAttribute)
+		assert.False(t, ok)
+	}
+	attrs := spans.At(19).Attributes()
+	score, ok := attrs.Get(cfg.ScoreAttribute)
+	require.True(t, ok)
+	assert.InDelta(t, 0.9, score.Double(), 1e-9)
+	reason, ok := attrs.Get(cfg.ReasonAttribute)
+	require.True(t, ok)
+	assert.Equal(t, "rare attribute path http.method=DELETE", reason.Str())
+}
+
+func TestProcessTracesMinScore(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.Attributes = []string{"http.method"}
+	cfg.MinScore = 0.95
+	p := newAnomalyProcessor(cfg, zap.NewNop())
+
+	methods := make([]string, 19, 20)
+	for i := range methods {
+		methods[i] = "GET"
+	}
+	td, err := p.processTraces(context.Background(), newTestTraces(append(methods, "DELETE")...))
+	require.NoError(t, err)
+	_, ok := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(19).Attributes().Get(cfg.ScoreAttribute)
+	assert.False(t, ok)
+}
+
+func TestProcessTracesReprocessed(t *testing.T) {
+	// Every attribute is a level, the annotations of an earlier processor are not.
+	p := newAnomalyProcessor(createDefaultConfig().(*Config), zap.NewNop())
+	td := newTestTraces("GET")
+	td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().PutDouble(defaultScoreAttribute, 1)
+	for i := 0; i < 2; i++ {
+		_, err := p.processTraces(context.Background(), td)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"http.method", "user.id"},
+		p.trie.levels(td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes()))
+}
@@ -0,0 +1,191 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package anomaly_processor // import "angrychow/otel/anomaly-processor"
+
+import (
+	"sort"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+// noneValue is the trie value of a level the span does not have.
+const noneValue = "NONE"
+
+// Reasons written along with the score of an anomalous span.
+const (
+	reasonRareName = "rare span name"
+	reasonRarePath = "rare attribute path "
+)
+
+// frequencyNode counts the spans through a node of the frequency trie: a span name at the
+// root, then a value per attribute level.
+type frequencyNode struct {
+	count    int
+	children map[string]*frequencyNode
+}
+
+// decay halves the counts under n and drops the nodes left without a span. It returns the
+// number of nodes left under n.
+func (n *frequencyNode) decay() int {
+	nodes := 0
+	for value, c := range n.children {
+		c.count /= 2
+		if c.count == 0 {
+			delete(n.children, value)
+			continue
+		}
+		nodes += 1 + c.decay()
+	}
+	return nodes
+}
+
+// frequencyTrie is the trie of every span seen so far, like the one the prefix-trie compressor
+// samples with: a span name or an attribute value seen much less than its siblings on average
+// makes the span anomalous.
+type frequencyTrie struct {
+	names      frequencyNode
+	attributes []string
+	ignored    map[string]bool
+	// cardinality holds the values seen per attribute key, up to maxChildren, which order the
+	// levels when attributes is empty.
+	cardinality map[string]map[string]bool
+	// nodes is the number of trie nodes and cardinality values, decayed at maxNodes.
+	nodes       int
+	maxChildren int
+	maxNodes    int
+}
+
+// newFrequencyTrie returns a trie with the attributes levels, or every attribute but the
+// ignored ones when attributes is empty.
+func newFrequencyTrie(attributes []string, ignored []string, maxChildren, maxNodes int) *frequencyTrie {
+	t := &frequencyTrie{
+		attributes:  attributes,
+		ignored:     make(map[string]bool),
+		cardinality: make(map[string]map[string]bool),
+		maxChildren: maxChildren,
+		maxNodes:    maxNodes,
+	}
+	for _, key := range ignored {
+		t.ignored[key] = true
+	}
+	return t
+}
+
+// child returns the child of n for value, created unless n has maxChildren already. It is nil
+// when the value is not tracked.
+func (t *frequencyTrie) child(n *frequencyNode, value string) *frequencyNode {
+	if c, ok := n.children[value]; ok {
+		return c
+	}
+	if len(n.children) >= t.maxChildren {
+		return nil
+	}
+	if n.children == nil {
+		n.children = make(map[string]*frequencyNode)
+	}
+	c := &frequencyNode{}
+	n.children[value] = c
+	t.nodes++
+	return c
+}
+
+// score adds the span to the trie and returns how rare its name or attribute path is, from 0
+// to 1, along with the reason of the highest score. A score of 0.9 means a count 10 times
+// lower than the parent count shared among the siblings.
+func (t *frequencyTrie) score(name string, attrs pcommon.Map) (float64, string) {
+	for t.nodes >= t.maxNodes {
+		t.decay()
+	}
+	levels := t.levels(attrs)
+
+	parent := &t.names
+	parent.count++
+	node := t.child(parent, name)
+	if node == nil {
+		return 0, ""
+	}
+	node.count++
+	score, reason := rarity(node.count, expected(parent)), reasonRareName
+
+	for _, key := range levels {
+		value := noneValue
+		if v, ok := attrs.Get(key); ok {
+			value = v.AsString()
+		}
+		parent = node
+		node = t.child(parent, value)
+		if node == nil {
+			break
+		}
+		node.count++
+		if s := rarity(node.count, expected(parent)); s > score {
+			score, reason = s, reasonRarePath+key+"="+value
+		}
+	}
+	return score, reason
+}
+
+// decay halves every count and drops the nodes left without a span, along with the values
+// of the attribute cardinalities, which keeps the trie within maxNodes and weighs the recent
+// spans more.
+func (t *frequencyTrie) decay() {
+	t.names.count /= 2
+	t.nodes = t.names.decay()
+	t.cardinality = make(map[string]map[string]bool)
+}
+
+// levels returns the attribute keys of the levels below the span name: the configured ones, or
+// every attribute of the span from the lowest cardinality seen to the highest, so that the
+// identifiers do not split the trie near its root.
+func (t *frequencyTrie) levels(attrs pcommon.Map) []string {
+	if len(t.attributes) > 0 {
+		return t.attributes
+	}
+	keys := make([]string, 0, attrs.Len())
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		if !t.ignored[k] {
+			keys = append(keys, k)
+			t.observe(k, v.AsString())
+		}
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		ci, cj := len(t.cardinality[keys[i]]), len(t.cardinality[keys[j]])
+		if ci != cj {
+			return ci < cj
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// observe adds value to the values seen for key, up to maxChildren of them.
+func (t *frequencyTrie) observe(key, value string) {
+	values, ok := t.cardinality[key]
+	if !ok {
+		values = make(map[string]bool)
+		t.cardinality[key] = values
+	}
+	if values[value] || len(values) >= t.maxChildren {
+		return
+	}
+	values[value] = true
+	t.nodes++
+}
+
+// expected returns the count each child of n has on average.
+func expected(n *frequencyNode) float64 {
+	if len(n.children) == 0 {
+		return 0
+	}
+	return float64(n.count) / float64(len(n.children))
+}
+
+// rarity compares count to the expected one, 0 when it is reached and 1 for the rarest.
+func rarity(count int, expected float64) float64 {
+	if expected <= 0 || float64(count) >= expected {
+		return 0
+	}
+	return 1 - float64(count)/expected
+}
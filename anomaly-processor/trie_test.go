@@ -0,0 +1,135 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package anomaly_processor
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+func TestFrequencyTrieScoreName(t *testing.T) {
+	trie := newFrequencyTrie(nil, nil, defaultMaxChildren, defaultMaxNodes)
+	for i := 0; i < 19; i++ {
+		score, _ := trie.score("GET /cart", pcommon.NewMap())
+		assert.Zero(t, score)
+	}
+	// 1 span where 10 are expected on average.
+	score, reason := trie.score("DELETE /cart", pcommon.NewMap())
+	assert.InDelta(t, 0.9, score, 1e-9)
+	assert.Equal(t, reasonRareName, reason)
+}
+
+func TestFrequencyTrieScorePath(t *testing.T) {
+	trie := newFrequencyTrie([]string{"http.method"}, nil, defaultMaxChildren, defaultMaxNodes)
+	attrs := pcommon.NewMap()
+	attrs.PutStr("http.method", "GET")
+	for i := 0; i < 19; i++ {
+		score, _ := trie.score("cart", attrs)
+		assert.Zero(t, score)
+	}
+	attrs.PutStr("http.method", "DELETE")
+	score, reason := trie.score("cart", attrs)
+	assert.InDelta(t, 0.9, score, 1e-9)
+	assert.Equal(t, "rare attribute path http.method=DELETE", reason)
+
+	// A span without the attribute goes through the NONE value of the level, 7 spans are
+	// expected per value.
+	score, reason = trie.score("cart", pcommon.NewMap())
+	assert.InDelta(t, 1-1.0/7, score, 1e-9)
+	assert.Equal(t, "rare attribute path http.method=NONE", reason)
+}
+
+func TestFrequencyTrieScoreParentCount(t *testing.T) {
+	trie := newFrequencyTrie([]string{"http.method", "http.route"}, nil, defaultMaxChildren, defaultMaxNodes)
+	attrs := pcommon.NewMap()
+	attrs.PutStr("http.method", "GET")
+	attrs.PutStr("http.route", "/cart")
+	for i := 0; i < 100; i++ {
+		trie.score("cart", attrs)
+	}
+	attrs.PutStr("http.method", "DELETE")
+	for i := 0; i < 9; i++ {
+		trie.score("cart", attrs)
+	}
+	// DELETE is rare among the methods, 10 spans where 55 are expected, but /cart is the only
+	// route of its 10 DELETE spans.
+	score, reason := trie.score("cart", attrs)
+	assert.InDelta(t, 1-10.0/55, score, 1e-9)
+	assert.Equal(t, "rare attribute path http.method=DELETE", reason)
+}
+
+func TestFrequencyTrieLevels(t *testing.T) {
+	attrs := pcommon.NewMap()
+	attrs.PutStr("b", "1")
+	attrs.PutStr("a", "2")
+	attrs.PutDouble(defaultScoreAttribute, 1)
+
+	trie := newFrequencyTrie(nil, []string{defaultScoreAttribute, defaultReasonAttribute}, defaultMaxChildren, defaultMaxNodes)
+	assert.Equal(t, []string{"a", "b"}, trie.levels(attrs))
+
+	// The keys with more values go down the trie.
+	for i := 0; i < 3; i++ {
+		attrs.PutStr("a", strconv.Itoa(i))
+		trie.levels(attrs)
+	}
+	assert.Equal(t, []string{"b", "a"}, trie.levels(attrs))
+
+	trie = newFrequencyTrie([]string{"b", "missing"}, nil, defaultMaxChildren, defaultMaxNodes)
+	assert.Equal(t, []string{"b", "missing"}, trie.levels(attrs))
+}
+
+func TestFrequencyTrieMaxChildren(t *testing.T) {
+	trie := newFrequencyTrie([]string{"id"}, nil, 2, defaultMaxNodes)
+	attrs := pcommon.NewMap()
+	for i := 0; i < 4; i++ {
+		attrs.PutStr("id", strconv.Itoa(i))
+		trie.score("op", attrs)
+		trie.score("op"+strconv.Itoa(i), pcommon.NewMap())
+	}
+	assert.Len(t, trie.names.children, 2)
+	assert.Len(t, trie.names.children["op"].children, 2)
+
+	// The names beyond the bound are not scored.
+	score, reason := trie.score("untracked", pcommon.NewMap())
+	assert.Zero(t, score)
+	assert.Empty(t, reason)
+}
+
+func TestFrequencyTrieMaxNodes(t *testing.T) {
+	trie := newFrequencyTrie(nil, nil, defaultMaxChildren, 8)
+	for i := 0; i < 100; i++ {
+		trie.score("GET /cart", pcommon.NewMap())
+		trie.score("op"+strconv.Itoa(i), pcommon.NewMap())
+		assert.LessOrEqual(t, trie.nodes, 8)
+	}
+	// The decay drops the names seen once, the frequent one stays.
+	assert.Contains(t, trie.names.children, "GET /cart")
+	assert.Less(t, len(trie.names.children), 8)
+	score, _ := trie.score("GET /cart", pcommon.NewMap())
+	assert.Zero(t, score)
+}
+
+func TestRarity(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    int
+		expected float64
+		want     float64
+	}{
+		{name: "expected", count: 10, expected: 10, want: 0},
+		{name: "above expected", count: 20, expected: 10, want: 0},
+		{name: "10 times rarer", count: 1, expected: 10, want: 0.9},
+		{name: "half", count: 5, expected: 10, want: 0.5},
+		{name: "nothing expected", count: 1, expected: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, rarity(tt.count, tt.expected), 1e-9)
+		})
+	}
+}
@@ -16,6 +16,8 @@ import (
 
 	prefix_compressed_receiver "angrychow/otel/prefix-compressed-receiver"
 
+	anomaly_processor "angrychow/otel/anomaly-processor"
+
 	jaegerreceiver "github.com/open-telemetry/opentelemetry-collector-contrib/receiver/jaegerreceiver"
 )
 
@@ -48,6 +50,7 @@ func components() (otelcol.Factories, error) {
 
 	factories.Processors, err = processor.MakeFactoryMap(
 		batchprocessor.NewFactory(),
+		anomaly_processor.NewFactory(),
 	)
 	if err != nil {
 		return otelcol.Factories{}, err
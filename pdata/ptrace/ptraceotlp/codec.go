@@ -0,0 +1,549 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"bytes"
+	goJson "encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/internal"
+	otlpcollectortrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/collector/trace/v1"
+	"go.opentelemetry.io/collector/pdata/internal/json"
+	"go.opentelemetry.io/collector/pdata/internal/otlp"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+var errTrieJSON = errors.New("prefix trie: malformed JSON payload")
+
+// ErrUnknownReference is returned, wrapped, when a payload uses a reference or fingerprint the
+// Dictionary does not know. The decoding side lost or never got the update, it can be restored
+// with the Entries of the encoding side.
+var ErrUnknownReference = errors.New("prefix trie: unknown reference")
+
+// EncodeCompressed encodes td into the JSON prefix-trie format, every span is encoded.
+// Attribute keys missing from dict are added to it and returned as updates. The payload
+// carries them too, decoding it applies them to the dictionary of the decoding side. It is
+// stamped with the version of dict, see DecodeCompressed.
+func EncodeCompressed(td ptrace.Traces, dict *Dictionary) ([]byte, []UpdatesEntry, error) {
+	data, updates := newTrieBuilder(dict).build(internal.GetOrigTraces(internal.Traces(td)).ResourceSpans)
+	buf, err := marshalTrieJSON(dict.Version(), updates, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, updates, nil
+}
+
+// DecodeCompressed decodes a JSON prefix-trie payload produced by EncodeCompressed or
+// TraceCompressor.MarshalTraces. The updates carried by buf are applied to dict first, dict
+// must know every other reference used in buf, and the zstd dictionary if buf went through
+// the zstd stage enabled by TraceCompressor.EnableZstd. A dict of another epoch than buf is
+// reset to it, the error wraps ErrUnknownReference when dict is behind the version of buf.
+func DecodeCompressed(buf []byte, dict *Dictionary) (ptrace.Traces, error) {
+	buf, err := decompressZstd(buf, dict)
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+	dec := goJson.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var body map[string]interface{}
+	if err = dec.Decode(&body); err != nil {
+		return ptrace.Traces{}, err
+	}
+	updates, err := trieJSONUpdates(body["updates"])
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+	version, err := trieJSONVersion(body)
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+	delete(body, "updates")
+	delete(body, "epoch")
+	delete(body, "version")
+	if err = dict.sync(version, updates); err != nil {
+		return ptrace.Traces{}, err
+	}
+	if err = revertTraces(body, dict); err != nil {
+		return ptrace.Traces{}, err
+	}
+	otlpBuf, err := goJson.Marshal(body)
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+	return jsonUnmarshaler.UnmarshalTraces(otlpBuf)
+}
+
+// EncodeCompressedProto is EncodeCompressed for the binary prefix-trie format described in trie.proto.
+func EncodeCompressedProto(td ptrace.Traces, dict *Dictionary) ([]byte, []UpdatesEntry, error) {
+	data, updates := newTrieBuilder(dict).build(internal.GetOrigTraces(internal.Traces(td)).ResourceSpans)
+	buf, err := marshalTrieProto(dict.Version(), updates, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, updates, nil
+}
+
+// DecodeCompressedProto is DecodeCompressed for the binary prefix-trie format described in trie.proto.
+func DecodeCompressedProto(buf []byte, dict *Dictionary) (ptrace.Traces, error) {
+	buf, err := decompressZstd(buf, dict)
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+	rss, err := unmarshalTrieProto(buf, dict)
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+	otlp.MigrateTraces(rss)
+	state := internal.StateMutable
+	return ptrace.Traces(internal.NewTraces(&otlpcollectortrace.ExportTraceServiceRequest{ResourceSpans: rss}, &state)), nil
+}
+
+func marshalTrieJSON(version DictionaryVersion, updates []UpdatesEntry, resourceSpans []ExportData) ([]byte, error) {
+	return goJson.Marshal(struct {
+		Epoch         string         `json:"epoch,omitempty"`
+		Version       uint64         `json:"version,omitempty"`
+		Updates       []UpdatesEntry `json:"updates,omitempty"`
+		ResourceSpans []ExportData   `json:"resourceSpans"`
+	}{
+		Epoch:         version.Epoch,
+		Version:       version.Version,
+		Updates:       updates,
+		ResourceSpans: resourceSpans,
+	})
+}
+
+// trieJSONVersion returns the dictionary version a JSON prefix-trie payload is stamped with.
+func trieJSONVersion(body map[string]interface{}) (DictionaryVersion, error) {
+	var version DictionaryVersion
+	if v, ok := body["epoch"]; ok {
+		if version.Epoch, ok = v.(string); !ok {
+			return version, errTrieJSON
+		}
+	}
+	if v, ok := body["version"]; ok {
+		n, ok := v.(goJson.Number)
+		if !ok {
+			return version, errTrieJSON
+		}
+		var err error
+		if version.Version, err = strconv.ParseUint(n.String(), 10, 64); err != nil {
+			return version, errTrieJSON
+		}
+	}
+	return version, nil
+}
+
+// trieJSONUpdates returns the updates carried by a JSON prefix-trie payload.
+func trieJSONUpdates(v interface{}) ([]UpdatesEntry, error) {
+	if v == nil {
+		return nil, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, errTrieJSON
+	}
+	updates := make([]UpdatesEntry, len(items))
+	for i, item := range items {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errTrieJSON
+		}
+		kind, _ := entry["kind"].(string)
+		key, okKey := entry["key"].(string)
+		value, okValue := entry["value"].(string)
+		if !okKey || !okValue {
+			return nil, errTrieJSON
+		}
+		updates[i] = UpdatesEntry{Kind: kind, Key: key, Value: value}
+	}
+	return updates, nil
+}
+
+// revertTraces rewrites a decoded JSON prefix-trie payload into an OTLP/JSON document in place.
+func revertTraces(body map[string]interface{}, dict *Dictionary) error {
+	resourceSpans, _ := body["resourceSpans"].([]interface{})
+	for _, resourceSpan := range resourceSpans {
+		rs, ok := resourceSpan.(map[string]interface{})
+		if !ok {
+			return errTrieJSON
+		}
+		if err := revertResource(rs, dict); err != nil {
+			return err
+		}
+		scopeSpans, _ := rs["scopeSpans"].([]interface{})
+		for _, scopeSpan := range scopeSpans {
+			ss, ok := scopeSpan.(map[string]interface{})
+			if !ok {
+				return errTrieJSON
+			}
+			if err := revertScope(ss, dict); err != nil {
+				return err
+			}
+			tOffset, err := trieJSONUint64(ss["tOffset"])
+			if err != nil {
+				return err
+			}
+			delete(ss, "tOffset")
+			timeMode, err := trieJSONUint64(ss["tMode"])
+			if err != nil {
+				return err
+			}
+			delete(ss, "tMode")
+			nodes, _ := ss["spans"].([]interface{})
+			var leaves []map[string]interface{}
+			for _, node := range nodes {
+				nodeLeaves, err := revertSpan(node, TimestampMode(timeMode))
+				if err != nil {
+					return err
+				}
+				leaves = append(leaves, nodeLeaves...)
+			}
+			traceIDs, _ := ss["traceIds"].([]interface{})
+			delete(ss, "traceIds")
+			if err = revertLinks(leaves, traceIDs); err != nil {
+				return err
+			}
+			spans := make([]interface{}, 0, len(leaves))
+			for _, leaf := range leaves {
+				if err = revertLeaf(leaf, tOffset, dict); err != nil {
+					return err
+				}
+				spans = append(spans, leaf)
+			}
+			ss["spans"] = spans
+		}
+	}
+	return nil
+}
+
+// revertResource replaces the resourceId of rs with the schema URL and resource it stands for.
+func revertResource(rs map[string]interface{}, dict *Dictionary) error {
+	id, _ := rs["resourceId"].(string)
+	delete(rs, "resourceId")
+	def, err := resolveResource(dict, id)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = json.Marshal(&buf, &def.Resource); err != nil {
+		return err
+	}
+	rs["resource"] = goJson.RawMessage(buf.Bytes())
+	if def.SchemaUrl != "" {
+		rs["schemaUrl"] = def.SchemaUrl
+	}
+	return nil
+}
+
+// revertScope replaces the scopeId of ss with the schema URL and scope it stands for.
+func revertScope(ss map[string]interface{}, dict *Dictionary) error {
+	id, _ := ss["scopeId"].(string)
+	delete(ss, "scopeId")
+	def, err := resolveScope(dict, id)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = json.Marshal(&buf, &def.Scope); err != nil {
+		return err
+	}
+	ss["scope"] = goJson.RawMessage(buf.Bytes())
+	if def.SchemaUrl != "" {
+		ss["schemaUrl"] = def.SchemaUrl
+	}
+	return nil
+}
+
+// revertSpan returns the leaves below node, each carrying the AN/AV pairs of its path as fields.
+// With TimestampModeDelta the leaf times are turned back into offsets from tOffset.
+func revertSpan(node interface{}, timeMode TimestampMode) ([]map[string]interface{}, error) {
+	iter, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, errTrieJSON
+	}
+	sons, ok := iter["Son"].([]interface{})
+	if !ok {
+		return nil, errTrieJSON
+	}
+	an, ok := iter["AN"].(string)
+	if !ok {
+		return nil, errTrieJSON
+	}
+	ret := make([]map[string]interface{}, 0, len(sons))
+	var start uint64
+	for _, item := range sons {
+		son, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errTrieJSON
+		}
+		if _, isNode := son["Son"]; !isNode {
+			if timeMode == TimestampModeDelta {
+				startDelta, err := trieJSONUint64(son["sd"])
+				if err != nil {
+					return nil, err
+				}
+				duration, err := trieJSONUint64(son["d"])
+				if err != nil {
+					return nil, err
+				}
+				start += startDelta
+				son["stun"] = goJson.Number(strconv.FormatUint(start, 10))
+				son["etun"] = goJson.Number(strconv.FormatUint(start+duration, 10))
+				delete(son, "sd")
+				delete(son, "d")
+			}
+			ret = append(ret, son)
+			continue
+		}
+		leaves, err := revertSpan(son, timeMode)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, leaves...)
+	}
+	for _, leaf := range ret {
+		leaf[an] = iter["AV"]
+	}
+	return ret, nil
+}
+
+// revertLinks puts back the trace IDs and the in-scope parent span IDs of the leaves of a scope,
+// leaves being in payload order.
+func revertLinks(leaves []map[string]interface{}, traceIDs []interface{}) error {
+	for _, leaf := range leaves {
+		if t, ok := leaf["t"]; ok {
+			index, err := trieJSONUint64(t)
+			if err != nil {
+				return err
+			}
+			if index >= uint64(len(traceIDs)) {
+				return fmt.Errorf("prefix trie: trace index %d out of range", index)
+			}
+			leaf["traceId"] = traceIDs[index]
+			delete(leaf, "t")
+		}
+	}
+	// Parents may come after their children, every span ID is in place by now.
+	for _, leaf := range leaves {
+		if p, ok := leaf["p"]; ok {
+			index, err := trieJSONUint64(p)
+			if err != nil {
+				return err
+			}
+			if index >= uint64(len(leaves)) {
+				return fmt.Errorf("prefix trie: parent index %d out of range", index)
+			}
+			leaf["parentSpanId"] = leaves[index]["spanId"]
+			delete(leaf, "p")
+		}
+	}
+	return nil
+}
+
+// revertLeaf turns a leaf returned by revertSpan into an OTLP/JSON span.
+func revertLeaf(leaf map[string]interface{}, tOffset uint64, dict *Dictionary) error {
+	var start uint64
+	for _, field := range [][2]string{{"stun", "startTimeUnixNano"}, {"etun", "endTimeUnixNano"}} {
+		t, err := trieJSONUint64(leaf[field[0]])
+		if err != nil {
+			return err
+		}
+		if field[0] == "stun" {
+			start = t + tOffset
+		}
+		leaf[field[1]] = strconv.FormatUint(t+tOffset, 10)
+		delete(leaf, field[0])
+	}
+	if err := revertDetails(leaf, start, dict); err != nil {
+		return err
+	}
+	if ref, ok := trieJSONRef(leaf[trieNameLevel]); ok {
+		name, err := resolveValueRef(ref, dict)
+		if err != nil {
+			return err
+		}
+		leaf[trieNameLevel] = name
+	}
+
+	var levels []string
+	for key := range leaf {
+		if strings.HasPrefix(key, trieAttrPrefix) {
+			levels = append(levels, key)
+		}
+	}
+	// Keep the attributes in dictionary order, map order is random.
+	sort.Slice(levels, func(i, j int) bool {
+		ri, _ := strconv.Atoi(levels[i][len(trieAttrPrefix):])
+		rj, _ := strconv.Atoi(levels[j][len(trieAttrPrefix):])
+		return ri < rj
+	})
+
+	attributes := make([]interface{}, 0, len(levels))
+	for _, key := range levels {
+		value := leaf[key]
+		delete(leaf, key)
+		attrKey, ok := dict.Key(key[len(trieAttrPrefix):])
+		if !ok {
+			return fmt.Errorf("%w: attribute %q", ErrUnknownReference, key)
+		}
+		if value == trieNoneValue {
+			continue
+		}
+		if ref, ok := trieJSONRef(value); ok {
+			sv, err := resolveValueRef(ref, dict)
+			if err != nil {
+				return err
+			}
+			value = map[string]interface{}{"stringValue": sv}
+		}
+		attributes = append(attributes, map[string]interface{}{
+			"key":   attrKey,
+			"value": value,
+		})
+	}
+	if len(attributes) > 0 {
+		leaf["attributes"] = attributes
+	}
+	return nil
+}
+
+// revertDetails turns the events ("ev") and links ("ln") of a leaf back into OTLP/JSON.
+func revertDetails(leaf map[string]interface{}, start uint64, dict *Dictionary) error {
+	if ev, ok := leaf["ev"]; ok {
+		items, ok := ev.([]interface{})
+		if !ok {
+			return errTrieJSON
+		}
+		events := make([]interface{}, len(items))
+		for i, item := range items {
+			e, ok := item.(map[string]interface{})
+			if !ok {
+				return errTrieJSON
+			}
+			dt, ok := e["dt"].(goJson.Number)
+			if !ok {
+				return errTrieJSON
+			}
+			delta, err := dt.Int64()
+			if err != nil {
+				return err
+			}
+			event := map[string]interface{}{
+				"timeUnixNano": strconv.FormatUint(start+uint64(delta), 10),
+			}
+			name := e["n"]
+			if ref, ok := trieJSONRef(name); ok {
+				if name, err = resolveValueRef(ref, dict); err != nil {
+					return err
+				}
+			}
+			event["name"] = name
+			if event["attributes"], err = revertAttributes(e["a"], dict); err != nil {
+				return err
+			}
+			if dac, ok := e["dac"]; ok {
+				event["droppedAttributesCount"] = dac
+			}
+			events[i] = event
+		}
+		leaf["events"] = events
+		delete(leaf, "ev")
+	}
+	if ln, ok := leaf["ln"]; ok {
+		links, ok := ln.([]interface{})
+		if !ok {
+			return errTrieJSON
+		}
+		for _, item := range links {
+			link, ok := item.(map[string]interface{})
+			if !ok {
+				return errTrieJSON
+			}
+			attributes, err := revertAttributes(link["a"], dict)
+			if err != nil {
+				return err
+			}
+			link["attributes"] = attributes
+			delete(link, "a")
+		}
+		leaf["links"] = links
+		delete(leaf, "ln")
+	}
+	return nil
+}
+
+// revertAttributes turns the {"k":"<key ref>","v":<value>} attributes of events and links back
+// into OTLP/JSON key values.
+func revertAttributes(list interface{}, dict *Dictionary) ([]interface{}, error) {
+	if list == nil {
+		return []interface{}{}, nil
+	}
+	items, ok := list.([]interface{})
+	if !ok {
+		return nil, errTrieJSON
+	}
+	attributes := make([]interface{}, len(items))
+	for i, item := range items {
+		kv, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errTrieJSON
+		}
+		ref, ok := kv["k"].(string)
+		if !ok {
+			return nil, errTrieJSON
+		}
+		key, ok := dict.Key(ref)
+		if !ok {
+			return nil, fmt.Errorf("%w: attribute %q", ErrUnknownReference, trieAttrPrefix+ref)
+		}
+		value := kv["v"]
+		if vref, ok := trieJSONRef(value); ok {
+			sv, err := resolveValueRef(vref, dict)
+			if err != nil {
+				return nil, err
+			}
+			value = map[string]interface{}{"stringValue": sv}
+		}
+		attributes[i] = map[string]interface{}{"key": key, "value": value}
+	}
+	return attributes, nil
+}
+
+// trieJSONRef returns the reference of an interned value written as {"ref":"<n>"}.
+func trieJSONRef(v interface{}) (interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	ref, ok := m["ref"]
+	return ref, ok
+}
+
+func resolveValueRef(ref interface{}, dict *Dictionary) (string, error) {
+	r, ok := ref.(string)
+	if !ok {
+		return "", errTrieJSON
+	}
+	value, ok := dict.Value(r)
+	if !ok {
+		return "", fmt.Errorf("%w: value %q", ErrUnknownReference, r)
+	}
+	return value, nil
+}
+
+func trieJSONUint64(v interface{}) (uint64, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, nil
+	case goJson.Number:
+		return strconv.ParseUint(n.String(), 10, 64)
+	default:
+		return 0, errTrieJSON
+	}
+}
@@ -0,0 +1,535 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func newCodecTestTraces() ptrace.Traces {
+	td := newTrieTestTraces()
+	spans := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	spans.At(0).Attributes().PutStr("http.method", "GET")
+	spans.At(0).Attributes().PutStr("http.route", "/cart")
+	spans.At(1).Attributes().PutStr("http.method", "POST")
+	spans.At(1).SetParentSpanID(spans.At(0).SpanID())
+	spans.At(2).Attributes().PutStr("db.system", "mysql")
+	return td
+}
+
+func TestEncodeDecodeCompressed(t *testing.T) {
+	td := newCodecTestTraces()
+
+	encDict := NewDictionary()
+	buf, updates, err := EncodeCompressed(td, encDict)
+	require.NoError(t, err)
+	assert.Len(t, keyUpdates(updates), 3)
+	assert.Equal(t, 3, encDict.Len())
+
+	decDict := NewDictionary()
+	decDict.Apply(updates)
+	got, err := DecodeCompressed(buf, decDict)
+	require.NoError(t, err)
+	assertTracesEqual(t, td, got)
+
+	// The second payload reuses the attribute keys, only the span name seen often enough by now
+	// is interned.
+	buf, updates, err = EncodeCompressed(td, encDict)
+	require.NoError(t, err)
+	assert.Equal(t, []UpdatesEntry{{Kind: UpdateKindValue, Key: "GET /cart", Value: "0"}}, updates)
+	decDict.Apply(updates)
+	got, err = DecodeCompressed(buf, decDict)
+	require.NoError(t, err)
+	assertTracesEqual(t, td, got)
+}
+
+func TestEncodeDecodeCompressedProto(t *testing.T) {
+	td := newCodecTestTraces()
+
+	encDict := NewDictionary()
+	buf, updates, err := EncodeCompressedProto(td, encDict)
+	require.NoError(t, err)
+
+	decDict := NewDictionary()
+	decDict.Apply(updates)
+	got, err := DecodeCompressedProto(buf, decDict)
+	require.NoError(t, err)
+	assertTracesEqual(t, td, got)
+}
+
+func TestDecodeCompressedUnknownReference(t *testing.T) {
+	dict := NewDictionary()
+	_, _, err := EncodeCompressed(newCodecTestTraces(), dict)
+	require.NoError(t, err)
+	// The second payload does not carry the entries of the first one again.
+	buf, updates, err := EncodeCompressed(newCodecTestTraces(), dict)
+	require.NoError(t, err)
+	assert.Empty(t, keyUpdates(updates))
+	_, err = DecodeCompressed(buf, NewDictionary())
+	assert.ErrorIs(t, err, ErrUnknownReference)
+}
+
+func TestDecodeCompressedVersionMismatch(t *testing.T) {
+	codecs := []struct {
+		name   string
+		encode func(ptrace.Traces, *Dictionary) ([]byte, []UpdatesEntry, error)
+		decode func([]byte, *Dictionary) (ptrace.Traces, error)
+	}{
+		{name: "json", encode: EncodeCompressed, decode: DecodeCompressed},
+		{name: "proto", encode: EncodeCompressedProto, decode: DecodeCompressedProto},
+	}
+	for _, codec := range codecs {
+		t.Run(codec.name, func(t *testing.T) {
+			td := newCodecTestTraces()
+			encDict, decDict := NewDictionary(), NewDictionary()
+			buf, _, err := codec.encode(td, encDict)
+			require.NoError(t, err)
+			_, err = codec.decode(buf, decDict)
+			require.NoError(t, err)
+			assert.Equal(t, encDict.Version(), decDict.Version())
+
+			// The gateway restarted, the version of the payload tells before any reference
+			// is resolved.
+			buf, updates, err := codec.encode(td, encDict)
+			require.NoError(t, err)
+			assert.Empty(t, keyUpdates(updates))
+			restarted := NewDictionary()
+			_, err = codec.decode(buf, restarted)
+			require.ErrorIs(t, err, ErrUnknownReference)
+			assert.Contains(t, err.Error(), "the payload needs version")
+
+			restarted.Restore(encDict.Snapshot())
+			got, err := codec.decode(buf, restarted)
+			require.NoError(t, err)
+			assertTracesEqual(t, td, got)
+		})
+	}
+}
+
+func TestDecodeCompressedInBandUpdates(t *testing.T) {
+	td := newCodecTestTraces()
+	codecs := []struct {
+		name   string
+		encode func(ptrace.Traces, *Dictionary) ([]byte, []UpdatesEntry, error)
+		decode func([]byte, *Dictionary) (ptrace.Traces, error)
+	}{
+		{name: "json", encode: EncodeCompressed, decode: DecodeCompressed},
+		{name: "proto", encode: EncodeCompressedProto, decode: DecodeCompressedProto},
+	}
+	for _, codec := range codecs {
+		t.Run(codec.name, func(t *testing.T) {
+			encDict, decDict := NewDictionary(), NewDictionary()
+			buf, updates, err := codec.encode(td, encDict)
+			require.NoError(t, err)
+			require.NotEmpty(t, updates)
+
+			// The payload alone is enough, decoding applies the updates it carries.
+			got, err := codec.decode(buf, decDict)
+			require.NoError(t, err)
+			assertTracesEqual(t, td, got)
+			assert.ElementsMatch(t, encDict.Entries(), decDict.Entries())
+		})
+	}
+}
+
+func TestDecodeCompressedInvalid(t *testing.T) {
+	for _, buf := range []string{
+		`{`,
+		`{"resourceSpans":[1]}`,
+		`{"resourceSpans":[{"scopeSpans":[{"tOffset":"x"}]}]}`,
+		`{"resourceSpans":[{"scopeSpans":[{"spans":[{"AN":"name","AV":"x"}]}]}]}`,
+		`{"resourceSpans":[{"scopeSpans":[{"spans":[{"AN":"name","AV":"x","Son":[{"stun":-1}]}]}]}]}`,
+	} {
+		_, err := DecodeCompressed([]byte(buf), NewDictionary())
+		assert.Error(t, err, buf)
+	}
+}
+
+// normalizeTraces sorts spans by id and span attributes by key, the two orders the trie does not keep.
+func normalizeTraces(td ptrace.Traces) ptrace.Traces {
+	out := ptrace.NewTraces()
+	td.CopyTo(out)
+	for i := 0; i < out.ResourceSpans().Len(); i++ {
+		sss := out.ResourceSpans().At(i).ScopeSpans()
+		for j := 0; j < sss.Len(); j++ {
+			spans := sss.At(j).Spans()
+			spans.Sort(func(a, b ptrace.Span) bool {
+				idA, idB := a.SpanID(), b.SpanID()
+				return bytes.Compare(idA[:], idB[:]) < 0
+			})
+			for k := 0; k < spans.Len(); k++ {
+				attrs := spans.At(k).Attributes()
+				keys := make([]string, 0, attrs.Len())
+				attrs.Range(func(k string, _ pcommon.Value) bool {
+					keys = append(keys, k)
+					return true
+				})
+				sort.Strings(keys)
+				sorted := pcommon.NewMap()
+				for _, key := range keys {
+					v, _ := attrs.Get(key)
+					v.CopyTo(sorted.PutEmpty(key))
+				}
+				sorted.CopyTo(attrs)
+			}
+		}
+	}
+	return out
+}
+
+func assertTracesEqual(t *testing.T, want, got ptrace.Traces) {
+	marshaler := &ptrace.JSONMarshaler{}
+	wantJSON, err := marshaler.MarshalTraces(normalizeTraces(want))
+	require.NoError(t, err)
+	gotJSON, err := marshaler.MarshalTraces(normalizeTraces(got))
+	require.NoError(t, err)
+	assert.JSONEq(t, string(wantJSON), string(gotJSON))
+}
+
+func TestEncodeDecodeCompressedValues(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(v pcommon.Value)
+	}{
+		{name: "str", set: func(v pcommon.Value) { v.SetStr("GET") }},
+		{name: "str none sentinel", set: func(v pcommon.Value) { v.SetStr(trieNoneValue) }},
+		{name: "str empty", set: func(v pcommon.Value) { v.SetStr("") }},
+		{name: "int", set: func(v pcommon.Value) { v.SetInt(-42) }},
+		{name: "int max", set: func(v pcommon.Value) { v.SetInt(math.MaxInt64) }},
+		{name: "double", set: func(v pcommon.Value) { v.SetDouble(0.1) }},
+		{name: "double integral", set: func(v pcommon.Value) { v.SetDouble(3) }},
+		{name: "double large", set: func(v pcommon.Value) { v.SetDouble(math.MaxFloat64) }},
+		{name: "bool", set: func(v pcommon.Value) { v.SetBool(true) }},
+		{name: "bool false", set: func(v pcommon.Value) { v.SetBool(false) }},
+		{name: "bytes", set: func(v pcommon.Value) { v.SetEmptyBytes().FromRaw([]byte{0, 1, 0xfe, 0xff}) }},
+		{name: "empty", set: func(pcommon.Value) {}},
+		{name: "slice", set: func(v pcommon.Value) {
+			s := v.SetEmptySlice()
+			s.AppendEmpty().SetStr("a")
+			s.AppendEmpty().SetInt(1)
+			s.AppendEmpty().SetEmptySlice().AppendEmpty().SetBool(true)
+		}},
+		{name: "map", set: func(v pcommon.Value) {
+			m := v.SetEmptyMap()
+			m.PutStr("str", "a")
+			m.PutDouble("double", 1.5)
+			m.PutEmptyMap("nested").PutEmptyBytes("bytes").FromRaw([]byte("x"))
+		}},
+	}
+	codecs := []struct {
+		name   string
+		encode func(ptrace.Traces, *Dictionary) ([]byte, []UpdatesEntry, error)
+		decode func([]byte, *Dictionary) (ptrace.Traces, error)
+	}{
+		{name: "json", encode: EncodeCompressed, decode: DecodeCompressed},
+		{name: "proto", encode: EncodeCompressedProto, decode: DecodeCompressedProto},
+	}
+	for _, tt := range tests {
+		for _, codec := range codecs {
+			t.Run(tt.name+"/"+codec.name, func(t *testing.T) {
+				td := newTrieTestTraces()
+				rs := td.ResourceSpans().At(0)
+				tt.set(rs.Resource().Attributes().PutEmpty("resource.value"))
+				tt.set(rs.ScopeSpans().At(0).Scope().Attributes().PutEmpty("scope.value"))
+				spans := rs.ScopeSpans().At(0).Spans()
+				// The second span does not have the attribute, it takes the NONE branch of the trie.
+				tt.set(spans.At(0).Attributes().PutEmpty("value"))
+				spans.At(0).Attributes().PutStr("http.route", "/cart")
+				spans.At(1).Attributes().PutStr("http.route", "/cart")
+				event := spans.At(0).Events().AppendEmpty()
+				event.SetName("event")
+				event.SetTimestamp(spans.At(0).StartTimestamp())
+				tt.set(event.Attributes().PutEmpty("event.value"))
+				link := spans.At(2).Links().AppendEmpty()
+				link.SetTraceID(spans.At(0).TraceID())
+				link.SetSpanID(spans.At(0).SpanID())
+				tt.set(link.Attributes().PutEmpty("link.value"))
+
+				dict := NewDictionary()
+				buf, updates, err := codec.encode(td, dict)
+				require.NoError(t, err)
+				decDict := NewDictionary()
+				decDict.Apply(updates)
+				got, err := codec.decode(buf, decDict)
+				require.NoError(t, err)
+				assertTracesEqual(t, td, got)
+			})
+		}
+	}
+}
+
+func TestEncodeDecodeCompressedInternedValues(t *testing.T) {
+	codecs := []struct {
+		name   string
+		encode func(ptrace.Traces, *Dictionary) ([]byte, []UpdatesEntry, error)
+		decode func([]byte, *Dictionary) (ptrace.Traces, error)
+	}{
+		{name: "json", encode: EncodeCompressed, decode: DecodeCompressed},
+		{name: "proto", encode: EncodeCompressedProto, decode: DecodeCompressedProto},
+	}
+	for _, codec := range codecs {
+		t.Run(codec.name, func(t *testing.T) {
+			td := newCodecTestTraces()
+			td.ResourceSpans().At(0).Resource().Attributes().PutInt("process.pid", 42)
+			td.ResourceSpans().At(0).Resource().Attributes().PutStr("host.name", "node-1.example")
+
+			encDict, decDict := NewDictionary(), NewDictionary()
+			var first []byte
+			for i := 0; i < valueMinHits; i++ {
+				buf, updates, err := codec.encode(td, encDict)
+				require.NoError(t, err)
+				if i == 0 {
+					first = buf
+				}
+				decDict.Apply(updates)
+				got, err := codec.decode(buf, decDict)
+				require.NoError(t, err)
+				assertTracesEqual(t, td, got)
+			}
+			assert.Positive(t, encDict.ValueLen())
+			// Resources are sent once by fingerprint, their values are not interned.
+			for _, value := range []string{"GET /cart", "SELECT", "mysql"} {
+				_, _, ok := encDict.valueReference(value)
+				assert.True(t, ok, "%q is not interned", value)
+			}
+
+			buf, _, err := codec.encode(td, encDict)
+			require.NoError(t, err)
+			assert.Less(t, len(buf), len(first))
+			_, err = codec.decode(buf, NewDictionary())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTrieBuilderCardinalityOrder(t *testing.T) {
+	td := ptrace.NewTraces()
+	spans := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	for i := 0; i < 4; i++ {
+		span := spans.AppendEmpty()
+		span.SetName("GET /cart")
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		// First seen, but a different value on every span.
+		span.Attributes().PutStr("user.id", strconv.Itoa(i))
+		span.Attributes().PutStr("http.method", []string{"GET", "POST"}[i%2])
+		span.Attributes().PutStr("http.route", "/cart")
+	}
+
+	dict := NewDictionary()
+	buf, updates, err := EncodeCompressed(td, dict)
+	require.NoError(t, err)
+	assert.Contains(t, updates, UpdatesEntry{Kind: UpdateKindOrder, Key: "GET /cart", Value: "2,1,0"})
+	order, ok := dict.Order("GET /cart")
+	require.True(t, ok)
+	assert.Equal(t, []string{"2", "1", "0"}, order)
+
+	// http.route is shared by every span, it is the only node below the name.
+	var body struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					Son []struct {
+						AN  string
+						Son []interface{}
+					}
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(buf, &body))
+	sons := body.ResourceSpans[0].ScopeSpans[0].Spans[0].Son
+	require.Len(t, sons, 1)
+	assert.Equal(t, "attr_2", sons[0].AN)
+	assert.Len(t, sons[0].Son, 2)
+
+	decDict := NewDictionary()
+	decDict.Apply(updates)
+	order, ok = decDict.Order("GET /cart")
+	require.True(t, ok)
+	assert.Equal(t, []string{"2", "1", "0"}, order)
+	got, err := DecodeCompressed(buf, decDict)
+	require.NoError(t, err)
+	assertTracesEqual(t, td, got)
+}
+
+func TestEncodeDecodeCompressedTraceLinks(t *testing.T) {
+	td := ptrace.NewTraces()
+	spans := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	traceA := pcommon.TraceID([16]byte{0xa, 1})
+	traceB := pcommon.TraceID([16]byte{0xb, 1})
+	newSpan := func(name string, trace pcommon.TraceID, id byte, parent pcommon.SpanID) {
+		span := spans.AppendEmpty()
+		span.SetName(name)
+		span.SetTraceID(trace)
+		span.SetSpanID(pcommon.SpanID([8]byte{id}))
+		span.SetParentSpanID(parent)
+		span.SetStartTimestamp(pcommon.Timestamp(1700000000000000000 + uint64(id)))
+	}
+	// The child comes before its parent, and the name levels split them apart.
+	newSpan("SELECT", traceA, 2, pcommon.SpanID([8]byte{1}))
+	newSpan("GET /cart", traceA, 1, pcommon.SpanID{})
+	// Same span ID in another trace, its parent is not in the batch.
+	newSpan("SELECT", traceB, 1, pcommon.SpanID([8]byte{9}))
+	newSpan("SELECT", traceB, 3, pcommon.SpanID([8]byte{1}))
+
+	// Only the parents in the batch become indexes, the others stay raw IDs.
+	buf, _, err := EncodeCompressed(td, NewDictionary())
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(buf), `"p":`))
+	assert.Contains(t, string(buf), `"parentSpanId":"0900000000000000"`)
+
+	codecs := []struct {
+		name   string
+		encode func(ptrace.Traces, *Dictionary) ([]byte, []UpdatesEntry, error)
+		decode func([]byte, *Dictionary) (ptrace.Traces, error)
+	}{
+		{name: "json", encode: EncodeCompressed, decode: DecodeCompressed},
+		{name: "proto", encode: EncodeCompressedProto, decode: DecodeCompressedProto},
+	}
+	for _, codec := range codecs {
+		t.Run(codec.name, func(t *testing.T) {
+			buf, updates, err := codec.encode(td, NewDictionary())
+			require.NoError(t, err)
+			dict := NewDictionary()
+			dict.Apply(updates)
+			got, err := codec.decode(buf, dict)
+			require.NoError(t, err)
+			assertTracesEqual(t, td, got)
+
+			// Each trace ID is sent once.
+			assert.Equal(t, 1, bytes.Count(buf, traceA[:])+strings.Count(string(buf), hex.EncodeToString(traceA[:])))
+		})
+	}
+}
+
+func TestEncodeDecodeCompressedEventsAndLinks(t *testing.T) {
+	td := newCodecTestTraces()
+	spans := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	for i := 0; i < spans.Len(); i++ {
+		span := spans.At(i)
+		event := span.Events().AppendEmpty()
+		event.SetName("exception")
+		event.SetTimestamp(span.StartTimestamp() + 10)
+		event.Attributes().PutStr("exception.type", "java.lang.NullPointerException")
+		event.Attributes().PutStr("exception.message", "cart is null")
+		event.Attributes().PutStr("exception.stacktrace", "at Cart.get(Cart.java:42)")
+		event.SetDroppedAttributesCount(uint32(i))
+		// An event before the span start.
+		span.Events().AppendEmpty().SetTimestamp(span.StartTimestamp() - 5)
+
+		link := span.Links().AppendEmpty()
+		link.SetTraceID(pcommon.TraceID([16]byte{0xc}))
+		link.SetSpanID(pcommon.SpanID([8]byte{0xc, byte(i)}))
+		link.TraceState().FromRaw("k=v")
+		link.Attributes().PutStr("link.kind", "follows_from")
+	}
+
+	codecs := []struct {
+		name   string
+		encode func(ptrace.Traces, *Dictionary) ([]byte, []UpdatesEntry, error)
+		decode func([]byte, *Dictionary) (ptrace.Traces, error)
+	}{
+		{name: "json", encode: EncodeCompressed, decode: DecodeCompressed},
+		{name: "proto", encode: EncodeCompressedProto, decode: DecodeCompressedProto},
+	}
+	for _, codec := range codecs {
+		t.Run(codec.name, func(t *testing.T) {
+			encDict, decDict := NewDictionary(), NewDictionary()
+			buf, updates, err := codec.encode(td, encDict)
+			require.NoError(t, err)
+			for _, key := range []string{"exception.type", "exception.message", "exception.stacktrace", "link.kind"} {
+				assert.Contains(t, updates, UpdatesEntry{Key: key, Value: encDict.refs[key]})
+			}
+			// The event name and values repeated by the three spans are interned right away.
+			for _, value := range []string{"exception", "java.lang.NullPointerException", "follows_from"} {
+				assert.Contains(t, updates, UpdatesEntry{Kind: UpdateKindValue, Key: value, Value: encDict.valueRefs[value]})
+			}
+			got, err := codec.decode(buf, decDict)
+			require.NoError(t, err)
+			assertTracesEqual(t, td, got)
+
+			// Once the updates were carried, keys and values are sent as references only.
+			buf, updates, err = codec.encode(td, encDict)
+			require.NoError(t, err)
+			assert.Empty(t, keyUpdates(updates))
+			assert.NotContains(t, string(buf), "exception.type")
+			assert.NotContains(t, string(buf), "java.lang.NullPointerException")
+			got, err = codec.decode(buf, decDict)
+			require.NoError(t, err)
+			assertTracesEqual(t, td, got)
+		})
+	}
+}
+
+func TestEncodeDecodeCompressedFingerprints(t *testing.T) {
+	codecs := []struct {
+		name   string
+		encode func(ptrace.Traces, *Dictionary) ([]byte, []UpdatesEntry, error)
+		decode func([]byte, *Dictionary) (ptrace.Traces, error)
+	}{
+		{name: "json", encode: EncodeCompressed, decode: DecodeCompressed},
+		{name: "proto", encode: EncodeCompressedProto, decode: DecodeCompressedProto},
+	}
+	fingerprints := func(updates []UpdatesEntry) []UpdatesEntry {
+		var ret []UpdatesEntry
+		for _, entry := range updates {
+			if entry.Kind == UpdateKindResource || entry.Kind == UpdateKindScope {
+				ret = append(ret, entry)
+			}
+		}
+		return ret
+	}
+	for _, codec := range codecs {
+		t.Run(codec.name, func(t *testing.T) {
+			td := newCodecTestTraces()
+			encDict, decDict := NewDictionary(), NewDictionary()
+
+			buf, updates, err := codec.encode(td, encDict)
+			require.NoError(t, err)
+			assert.Len(t, fingerprints(updates), 2)
+			decDict.Apply(updates)
+			got, err := codec.decode(buf, decDict)
+			require.NoError(t, err)
+			assertTracesEqual(t, td, got)
+
+			// The next batch only refers to the resource and the scope.
+			buf, updates, err = codec.encode(td, encDict)
+			require.NoError(t, err)
+			assert.Empty(t, fingerprints(updates))
+			decDict.Apply(updates)
+			got, err = codec.decode(buf, decDict)
+			require.NoError(t, err)
+			assertTracesEqual(t, td, got)
+
+			// A changed resource is announced again, the scope is not.
+			td.ResourceSpans().At(0).Resource().Attributes().PutStr("host.name", "node-2")
+			buf, updates, err = codec.encode(td, encDict)
+			require.NoError(t, err)
+			require.Len(t, fingerprints(updates), 1)
+			assert.Equal(t, UpdateKindResource, fingerprints(updates)[0].Kind)
+
+			// A decoder that lost its dictionary reports it, the entries of the encoder restore it.
+			lost := NewDictionary()
+			_, err = codec.decode(buf, lost)
+			assert.ErrorIs(t, err, ErrUnknownReference)
+			lost.Apply(encDict.Entries())
+			got, err = codec.decode(buf, lost)
+			require.NoError(t, err)
+			assertTracesEqual(t, td, got)
+		})
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/collector/pdata/internal"
+	otlptrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/trace/v1"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// TraceCompressor encodes traces into the prefix-trie format. It owns the state the encoding keeps
+// across requests: the attribute key dictionary and the per span name statistics and trie levels.
+// Each payload carries the dictionary entries the receiver has not acknowledged yet, so it can
+// be decoded whatever happened to the payloads before it.
+// Each exporter should own one TraceCompressor; it is safe for concurrent use.
+type TraceCompressor struct {
+	mu sync.Mutex
+
+	builder *trieBuilder
+
+	trieSpanProto []*TrieSpan
+	protoOrder    map[string]string // span name -> level order trieSpanProto was built with
+	recordsList   map[string]int    // accumulating calculate
+	totalRecord   int
+	nameUse       map[string]int // span name -> last build it was seen in
+	builds        int
+	maxNames      int // bound of the span names without order entry, 0 for none
+
+	zstd *zstdStage // nil unless EnableZstd was called
+
+	sampling   SamplingPolicy
+	sampledOut int64 // spans dropped by the sampling policy
+
+	pending []UpdatesEntry // dictionary entries not acknowledged by the receiver, oldest first
+}
+
+// NewTraceCompressor returns a TraceCompressor with an empty dictionary.
+func NewTraceCompressor() *TraceCompressor {
+	return &TraceCompressor{
+		builder:       newTrieBuilder(NewDictionary()),
+		trieSpanProto: make([]*TrieSpan, 0),
+		protoOrder:    make(map[string]string),
+		recordsList:   make(map[string]int),
+		nameUse:       make(map[string]int),
+	}
+}
+
+// SetTimestampMode selects how span times are written, TimestampModeDelta by default.
+// Gateways decoding only TimestampModeOffset need it set to that.
+func (c *TraceCompressor) SetTimestampMode(mode TimestampMode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.builder.timeMode = mode
+}
+
+// EnableZstd compresses the payloads with zstd after the trie step, using a dictionary trained
+// on recent payloads. A trained dictionary is carried as an UpdateKindZstd entry and used once
+// it is acknowledged. DecodeCompressed and DecodeCompressedProto recognize the compressed payloads.
+func (c *TraceCompressor) EnableZstd() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.zstd != nil {
+		return nil
+	}
+	z, err := newZstdStage()
+	if err != nil {
+		return err
+	}
+	c.zstd = z
+	return nil
+}
+
+// DictionaryEntries returns every entry of the dictionary. A receiver that answers with an
+// unknown reference lost its dictionary, it is restored by sending it these entries.
+func (c *TraceCompressor) DictionaryEntries() []UpdatesEntry {
+	return c.builder.dict.Entries()
+}
+
+// DictionarySnapshot returns every entry of the dictionary along with its version, the
+// receiver Restores it to get to the version the payloads are stamped with.
+func (c *TraceCompressor) DictionarySnapshot() DictionarySnapshot {
+	return c.builder.dict.Snapshot()
+}
+
+// PendingUpdates returns the dictionary entries the receiver has not acknowledged yet, the next
+// payload carries them.
+func (c *TraceCompressor) PendingUpdates() []UpdatesEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := make([]UpdatesEntry, len(c.pending))
+	copy(pending, c.pending)
+	return pending
+}
+
+// RestoreDictionary replaces the dictionary with a snapshot returned by DictionarySnapshot, e.g.
+// one persisted before a restart. The receiver that kept its dictionary decodes the next
+// payloads without the entries being sent again.
+func (c *TraceCompressor) RestoreDictionary(s DictionarySnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.builder.dict.Restore(s)
+	c.pending = nil
+}
+
+// Acknowledge records that the receiver decoded a payload carrying updates, they are not
+// carried by the next payloads any more. Call it with the entries returned along with the
+// payload once the receiver accepted it.
+func (c *TraceCompressor) Acknowledge(updates []UpdatesEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	acked := make(map[UpdatesEntry]bool, len(updates))
+	for _, entry := range updates {
+		acked[entry] = true
+		if entry.Kind == UpdateKindZstd && c.zstd != nil {
+			c.zstd.acknowledge(entry.Value)
+		}
+	}
+	pending := c.pending[:0]
+	for _, entry := range c.pending {
+		if !acked[entry] {
+			pending = append(pending, entry)
+		}
+	}
+	c.pending = pending
+}
+
+// MarshalTraces marshals td into the JSON prefix-trie encoding. The payload carries the dictionary
+// entries the receiver has not acknowledged, they are returned for Acknowledge and are nil if
+// there are none.
+func (c *TraceCompressor) MarshalTraces(td ptrace.Traces) ([]byte, []UpdatesEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	orig := internal.GetOrigTraces(internal.Traces(td))
+	data, updatesEntry := c.buildTrie(orig.ResourceSpans)
+
+	v, err := marshalTrieJSON(c.builder.dict.Version(), updatesEntry, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.compress(v, updatesEntry)
+}
+
+// MarshalTracesProto marshals td into the binary prefix-trie encoding described in trie.proto.
+// The dictionary entries are returned the same way as by MarshalTraces.
+func (c *TraceCompressor) MarshalTracesProto(td ptrace.Traces) ([]byte, []UpdatesEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, updatesEntry := c.buildTrie(internal.GetOrigTraces(internal.Traces(td)).ResourceSpans)
+	v, err := marshalTrieProto(c.builder.dict.Version(), updatesEntry, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.compress(v, updatesEntry)
+}
+
+// compress runs the zstd stage on the payload v if it is enabled. A newly trained dictionary is
+// left to the next payloads to carry, v is marshaled already.
+func (c *TraceCompressor) compress(v []byte, updates []UpdatesEntry) ([]byte, []UpdatesEntry, error) {
+	if c.zstd == nil {
+		return v, updates, nil
+	}
+	out, entry, err := c.zstd.compress(v, c.builder.dict)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry != nil {
+		c.pending = append(c.pending, *entry)
+	}
+	return out, updates, nil
+}
+
+// buildTrie builds the tries of rss and returns them with the entries the payload has to carry:
+// the pending ones, including those created by this build.
+func (c *TraceCompressor) buildTrie(rss []*otlptrace.ResourceSpans) ([]ExportData, []UpdatesEntry) {
+	c.builds++
+	for _, rspan := range rss {
+		for _, sspan := range rspan.ScopeSpans {
+			for _, span := range sspan.Spans {
+				c.nameUse[span.Name] = c.builds
+			}
+		}
+	}
+	data, updates := c.builder.build(rss)
+	for _, entry := range updates {
+		if entry.Kind == UpdateKindEvict && entry.Key == UpdateKindOrder {
+			c.forgetName(entry.Value)
+		}
+	}
+	c.evictNames()
+	c.pending = append(c.pending, updates...)
+	if len(c.pending) == 0 {
+		return data, nil
+	}
+	carried := make([]UpdatesEntry, len(c.pending))
+	copy(carried, c.pending)
+	return data, carried
+}
+
+// forgetName drops the statistics of the spans called name, evicted from the dictionary.
+func (c *TraceCompressor) forgetName(name string) {
+	for i, spanProto := range c.trieSpanProto {
+		if spanProto.AV == name {
+			c.trieSpanProto = append(c.trieSpanProto[:i], c.trieSpanProto[i+1:]...)
+			break
+		}
+	}
+	c.totalRecord -= c.recordsList[name]
+	delete(c.recordsList, name)
+	delete(c.protoOrder, name)
+	delete(c.nameUse, name)
+}
+
+// evictNames drops the statistics of the least recently seen span names beyond maxNames. Only
+// names without attributes, and so without order entry, are concerned, the others go with
+// their order entry.
+func (c *TraceCompressor) evictNames() {
+	if c.maxNames <= 0 || len(c.nameUse) <= c.maxNames {
+		return
+	}
+	var names []string
+	for name, last := range c.nameUse {
+		if _, ok := c.builder.dict.Order(name); !ok && last != c.builds {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return c.nameUse[names[i]] < c.nameUse[names[j]] })
+	for _, name := range names {
+		if len(c.nameUse) <= c.maxNames {
+			break
+		}
+		c.forgetName(name)
+	}
+}
+
+// SetDictionaryLimits bounds the dictionary and the span name statistics, see DictionaryLimits.
+// The statistics of a span name go with its order entry.
+func (c *TraceCompressor) SetDictionaryLimits(limits DictionaryLimits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.builder.dict.SetLimits(limits)
+	c.maxNames = limits.MaxEntries
+}
+
+// SetDictionarySeed starts the dictionary over with the keys of seed, the decoding side must use
+// the same seed. It is meant to be called before the first payload is marshaled.
+func (c *TraceCompressor) SetDictionarySeed(seed DictionarySeed) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.builder.dict.setSeed(seed)
+	c.pending = nil
+}
+
+// abnormal walks the record through trieSpanProto, the trie of every span seen so far, and
+// reports whether it has a rare name or a rare attribute path.
+func (c *TraceCompressor) abnormal(record *trieRecord) bool {
+	abnormalDetect := false
+	var iterProto *TrieSpan
+	for _, spanProto := range c.trieSpanProto {
+		if spanProto.AV == record.name {
+			iterProto = spanProto
+			spanProto.Count++
+			break
+		}
+	}
+	if iterProto == nil { // if didn't find, create it
+		iterProto = &TrieSpan{
+			AN:    trieNameLevel,
+			AV:    record.name,
+			Son:   make([]interface{}, 0),
+			Count: 1,
+		}
+		c.trieSpanProto = append(c.trieSpanProto, iterProto)
+	}
+	attrList := c.builder.attrList
+	// The statistics below the name only hold for the level order they were collected with,
+	// start over when the builder reordered the levels. New levels are appended and keep them.
+	order := strings.Join(attrList[record.name], ",")
+	if prev := c.protoOrder[record.name]; prev != "" && order != prev && !strings.HasPrefix(order, prev+",") {
+		iterProto.Son = make([]interface{}, 0)
+		iterProto.Count = 1
+	}
+	c.protoOrder[record.name] = order
+	nameProto := iterProto
+	if len(attrList) > 0 && c.recordsList[record.name] > 0 && c.totalRecord/len(attrList)/10 >= c.recordsList[record.name] { // rare name
+		abnormalDetect = true
+	}
+	if len(attrList[record.name]) == 0 { // no attributes
+		return abnormalDetect
+	}
+	for _, attrName := range attrList[record.name] {
+		av := record.value(attrName)
+		nextProto := iterProto.son(attrName, av)
+		if nextProto != nil {
+			nextProto.Count++
+		} else {
+			nextProto = &TrieSpan{
+				AN:    attrName,
+				AV:    av,
+				Son:   make([]interface{}, 0),
+				Count: 1,
+			}
+			iterProto.Son = append(iterProto.Son, nextProto)
+		}
+		// INDICATE ABNORMAL RATE !!!!!!!
+		if len(iterProto.Son) > 0 && nameProto.Count/len(iterProto.Son)/10 >= nextProto.Count {
+			abnormalDetect = true
+		}
+		iterProto = nextProto
+	}
+
+	return abnormalDetect
+}
@@ -0,0 +1,394 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func TestTraceCompressorDictionaryUpdates(t *testing.T) {
+	td := newTrieTestTraces()
+	td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().PutStr("http.method", "GET")
+
+	c := NewTraceCompressor()
+	_, updates, err := c.MarshalTracesProto(td)
+	require.NoError(t, err)
+	assert.Equal(t, []UpdatesEntry{{Key: "http.method", Value: "0"}}, keyUpdates(updates))
+
+	// Keys are carried until the receiver acknowledges them.
+	_, updates, err = c.MarshalTraces(td)
+	require.NoError(t, err)
+	assert.Equal(t, []UpdatesEntry{{Key: "http.method", Value: "0"}}, keyUpdates(updates))
+	c.Acknowledge(updates)
+	_, updates, err = c.MarshalTraces(td)
+	require.NoError(t, err)
+	assert.Empty(t, keyUpdates(updates))
+
+	// Another compressor does not share the dictionary.
+	_, updates, err = NewTraceCompressor().MarshalTracesProto(td)
+	require.NoError(t, err)
+	assert.Equal(t, []UpdatesEntry{{Key: "http.method", Value: "0"}}, keyUpdates(updates))
+}
+
+func TestTraceCompressorDictionaryEntries(t *testing.T) {
+	td := newTrieTestTraces()
+	td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().PutStr("http.method", "GET")
+
+	c := NewTraceCompressor()
+	_, updates, err := c.MarshalTracesProto(td)
+	require.NoError(t, err)
+	c.Acknowledge(updates)
+	buf, _, err := c.MarshalTracesProto(td)
+	require.NoError(t, err)
+
+	// The receiver lost the acknowledged updates of the first request, the entries restore them.
+	dict := NewDictionary()
+	_, err = DecodeCompressedProto(buf, dict)
+	require.ErrorIs(t, err, ErrUnknownReference)
+	dict.Apply(c.DictionaryEntries())
+	_, err = DecodeCompressedProto(buf, dict)
+	require.NoError(t, err)
+
+	// The snapshot restores the version along with the entries.
+	dict = NewDictionary()
+	dict.Restore(c.DictionarySnapshot())
+	assert.Equal(t, c.builder.dict.Version(), dict.Version())
+	_, err = DecodeCompressedProto(buf, dict)
+	require.NoError(t, err)
+}
+
+func TestTraceCompressorRestoreDictionary(t *testing.T) {
+	td := newTrieTestTraces()
+	td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().PutStr("http.method", "GET")
+
+	c := NewTraceCompressor()
+	buf, updates, err := c.MarshalTracesProto(td)
+	require.NoError(t, err)
+	dict := NewDictionary()
+	_, err = DecodeCompressedProto(buf, dict)
+	require.NoError(t, err)
+	c.Acknowledge(updates)
+
+	// A restarted agent picks up where it left off, the receiver kept its dictionary.
+	restarted := NewTraceCompressor()
+	restarted.RestoreDictionary(c.DictionarySnapshot())
+	buf, updates, err = restarted.MarshalTracesProto(td)
+	require.NoError(t, err)
+	assert.Empty(t, keyUpdates(updates))
+	got, err := DecodeCompressedProto(buf, dict)
+	require.NoError(t, err)
+	// The restarted compressor samples the span with an attribute on statistics of its own.
+	assertSampledTracesEqual(t, td, got)
+}
+
+// assertSampledTracesEqual asserts that got is want without the spans that were sampled out.
+func assertSampledTracesEqual(t *testing.T, want, got ptrace.Traces) {
+	kept := make(map[pcommon.SpanID]bool)
+	for i := 0; i < got.ResourceSpans().Len(); i++ {
+		for j := 0; j < got.ResourceSpans().At(i).ScopeSpans().Len(); j++ {
+			spans := got.ResourceSpans().At(i).ScopeSpans().At(j).Spans()
+			for k := 0; k < spans.Len(); k++ {
+				kept[spans.At(k).SpanID()] = true
+			}
+		}
+	}
+	sampled := ptrace.NewTraces()
+	want.CopyTo(sampled)
+	for i := 0; i < sampled.ResourceSpans().Len(); i++ {
+		for j := 0; j < sampled.ResourceSpans().At(i).ScopeSpans().Len(); j++ {
+			sampled.ResourceSpans().At(i).ScopeSpans().At(j).Spans().RemoveIf(func(span ptrace.Span) bool {
+				return !kept[span.SpanID()]
+			})
+		}
+	}
+	assertTracesEqual(t, sampled, got)
+}
+
+func TestTraceCompressorDictionaryLimits(t *testing.T) {
+	const limit = 8
+	c := NewTraceCompressor()
+	c.SetDictionaryLimits(DictionaryLimits{MaxEntries: limit})
+	dict := NewDictionary()
+	for i := 0; i < 40; i++ {
+		// Every batch has a new span name and attribute key, like IDs leaking into them.
+		td := ptrace.NewTraces()
+		span := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		span.SetName("GET /user/" + strconv.Itoa(i))
+		span.Attributes().PutStr("user."+strconv.Itoa(i), "x")
+		span.Attributes().PutStr("http.route", "/user/{id}")
+		buf, updates, err := c.MarshalTracesProto(td)
+		require.NoError(t, err)
+		_, err = DecodeCompressedProto(buf, dict)
+		require.NoError(t, err)
+		c.Acknowledge(updates)
+	}
+	// Both sides evicted the same entries.
+	assert.Equal(t, c.DictionaryEntries(), dict.Entries())
+	assert.LessOrEqual(t, len(dict.Entries()), limit+3)
+	assert.LessOrEqual(t, len(c.builder.attrList), limit)
+	assert.LessOrEqual(t, len(c.recordsList), limit)
+	assert.LessOrEqual(t, len(c.trieSpanProto), limit)
+}
+
+func TestTraceCompressorDictionaryLimitsOptionalAttribute(t *testing.T) {
+	for _, proto := range []bool{false, true} {
+		c := NewTraceCompressor()
+		c.SetDictionaryLimits(DictionaryLimits{MaxEntries: 4})
+		dict := NewDictionary()
+		for i := 0; i < 4; i++ {
+			// "optional" stays a level of the spans called op while the batches only have spans
+			// without it.
+			td := ptrace.NewTraces()
+			spans := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+			a := spans.AppendEmpty()
+			a.SetName("op")
+			a.Attributes().PutStr("always", "a")
+			if i == 0 {
+				b := spans.AppendEmpty()
+				b.SetName("op")
+				b.Attributes().PutStr("always", "b")
+				b.Attributes().PutStr("optional", "b")
+			}
+			var buf []byte
+			var updates []UpdatesEntry
+			var err error
+			if proto {
+				buf, updates, err = c.MarshalTracesProto(td)
+				require.NoError(t, err)
+				_, err = DecodeCompressedProto(buf, dict)
+			} else {
+				buf, updates, err = c.MarshalTraces(td)
+				require.NoError(t, err)
+				_, err = DecodeCompressed(buf, dict)
+			}
+			require.NoError(t, err, "batch %d", i)
+			c.Acknowledge(updates)
+		}
+		assert.Equal(t, c.DictionaryEntries(), dict.Entries())
+	}
+}
+
+func TestTraceCompressorDictionaryLimitsOutOfOrder(t *testing.T) {
+	c := NewTraceCompressor()
+	c.SetDictionaryLimits(DictionaryLimits{MaxEntries: 8})
+	dict := NewDictionary()
+	batch := func(i int) ptrace.Traces {
+		td := ptrace.NewTraces()
+		span := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		span.SetName("GET /user/" + strconv.Itoa(i))
+		span.Attributes().PutStr("user."+strconv.Itoa(i), "x")
+		span.Attributes().PutStr("http.route", "/user/{id}")
+		return td
+	}
+	for i := 0; i < 40; i += 2 {
+		// Two consumers send a batch each, the second one evicting entries of the first arrives
+		// first.
+		first, second := batch(i), batch(i+1)
+		buf1, updates1, err := c.MarshalTracesProto(first)
+		require.NoError(t, err)
+		buf2, updates2, err := c.MarshalTracesProto(second)
+		require.NoError(t, err)
+
+		got, err := DecodeCompressedProto(buf2, dict)
+		require.NoError(t, err)
+		assertTracesEqual(t, second, got)
+		got, err = DecodeCompressedProto(buf1, dict)
+		require.NoError(t, err, "batch %d", i)
+		assertTracesEqual(t, first, got)
+		c.Acknowledge(updates1)
+		c.Acknowledge(updates2)
+	}
+	// The late batches did not bring back the entries evicted before them.
+	assert.Equal(t, c.DictionaryEntries(), dict.Entries())
+}
+
+// keyUpdates returns the attribute key entries of updates.
+func keyUpdates(updates []UpdatesEntry) []UpdatesEntry {
+	var keys []UpdatesEntry
+	for _, entry := range updates {
+		if entry.Kind == "" {
+			keys = append(keys, entry)
+		}
+	}
+	return keys
+}
+
+// fixedUpdates drops the value entries, which depend on the spans that were sampled, from updates.
+func fixedUpdates(updates []UpdatesEntry) []UpdatesEntry {
+	var fixed []UpdatesEntry
+	for _, entry := range updates {
+		if entry.Kind != UpdateKindValue {
+			fixed = append(fixed, entry)
+		}
+	}
+	return fixed
+}
+
+func TestTraceCompressorAcknowledge(t *testing.T) {
+	td := newTrieTestTraces()
+	c := NewTraceCompressor()
+	buf1, updates1, err := c.MarshalTracesProto(td)
+	require.NoError(t, err)
+	fixed1 := fixedUpdates(updates1)
+	require.NotEmpty(t, fixed1)
+
+	td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().PutStr("http.method", "GET")
+	buf2, updates2, err := c.MarshalTracesProto(td)
+	require.NoError(t, err)
+	fixed2 := fixedUpdates(updates2)
+	assert.Subset(t, fixed2, fixed1)
+	assert.Equal(t, updates2, c.PendingUpdates())
+	assert.Contains(t, fixed2, UpdatesEntry{Key: "http.method", Value: c.builder.dict.refs["http.method"]})
+
+	// Payloads decode in any order, even when the first one is lost.
+	dict := NewDictionary()
+	_, err = DecodeCompressedProto(buf2, dict)
+	require.NoError(t, err)
+	_, err = DecodeCompressedProto(buf1, dict)
+	require.NoError(t, err)
+
+	// Acknowledging the first payload leaves the entries only the second one introduced.
+	c.Acknowledge(updates1)
+	_, updates3, err := c.MarshalTracesProto(td)
+	require.NoError(t, err)
+	fixed3 := fixedUpdates(updates3)
+	assert.NotEmpty(t, fixed3)
+	for _, entry := range fixed3 {
+		assert.NotContains(t, fixed1, entry)
+	}
+	c.Acknowledge(updates3)
+	_, updates4, err := c.MarshalTracesProto(td)
+	require.NoError(t, err)
+	assert.Empty(t, fixedUpdates(updates4))
+}
+
+func TestTraceCompressorDictionarySeed(t *testing.T) {
+	seed := NewDictionarySeed([]string{"http.method", "db.system"})
+	c := NewTraceCompressor()
+	c.SetDictionarySeed(seed)
+	buf, updates, err := c.MarshalTracesProto(newCodecTestTraces())
+	require.NoError(t, err)
+	// Only the key outside the seed is announced.
+	assert.Equal(t, []UpdatesEntry{{Key: "http.route", Value: "2"}}, keyUpdates(updates))
+
+	dict := NewSeededDictionary(seed)
+	td, err := DecodeCompressedProto(buf, dict)
+	require.NoError(t, err)
+	for i := 0; i < td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().Len(); i++ {
+		span := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(i)
+		if span.Name() == "SELECT" {
+			v, ok := span.Attributes().Get("db.system")
+			require.True(t, ok)
+			assert.Equal(t, "mysql", v.Str())
+		}
+	}
+}
+
+func TestTraceCompressorConcurrent(t *testing.T) {
+	c := NewTraceCompressor()
+	var mu sync.Mutex
+	refs := map[string]string{}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			td := newTrieTestTraces()
+			attrs := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes()
+			attrs.PutStr("shared", "x")
+			attrs.PutStr("key."+strconv.Itoa(i), "y")
+			_, updates, err := c.MarshalTracesProto(td)
+			assert.NoError(t, err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			// Unacknowledged entries are carried again, a reference must keep its key.
+			for _, entry := range keyUpdates(updates) {
+				if key, ok := refs[entry.Value]; ok {
+					assert.Equal(t, key, entry.Key, "reference %q assigned twice", entry.Value)
+				}
+				refs[entry.Value] = entry.Key
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, refs, 9)
+}
+
+func TestTraceCompressorReorder(t *testing.T) {
+	c := NewTraceCompressor()
+	orders := func(updates []UpdatesEntry) []string {
+		var ret []string
+		for _, entry := range updates {
+			if entry.Kind == UpdateKindOrder {
+				ret = append(ret, entry.Value)
+			}
+		}
+		return ret
+	}
+	batch := func(i int) ptrace.Traces {
+		td := ptrace.NewTraces()
+		span := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		span.SetName("GET /cart")
+		span.Attributes().PutStr("user.id", strconv.Itoa(i))
+		span.Attributes().PutStr("http.route", "/cart")
+		return td
+	}
+
+	_, updates, err := c.MarshalTracesProto(batch(0))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0,1"}, orders(updates))
+	c.Acknowledge(updates)
+
+	// user.id gets a new value on every batch, it moves below http.route at the next evaluation.
+	for i := 1; i < trieReorderInterval; i++ {
+		_, updates, err = c.MarshalTracesProto(batch(i))
+		require.NoError(t, err)
+		assert.Empty(t, orders(updates))
+		c.Acknowledge(updates)
+	}
+	_, updates, err = c.MarshalTracesProto(batch(trieReorderInterval))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1,0"}, orders(updates))
+}
+
+func TestTraceCompressorTimestampModes(t *testing.T) {
+	td := newTrieTestTraces()
+	spans := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	// Out of order starts, and an end before its start.
+	spans.At(0).SetStartTimestamp(spans.At(1).StartTimestamp() + 500)
+	spans.At(2).SetEndTimestamp(spans.At(2).StartTimestamp() - 1)
+
+	sizes := map[TimestampMode]int{}
+	for _, mode := range []TimestampMode{TimestampModeOffset, TimestampModeDelta} {
+		c := NewTraceCompressor()
+		c.SetTimestampMode(mode)
+
+		buf, updates, err := c.MarshalTracesProto(td)
+		require.NoError(t, err)
+		dict := NewDictionary()
+		dict.Apply(updates)
+		got, err := DecodeCompressedProto(buf, dict)
+		require.NoError(t, err)
+		assertTracesEqual(t, td, got)
+		sizes[mode] = len(buf)
+
+		buf, updates, err = c.MarshalTraces(td)
+		require.NoError(t, err)
+		dict.Apply(updates)
+		got, err = DecodeCompressed(buf, dict)
+		require.NoError(t, err)
+		assertTracesEqual(t, td, got)
+	}
+	assert.Less(t, sizes[TimestampModeDelta], sizes[TimestampModeOffset])
+}
@@ -0,0 +1,476 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// UpdateKindValue marks an UpdatesEntry of the value dictionary.
+	UpdateKindValue = "value"
+	// UpdateKindOrder marks an UpdatesEntry announcing the level order of a span name.
+	UpdateKindOrder = "order"
+	// UpdateKindResource marks an UpdatesEntry announcing a resource by its fingerprint.
+	UpdateKindResource = "resource"
+	// UpdateKindScope marks an UpdatesEntry announcing an instrumentation scope by its fingerprint.
+	UpdateKindScope = "scope"
+	// UpdateKindZstd marks an UpdatesEntry announcing a trained zstd dictionary.
+	UpdateKindZstd = "zstd"
+
+	// valueMinHits is how often a string has to be seen before it is interned, rarer values stay inline.
+	valueMinHits = 3
+	// valueMinLen is the shortest string worth interning, a reference is not shorter than that.
+	valueMinLen = 4
+)
+
+// UpdatesEntry announces that Key is referenced as Value in prefix-trie payloads. With an empty
+// Kind Key is an attribute key used on the attr_<Value> levels, with UpdateKindValue it is an
+// interned string value: a span name, or a string attribute value of a span or resource.
+// With UpdateKindOrder Key is a span name and Value the comma separated attribute key
+// references of its trie levels, from the root down. With UpdateKindResource and UpdateKindScope
+// Key is the definition of a resource or scope and Value its fingerprint, the payloads only
+// carry the fingerprint once it is announced. With UpdateKindZstd Key is a base64 zstd
+// dictionary and Value its zstd dictionary ID, which the compressed payloads name.
+type UpdatesEntry struct {
+	Kind  string `json:"kind,omitempty"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// DictionaryVersion identifies a state of a Dictionary. Epoch is drawn when the Dictionary is
+// created or restored and Version counts the changes made to it since, so the decoding side
+// can tell whether it has every entry a payload was encoded with.
+type DictionaryVersion struct {
+	Epoch   string `json:"epoch"`
+	Version uint64 `json:"version"`
+}
+
+// DictionarySnapshot is every entry of a Dictionary along with its version. Seed is the hash of
+// the seed the entries were assigned on top of, they are only meaningful with the same seed.
+type DictionarySnapshot struct {
+	DictionaryVersion
+	Seed    string         `json:"seed,omitempty"`
+	Entries []UpdatesEntry `json:"entries"`
+}
+
+// Bytes returns the size of the keys and values of the entries, the size DictionaryLimits
+// bounds.
+func (s DictionarySnapshot) Bytes() int {
+	n := 0
+	for _, entry := range s.Entries {
+		if entry.Kind != UpdateKindZstd {
+			n += len(entry.Key) + len(entry.Value)
+		}
+	}
+	return n
+}
+
+// Dictionary maps attribute keys to the short references used on the attr_<n> levels of the
+// prefix trie, and frequent string values to the references that replace them in the payload.
+// The encoding side assigns references, the decoding side learns them with Apply.
+// It is safe for concurrent use.
+type Dictionary struct {
+	mu sync.RWMutex
+
+	epoch   string
+	version uint64 // number of changes since the epoch started
+
+	refs map[string]string // attribute key -> reference
+	keys map[string]string // reference -> attribute key
+	next int
+
+	valueRefs map[string]string // string value -> reference
+	values    map[string]string // reference -> string value
+	valueHits map[string]int    // string value -> times seen before it was interned
+	nextValue int
+
+	orders map[string]string // span name -> level order, as announced
+
+	resources map[string]string // fingerprint -> resource definition
+	scopes    map[string]string // fingerprint -> scope definition
+
+	zstdDicts    map[string]string // zstd dictionary ID -> base64 dictionary
+	zstdOrder    []string          // zstd dictionary IDs, oldest first
+	zstdDecoders map[uint32]*zstd.Decoder
+
+	limits  DictionaryLimits
+	usage   map[usageKey]*entryUsage     // use of the entries assigned or looked up by the encoding side
+	retired map[string]map[string]string // kind -> reference -> entry evicted by the last eviction round
+	tick    uint64                       // current build
+
+	seed DictionarySeed // attribute keys on the lowest references, kept across resets
+}
+
+// NewDictionary returns an empty Dictionary with a new epoch.
+func NewDictionary() *Dictionary {
+	d := &Dictionary{}
+	d.reset(newEpoch())
+	return d
+}
+
+// newEpoch returns a random epoch, epochs of different dictionaries are not expected to collide.
+func newEpoch() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%016x", binary.BigEndian.Uint64(b[:]))
+}
+
+// reset empties the dictionary and starts epoch at version 0. d.mu must be held or d unshared.
+func (d *Dictionary) reset(epoch string) {
+	d.epoch, d.version = epoch, 0
+	d.refs = make(map[string]string)
+	d.keys = make(map[string]string)
+	d.next = 0
+	d.valueRefs = make(map[string]string)
+	d.values = make(map[string]string)
+	d.valueHits = make(map[string]int)
+	d.nextValue = 0
+	d.orders = make(map[string]string)
+	d.resources = make(map[string]string)
+	d.scopes = make(map[string]string)
+	d.zstdDicts = make(map[string]string)
+	d.zstdOrder = nil
+	d.zstdDecoders = make(map[uint32]*zstd.Decoder)
+	d.usage = make(map[usageKey]*entryUsage)
+	d.retired = nil
+	d.plantSeed()
+}
+
+// Apply records the references announced by the encoding side. Every entry that changes the
+// dictionary advances its version.
+func (d *Dictionary) Apply(updates []UpdatesEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.apply(updates, false)
+}
+
+// apply applies updates. The updates of a stale payload, one encoded before the dictionary
+// version, were applied already or evicted since, so they do not bring back the entries of the
+// last eviction round.
+func (d *Dictionary) apply(updates []UpdatesEntry, stale bool) {
+	var retiring map[string]map[string]string
+	for _, entry := range updates {
+		var m map[string]string
+		k, v := entry.Key, entry.Value
+		switch entry.Kind {
+		case UpdateKindOrder:
+			m = d.orders
+		case UpdateKindResource:
+			m, k, v = d.resources, entry.Value, entry.Key
+		case UpdateKindScope:
+			m, k, v = d.scopes, entry.Value, entry.Key
+		case UpdateKindEvict:
+			retiring = d.retireRef(retiring, entry.Key, entry.Value)
+			continue
+		case UpdateKindZstd:
+			if d.zstdDicts[entry.Value] == entry.Key || (stale && d.retired[UpdateKindZstd][entry.Value] == entry.Key) {
+				continue
+			}
+			d.recordZstd(entry.Value, entry.Key)
+			d.version++
+			continue
+		case UpdateKindValue:
+			if d.valueRefs[entry.Key] == entry.Value || (stale && d.retired[UpdateKindValue][entry.Value] == entry.Key) {
+				continue
+			}
+			d.valueRefs[entry.Key] = entry.Value
+			d.values[entry.Value] = entry.Key
+			delete(d.valueHits, entry.Key)
+			if n, err := strconv.Atoi(entry.Value); err == nil && n >= d.nextValue {
+				d.nextValue = n + 1
+			}
+			d.version++
+			continue
+		default:
+			if d.refs[entry.Key] == entry.Value || d.seeded(entry.Value) || (stale && d.retired[""][entry.Value] == entry.Key) {
+				continue
+			}
+			d.refs[entry.Key] = entry.Value
+			d.keys[entry.Value] = entry.Key
+			if n, err := strconv.Atoi(entry.Value); err == nil && n >= d.next {
+				d.next = n + 1
+			}
+			d.version++
+			continue
+		}
+		if prev, ok := m[k]; (ok && prev == v) || (stale && d.retired[entry.Kind][k] == v) {
+			continue
+		}
+		m[k] = v
+		d.version++
+	}
+	if retiring != nil {
+		d.retired = retiring
+	}
+}
+
+// Version returns the epoch and version of the dictionary.
+func (d *Dictionary) Version() DictionaryVersion {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return DictionaryVersion{Epoch: d.epoch, Version: d.version}
+}
+
+// Snapshot returns every entry of the dictionary along with its version.
+func (d *Dictionary) Snapshot() DictionarySnapshot {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return DictionarySnapshot{
+		DictionaryVersion: DictionaryVersion{Epoch: d.epoch, Version: d.version},
+		Seed:              d.seed.Hash(),
+		Entries:           d.entries(),
+	}
+}
+
+// Restore replaces the content of the dictionary with the snapshot of the encoding side.
+func (d *Dictionary) Restore(s DictionarySnapshot) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reset(s.Epoch)
+	d.apply(s.Entries, false)
+	d.version = s.Version
+}
+
+// sync applies the updates carried by a payload encoded with the dictionary at want. A
+// dictionary of another epoch is reset to that epoch first: the encoding side started over, the
+// payloads of the new epoch carry its entries. Payloads without epoch are only applied.
+func (d *Dictionary) sync(want DictionaryVersion, updates []UpdatesEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if want.Epoch == "" {
+		d.apply(updates, false)
+		return nil
+	}
+	if d.epoch != want.Epoch {
+		d.reset(want.Epoch)
+	}
+	d.apply(updates, want.Version < d.version)
+	if d.version < want.Version {
+		return fmt.Errorf("%w: dictionary %s is at version %d, the payload needs version %d",
+			ErrUnknownReference, d.epoch, d.version, want.Version)
+	}
+	return nil
+}
+
+// Key returns the attribute key referenced by ref.
+func (d *Dictionary) Key(ref string) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	key, ok := d.keys[ref]
+	if !ok {
+		key, ok = d.retired[""][ref]
+	}
+	return key, ok
+}
+
+// Value returns the string value referenced by ref.
+func (d *Dictionary) Value(ref string) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	value, ok := d.values[ref]
+	if !ok {
+		value, ok = d.retired[UpdateKindValue][ref]
+	}
+	return value, ok
+}
+
+// Order returns the attribute key references of the trie levels of the spans called name,
+// from the root down.
+func (d *Dictionary) Order(name string) ([]string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	order, ok := d.orders[name]
+	if !ok {
+		order, ok = d.retired[UpdateKindOrder][name]
+	}
+	if !ok {
+		return nil, false
+	}
+	if order == "" {
+		return []string{}, true
+	}
+	return strings.Split(order, ","), true
+}
+
+// Entries returns every reference of the dictionary as updates, Applying them to an empty
+// Dictionary restores the decoding side after it lost its state. The seeded keys are left out.
+func (d *Dictionary) Entries() []UpdatesEntry {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.entries()
+}
+
+func (d *Dictionary) entries() []UpdatesEntry {
+	entries := make([]UpdatesEntry, 0, len(d.refs)+len(d.valueRefs)+len(d.resources)+len(d.scopes)+len(d.zstdDicts)+len(d.orders))
+	entries = appendEntries(entries, "", d.syncedRefs(), false)
+	entries = appendEntries(entries, UpdateKindValue, d.valueRefs, false)
+	entries = appendEntries(entries, UpdateKindResource, d.resources, true)
+	entries = appendEntries(entries, UpdateKindScope, d.scopes, true)
+	for _, ref := range d.zstdOrder {
+		// Oldest first, so that applying them keeps the same dictionaries.
+		entries = append(entries, UpdatesEntry{Kind: UpdateKindZstd, Key: d.zstdDicts[ref], Value: ref})
+	}
+	return appendEntries(entries, UpdateKindOrder, d.orders, false)
+}
+
+// appendEntries appends m as updates of kind, sorted by key. inverse is set for maps keyed by
+// the UpdatesEntry Value.
+func appendEntries(entries []UpdatesEntry, kind string, m map[string]string, inverse bool) []UpdatesEntry {
+	start := len(entries)
+	for k, v := range m {
+		if inverse {
+			k, v = v, k
+		}
+		entries = append(entries, UpdatesEntry{Kind: kind, Key: k, Value: v})
+	}
+	added := entries[start:]
+	sort.Slice(added, func(i, j int) bool { return added[i].Key < added[j].Key })
+	return entries
+}
+
+// Len returns the number of attribute keys in the dictionary.
+func (d *Dictionary) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.refs)
+}
+
+// ValueLen returns the number of interned string values in the dictionary.
+func (d *Dictionary) ValueLen() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.valueRefs)
+}
+
+// reference returns the reference of key, assigning the next free one if key is new.
+// The returned entry is non-nil only when a reference was assigned.
+func (d *Dictionary) reference(key string) (string, *UpdatesEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.use("", key)
+	if ref, ok := d.refs[key]; ok {
+		return ref, nil
+	}
+	ref := strconv.Itoa(d.next)
+	d.next++
+	d.version++
+	d.refs[key] = ref
+	d.keys[ref] = key
+	return ref, &UpdatesEntry{Key: key, Value: ref}
+}
+
+// lookup returns the reference of key, without assigning one.
+func (d *Dictionary) lookup(key string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ref, ok := d.refs[key]
+	return ref, ok
+}
+
+// observe counts one more occurrence of value, it decides when valueReference interns it.
+func (d *Dictionary) observe(value string) {
+	if len(value) < valueMinLen {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.valueRefs[value]; !ok {
+		if len(d.valueHits) >= maxValueHits {
+			d.valueHits = make(map[string]int)
+		}
+		d.valueHits[value]++
+	}
+}
+
+// valueReference returns the reference of value if it is interned, interning it first if it has
+// been observed often enough. ok is false for values that stay inline. The returned entry is
+// non-nil only when a reference was assigned.
+func (d *Dictionary) valueReference(value string) (ref string, entry *UpdatesEntry, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ref, ok = d.valueRefs[value]; ok {
+		d.use(UpdateKindValue, value)
+		return ref, nil, true
+	}
+	if d.valueHits[value] < valueMinHits {
+		return "", nil, false
+	}
+	d.use(UpdateKindValue, value)
+	ref = strconv.Itoa(d.nextValue)
+	d.nextValue++
+	d.version++
+	d.valueRefs[value] = ref
+	d.values[ref] = value
+	delete(d.valueHits, value)
+	return ref, &UpdatesEntry{Kind: UpdateKindValue, Key: value, Value: ref}, true
+}
+
+// order records levels, the attr_<n> levels of the spans called name, as their order. The
+// returned entry is non-nil only when the order changed.
+func (d *Dictionary) order(name string, levels []string) *UpdatesEntry {
+	refs := make([]string, len(levels))
+	for i, level := range levels {
+		refs[i] = strings.TrimPrefix(level, trieAttrPrefix)
+	}
+	order := strings.Join(refs, ",")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.use(UpdateKindOrder, name)
+	if prev, ok := d.orders[name]; ok && prev == order {
+		return nil
+	}
+	d.orders[name] = order
+	d.version++
+	return &UpdatesEntry{Kind: UpdateKindOrder, Key: name, Value: order}
+}
+
+// fingerprint returns the fingerprint of def, the definition of a resource or a scope depending
+// on kind. The returned entry is non-nil only when def was not announced yet.
+func (d *Dictionary) fingerprint(kind, def string) (string, *UpdatesEntry) {
+	h := fnv.New64a()
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(def))
+	id := fmt.Sprintf("%016x", h.Sum64())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defs := d.definitions(kind)
+	d.use(kind, id)
+	if _, ok := defs[id]; ok {
+		return id, nil
+	}
+	defs[id] = def
+	d.version++
+	return id, &UpdatesEntry{Kind: kind, Key: def, Value: id}
+}
+
+// definition returns the resource or scope definition announced as id.
+func (d *Dictionary) definition(kind, id string) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	def, ok := d.definitions(kind)[id]
+	if !ok {
+		def, ok = d.retired[kind][id]
+	}
+	return def, ok
+}
+
+func (d *Dictionary) definitions(kind string) map[string]string {
+	if kind == UpdateKindScope {
+		return d.scopes
+	}
+	return d.resources
+}
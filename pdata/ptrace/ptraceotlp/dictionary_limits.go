@@ -0,0 +1,248 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"sort"
+	"strings"
+)
+
+// UpdateKindEvict marks an UpdatesEntry evicting the entry of kind Key referenced as Value, see
+// DictionaryLimits.
+const UpdateKindEvict = "evict"
+
+// maxValueHits bounds the strings counted for interning, the counts start over once it is
+// reached. Values seen only once, like IDs, would grow the counts forever otherwise.
+const maxValueHits = 1 << 16
+
+// EvictionPolicy selects the entries a bounded Dictionary evicts first.
+type EvictionPolicy string
+
+const (
+	// EvictionLRU evicts the least recently used entries.
+	EvictionLRU EvictionPolicy = "lru"
+	// EvictionLFU evicts the least frequently used entries.
+	EvictionLFU EvictionPolicy = "lfu"
+)
+
+// DictionaryLimits bounds the attribute keys, interned values, resources, scopes and span name
+// orders of a Dictionary, zero values do not limit. Entries are evicted by the encoding side
+// after a build, never the ones the build used, and announced as UpdateKindEvict entries so
+// the decoding side evicts the same ones. The decoding side still resolves the entries of the
+// last eviction round until the next one: payloads encoded before an eviction may arrive after
+// it when several are sent concurrently. The zstd dictionaries and the seeded keys are not
+// counted.
+type DictionaryLimits struct {
+	// MaxEntries is the number of entries kept.
+	MaxEntries int
+	// MaxBytes is the size of the keys and values of the entries kept.
+	MaxBytes int
+	// Policy selects the evicted entries, EvictionLRU if empty.
+	Policy EvictionPolicy
+}
+
+// usageKey names an entry by its kind and the key the encoding side looks it up with: the
+// attribute key, the string value, the fingerprint or the span name.
+type usageKey struct {
+	kind string
+	key  string
+}
+
+// entryUsage is when an entry was last used, in builds, and how often.
+type entryUsage struct {
+	last uint64
+	hits uint64
+}
+
+// SetLimits bounds the dictionary, see DictionaryLimits.
+func (d *Dictionary) SetLimits(limits DictionaryLimits) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.limits = limits
+}
+
+// advance starts a build, the entries it uses are not evicted by the evict that ends it.
+func (d *Dictionary) advance() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tick++
+}
+
+// use records a use of the entry of kind looked up by key. d.mu must be held.
+func (d *Dictionary) use(kind, key string) {
+	u := d.usage[usageKey{kind: kind, key: key}]
+	if u == nil {
+		u = &entryUsage{}
+		d.usage[usageKey{kind: kind, key: key}] = u
+	}
+	u.last = d.tick
+	u.hits++
+}
+
+// useName records a use of the order of the spans called name, if it is announced.
+func (d *Dictionary) useName(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.orders[name]; ok {
+		d.use(UpdateKindOrder, name)
+	}
+}
+
+// useLevels records a use of the attribute keys of the attr_<n> levels. Every span of a name
+// goes through all its levels, the ones without the attribute as NONE, so a level key is used
+// by the spans lacking it too.
+func (d *Dictionary) useLevels(levels []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, level := range levels {
+		if key, ok := d.keys[strings.TrimPrefix(level, trieAttrPrefix)]; ok {
+			d.use("", key)
+		}
+	}
+}
+
+// evictionCandidate is an entry that may be evicted.
+type evictionCandidate struct {
+	kind, ref string
+	size      int
+	usage     entryUsage
+}
+
+// evict evicts entries until the dictionary is within its limits and returns the
+// UpdateKindEvict entries announcing them. Entries used by the current build are kept.
+func (d *Dictionary) evict() []UpdatesEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.limits.MaxEntries <= 0 && d.limits.MaxBytes <= 0 {
+		return nil
+	}
+	var candidates []evictionCandidate
+	// keyedByRef is set for the maps keyed by the reference, the others are keyed by the key the
+	// entry is looked up with. Orders are both looked up and referenced by span name.
+	add := func(kind string, m map[string]string, keyedByRef bool) {
+		for k, v := range m {
+			ref := v
+			if keyedByRef {
+				ref = k
+			}
+			c := evictionCandidate{kind: kind, ref: ref, size: len(k) + len(v)}
+			if u := d.usage[usageKey{kind: kind, key: k}]; u != nil {
+				c.usage = *u
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	add("", d.syncedRefs(), false)
+	add(UpdateKindValue, d.valueRefs, false)
+	add(UpdateKindResource, d.resources, true)
+	add(UpdateKindScope, d.scopes, true)
+	add(UpdateKindOrder, d.orders, true)
+
+	count, size := len(candidates), 0
+	for _, c := range candidates {
+		size += c.size
+	}
+	within := func() bool {
+		return (d.limits.MaxEntries <= 0 || count <= d.limits.MaxEntries) &&
+			(d.limits.MaxBytes <= 0 || size <= d.limits.MaxBytes)
+	}
+	if within() {
+		return nil
+	}
+
+	lfu := d.limits.Policy == EvictionLFU
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].usage, candidates[j].usage
+		if lfu && a.hits != b.hits {
+			return a.hits < b.hits
+		}
+		if a.last != b.last {
+			return a.last < b.last
+		}
+		return a.hits < b.hits
+	})
+	var evicted []UpdatesEntry
+	for _, c := range candidates {
+		if within() {
+			break
+		}
+		if c.usage.hits > 0 && c.usage.last == d.tick {
+			continue
+		}
+		d.evictRef(c.kind, c.ref)
+		count--
+		size -= c.size
+		evicted = append(evicted, UpdatesEntry{Kind: UpdateKindEvict, Key: c.kind, Value: c.ref})
+	}
+	return evicted
+}
+
+// evictRef removes the entry of kind referenced as ref, an attribute key or value reference, a
+// fingerprint, or a span name for orders. It reports whether the entry existed. d.mu must be
+// held.
+func (d *Dictionary) evictRef(kind, ref string) bool {
+	var lookup string
+	switch kind {
+	case "":
+		key, ok := d.keys[ref]
+		if !ok || d.seeded(ref) {
+			return false
+		}
+		delete(d.keys, ref)
+		delete(d.refs, key)
+		lookup = key
+	case UpdateKindValue:
+		value, ok := d.values[ref]
+		if !ok {
+			return false
+		}
+		delete(d.values, ref)
+		delete(d.valueRefs, value)
+		lookup = value
+	case UpdateKindResource, UpdateKindScope, UpdateKindOrder:
+		m := d.orders
+		if kind != UpdateKindOrder {
+			m = d.definitions(kind)
+		}
+		if _, ok := m[ref]; !ok {
+			return false
+		}
+		delete(m, ref)
+		lookup = ref
+	default:
+		return false
+	}
+	delete(d.usage, usageKey{kind: kind, key: lookup})
+	d.version++
+	return true
+}
+
+// retireRef evicts the entry of kind referenced as ref on the decoding side and adds it to
+// retiring, the entries that replace the ones retired by the previous eviction round once the
+// updates of a payload are applied. d.mu must be held.
+func (d *Dictionary) retireRef(retiring map[string]map[string]string, kind, ref string) map[string]map[string]string {
+	var entry string
+	var ok bool
+	switch kind {
+	case "":
+		entry, ok = d.keys[ref]
+	case UpdateKindValue:
+		entry, ok = d.values[ref]
+	case UpdateKindOrder:
+		entry, ok = d.orders[ref]
+	case UpdateKindResource, UpdateKindScope:
+		entry, ok = d.definitions(kind)[ref]
+	}
+	if !ok || !d.evictRef(kind, ref) {
+		return retiring
+	}
+	if retiring == nil {
+		retiring = make(map[string]map[string]string)
+	}
+	if retiring[kind] == nil {
+		retiring[kind] = make(map[string]string)
+	}
+	retiring[kind][ref] = entry
+	return retiring
+}
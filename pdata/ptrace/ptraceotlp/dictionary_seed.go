@@ -0,0 +1,153 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DictionarySeed is a list of attribute keys both sides of a Dictionary know beforehand, like the
+// semantic convention keys. Seeded keys get the lowest references, in the order of the list, and
+// are never synchronized: they are not announced, snapshotted nor evicted. Both sides must use
+// the same seed, which they can check by comparing the Hash.
+type DictionarySeed struct {
+	keys []string
+	hash string
+}
+
+// NewDictionarySeed returns the seed of keys, without the empty and repeated ones.
+func NewDictionarySeed(keys []string) DictionarySeed {
+	seen := make(map[string]bool, len(keys))
+	var seed DictionarySeed
+	for _, key := range keys {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		seed.keys = append(seed.keys, key)
+	}
+	if len(seed.keys) > 0 {
+		sum := sha256.Sum256([]byte(strings.Join(seed.keys, "\n")))
+		seed.hash = fmt.Sprintf("%x", sum[:8])
+	}
+	return seed
+}
+
+// ParseDictionarySeed reads the keys of a seed file, one per line. Blank lines and lines starting
+// with # are skipped.
+func ParseDictionarySeed(buf []byte) []string {
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
+
+// DictionarySeedConfig configures a DictionarySeed, the exporters and receivers of the traces
+// dictionaries share it.
+type DictionarySeedConfig struct {
+	// The attribute keys, e.g. the semantic convention keys the services use.
+	Keys []string `mapstructure:"keys"`
+
+	// A file with more keys, one per line after Keys. Blank lines and lines starting with #
+	// are skipped.
+	File string `mapstructure:"file"`
+
+	// The expected hash of the seed, Load fails when the keys hash differently.
+	Hash string `mapstructure:"hash"`
+}
+
+// Load returns the seed of the keys and the file.
+func (cfg DictionarySeedConfig) Load() (DictionarySeed, error) {
+	keys := cfg.Keys
+	if cfg.File != "" {
+		buf, err := os.ReadFile(cfg.File)
+		if err != nil {
+			return DictionarySeed{}, fmt.Errorf("failed to read the seed dictionary: %w", err)
+		}
+		keys = append(append([]string(nil), keys...), ParseDictionarySeed(buf)...)
+	}
+	seed := NewDictionarySeed(keys)
+	if cfg.Hash != "" && cfg.Hash != seed.Hash() {
+		return DictionarySeed{}, fmt.Errorf("the seed dictionary hashes to %q, the configuration expects %q", seed.Hash(), cfg.Hash)
+	}
+	return seed, nil
+}
+
+// Keys returns the seeded attribute keys, the one at index i is referenced as i.
+func (s DictionarySeed) Keys() []string {
+	keys := make([]string, len(s.keys))
+	copy(keys, s.keys)
+	return keys
+}
+
+// Hash identifies the seed, it is empty for the empty seed.
+func (s DictionarySeed) Hash() string {
+	return s.hash
+}
+
+// NewSeededDictionary returns a Dictionary with a new epoch holding the keys of seed. They
+// survive the resets to other epochs and Restore.
+func NewSeededDictionary(seed DictionarySeed) *Dictionary {
+	d := &Dictionary{seed: seed}
+	d.reset(newEpoch())
+	return d
+}
+
+// Seed returns the seed of the dictionary.
+func (d *Dictionary) Seed() DictionarySeed {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.seed
+}
+
+// setSeed empties the dictionary and starts a new epoch holding the keys of seed.
+func (d *Dictionary) setSeed(seed DictionarySeed) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seed = seed
+	d.reset(newEpoch())
+}
+
+// plantSeed adds the keys of the seed to a dictionary that was just reset. d.mu must be held or
+// d unshared.
+func (d *Dictionary) plantSeed() {
+	for i, key := range d.seed.keys {
+		ref := strconv.Itoa(i)
+		d.refs[key] = ref
+		d.keys[ref] = key
+	}
+	d.next = len(d.seed.keys)
+}
+
+// seeded reports whether the attribute key reference ref belongs to the seed. d.mu must be held.
+func (d *Dictionary) seeded(ref string) bool {
+	n, err := strconv.Atoi(ref)
+	return err == nil && n >= 0 && n < len(d.seed.keys)
+}
+
+// syncedRefs returns the attribute key references without the seeded ones. d.mu must be held.
+func (d *Dictionary) syncedRefs() map[string]string {
+	if len(d.seed.keys) == 0 {
+		return d.refs
+	}
+	refs := make(map[string]string, len(d.refs)-len(d.seed.keys))
+	for key, ref := range d.refs {
+		if !d.seeded(ref) {
+			refs[key] = ref
+		}
+	}
+	return refs
+}
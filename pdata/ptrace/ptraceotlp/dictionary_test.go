@@ -0,0 +1,348 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDictionary(t *testing.T) {
+	d := NewDictionary()
+	ref, entry := d.reference("http.method")
+	assert.Equal(t, "0", ref)
+	assert.Equal(t, &UpdatesEntry{Key: "http.method", Value: "0"}, entry)
+
+	ref, entry = d.reference("http.method")
+	assert.Equal(t, "0", ref)
+	assert.Nil(t, entry)
+
+	key, ok := d.Key("0")
+	assert.True(t, ok)
+	assert.Equal(t, "http.method", key)
+	_, ok = d.Key("1")
+	assert.False(t, ok)
+	assert.Equal(t, 1, d.Len())
+}
+
+func TestDictionaryApply(t *testing.T) {
+	d := NewDictionary()
+	d.Apply([]UpdatesEntry{{Key: "http.method", Value: "0"}, {Key: "db.system", Value: "4"}})
+	key, ok := d.Key("4")
+	assert.True(t, ok)
+	assert.Equal(t, "db.system", key)
+
+	// References assigned after Apply do not collide with the applied ones.
+	ref, _ := d.reference("net.peer.ip")
+	assert.Equal(t, "5", ref)
+	ref, _ = d.reference("http.method")
+	assert.Equal(t, "0", ref)
+}
+
+func TestDictionaryValues(t *testing.T) {
+	d := NewDictionary()
+	for i := 0; i < valueMinHits-1; i++ {
+		d.observe("checkout")
+	}
+	_, _, ok := d.valueReference("checkout")
+	assert.False(t, ok, "low-hit values stay inline")
+
+	d.observe("checkout")
+	ref, entry, ok := d.valueReference("checkout")
+	assert.True(t, ok)
+	assert.Equal(t, "0", ref)
+	assert.Equal(t, &UpdatesEntry{Kind: UpdateKindValue, Key: "checkout", Value: "0"}, entry)
+
+	ref, again, ok := d.valueReference("checkout")
+	assert.True(t, ok)
+	assert.Equal(t, "0", ref)
+	assert.Nil(t, again)
+
+	// Short values are never interned.
+	for i := 0; i < 2*valueMinHits; i++ {
+		d.observe("GET")
+	}
+	_, _, ok = d.valueReference("GET")
+	assert.False(t, ok)
+
+	// Values and attribute keys have their own references.
+	ref, _ = d.reference("service.name")
+	assert.Equal(t, "0", ref)
+	assert.Equal(t, 1, d.Len())
+	assert.Equal(t, 1, d.ValueLen())
+
+	dec := NewDictionary()
+	dec.Apply([]UpdatesEntry{*entry, {Key: "service.name", Value: "0"}})
+	value, ok := dec.Value("0")
+	assert.True(t, ok)
+	assert.Equal(t, "checkout", value)
+	key, ok := dec.Key("0")
+	assert.True(t, ok)
+	assert.Equal(t, "service.name", key)
+}
+
+func TestDictionaryFingerprints(t *testing.T) {
+	d := NewDictionary()
+	id, entry := d.fingerprint(UpdateKindResource, "def")
+	assert.Len(t, id, 16)
+	assert.Equal(t, &UpdatesEntry{Kind: UpdateKindResource, Key: "def", Value: id}, entry)
+
+	again, entry := d.fingerprint(UpdateKindResource, "def")
+	assert.Equal(t, id, again)
+	assert.Nil(t, entry)
+
+	// The same definition as a scope is a different fingerprint.
+	scopeID, entry := d.fingerprint(UpdateKindScope, "def")
+	assert.NotEqual(t, id, scopeID)
+	assert.NotNil(t, entry)
+
+	def, ok := d.definition(UpdateKindResource, id)
+	assert.True(t, ok)
+	assert.Equal(t, "def", def)
+	_, ok = d.definition(UpdateKindScope, id)
+	assert.False(t, ok)
+}
+
+func TestDictionaryEntries(t *testing.T) {
+	d := NewDictionary()
+	d.reference("http.method")
+	for i := 0; i < valueMinHits; i++ {
+		d.observe("checkout")
+	}
+	d.valueReference("checkout")
+	d.order("GET /cart", []string{"attr_0"})
+	resourceID, _ := d.fingerprint(UpdateKindResource, "resource")
+	scopeID, _ := d.fingerprint(UpdateKindScope, "scope")
+
+	restored := NewDictionary()
+	restored.Apply(d.Entries())
+	key, ok := restored.Key("0")
+	assert.True(t, ok)
+	assert.Equal(t, "http.method", key)
+	value, ok := restored.Value("0")
+	assert.True(t, ok)
+	assert.Equal(t, "checkout", value)
+	order, ok := restored.Order("GET /cart")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"0"}, order)
+	def, ok := restored.definition(UpdateKindResource, resourceID)
+	assert.True(t, ok)
+	assert.Equal(t, "resource", def)
+	def, ok = restored.definition(UpdateKindScope, scopeID)
+	assert.True(t, ok)
+	assert.Equal(t, "scope", def)
+	assert.Equal(t, d.Entries(), restored.Entries())
+}
+
+func TestDictionaryVersion(t *testing.T) {
+	d := NewDictionary()
+	v := d.Version()
+	assert.Len(t, v.Epoch, 16)
+	assert.Zero(t, v.Version)
+	assert.NotEqual(t, v.Epoch, NewDictionary().Version().Epoch)
+
+	d.reference("http.method")
+	d.reference("http.method")
+	d.order("GET /cart", []string{"attr_0"})
+	d.order("GET /cart", []string{"attr_0"})
+	assert.Equal(t, uint64(2), d.Version().Version)
+
+	// Applying the entries advances the decoding side the same way, known entries change nothing.
+	dec := NewDictionary()
+	dec.Apply(d.Entries())
+	dec.Apply(d.Entries())
+	assert.Equal(t, uint64(2), dec.Version().Version)
+
+	// A changed order is one more change on both sides.
+	d.order("GET /cart", []string{"attr_1", "attr_0"})
+	dec.Apply(d.Entries())
+	assert.Equal(t, uint64(3), d.Version().Version)
+	assert.Equal(t, uint64(3), dec.Version().Version)
+}
+
+func TestDictionarySync(t *testing.T) {
+	d := NewDictionary()
+	_, entry := d.reference("http.method")
+	want := d.Version()
+
+	dec := NewDictionary()
+	dec.Apply([]UpdatesEntry{{Key: "stale", Value: "7"}})
+	// Another epoch resets the decoding side, the carried entries bring it up to date.
+	assert.NoError(t, dec.sync(want, []UpdatesEntry{*entry}))
+	assert.Equal(t, want, dec.Version())
+	_, ok := dec.Key("7")
+	assert.False(t, ok)
+
+	// Entries the payload does not carry are missing.
+	d.reference("db.system")
+	d.reference("net.peer.ip")
+	err := dec.sync(d.Version(), nil)
+	assert.ErrorIs(t, err, ErrUnknownReference)
+
+	restored := NewDictionary()
+	restored.Restore(d.Snapshot())
+	assert.Equal(t, d.Version(), restored.Version())
+	assert.Equal(t, d.Entries(), restored.Entries())
+	assert.NoError(t, restored.sync(d.Version(), nil))
+	assert.Equal(t, len("http.method0db.system1net.peer.ip2"), d.Snapshot().Bytes())
+
+	// Payloads without epoch are applied without check.
+	assert.NoError(t, NewDictionary().sync(DictionaryVersion{}, []UpdatesEntry{*entry}))
+}
+
+func TestDictionaryEvictLRU(t *testing.T) {
+	d := NewDictionary()
+	d.SetLimits(DictionaryLimits{MaxEntries: 2})
+	d.advance()
+	d.reference("a")
+	d.reference("b")
+	assert.Empty(t, d.evict())
+
+	d.advance()
+	d.reference("b")
+	d.reference("c")
+	evicted := d.evict()
+	assert.Equal(t, []UpdatesEntry{{Kind: UpdateKindEvict, Key: "", Value: "0"}}, evicted)
+	_, ok := d.Key("0")
+	assert.False(t, ok)
+	assert.Equal(t, 2, d.Len())
+
+	// The decoding side evicts the same entry, and both sides end up at the same version.
+	dec := NewDictionary()
+	dec.Apply([]UpdatesEntry{{Key: "a", Value: "0"}, {Key: "b", Value: "1"}, {Key: "c", Value: "2"}})
+	dec.Apply(evicted)
+	assert.Equal(t, d.Entries(), dec.Entries())
+	assert.Equal(t, d.Version().Version, dec.Version().Version)
+
+	// An evicted key gets a new reference, references are never reused.
+	ref, entry := d.reference("a")
+	assert.Equal(t, "3", ref)
+	assert.NotNil(t, entry)
+}
+
+func TestDictionaryEvictRetired(t *testing.T) {
+	dec := NewDictionary()
+	dec.Apply([]UpdatesEntry{{Key: "a", Value: "0"}, {Key: "b", Value: "1"}, {Kind: UpdateKindOrder, Key: "op", Value: "0"}})
+	dec.Apply([]UpdatesEntry{{Kind: UpdateKindEvict, Key: "", Value: "0"}, {Kind: UpdateKindEvict, Key: UpdateKindOrder, Value: "op"}})
+	assert.Equal(t, []UpdatesEntry{{Key: "b", Value: "1"}}, dec.Entries())
+
+	// The payloads encoded before the eviction still decode, without bringing the entries back.
+	version := dec.Version()
+	assert.NoError(t, dec.sync(DictionaryVersion{Epoch: version.Epoch, Version: 3}, []UpdatesEntry{{Key: "a", Value: "0"}}))
+	key, ok := dec.Key("0")
+	assert.True(t, ok)
+	assert.Equal(t, "a", key)
+	order, ok := dec.Order("op")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"0"}, order)
+	assert.Equal(t, version, dec.Version())
+
+	// The next eviction round drops them.
+	dec.Apply([]UpdatesEntry{{Kind: UpdateKindEvict, Key: "", Value: "1"}})
+	_, ok = dec.Key("0")
+	assert.False(t, ok)
+	_, ok = dec.Key("1")
+	assert.True(t, ok)
+}
+
+func TestDictionaryEvictLFU(t *testing.T) {
+	d := NewDictionary()
+	d.SetLimits(DictionaryLimits{MaxEntries: 2, Policy: EvictionLFU})
+	d.advance()
+	for i := 0; i < 3; i++ {
+		d.reference("frequent")
+	}
+	d.reference("rare")
+	d.advance()
+	d.reference("new")
+	// LRU would evict frequent, seen as early as rare.
+	assert.Equal(t, []UpdatesEntry{{Kind: UpdateKindEvict, Key: "", Value: "1"}}, d.evict())
+}
+
+func TestDictionaryEvictBytes(t *testing.T) {
+	d := NewDictionary()
+	d.SetLimits(DictionaryLimits{MaxBytes: 20})
+	d.advance()
+	d.fingerprint(UpdateKindResource, "a resource definition")
+	d.advance()
+	d.reference("http.method")
+	// The resource alone is beyond the budget, the key used by this build is kept.
+	assert.Len(t, d.evict(), 1)
+	assert.Empty(t, d.resources)
+	assert.Equal(t, 1, d.Len())
+
+	// Entries used by the current build are kept even beyond the limits.
+	d.reference("http.route")
+	d.reference("http.status_code")
+	assert.Empty(t, d.evict())
+}
+
+func TestDictionaryObserveBounded(t *testing.T) {
+	d := NewDictionary()
+	for i := 0; i < maxValueHits+10; i++ {
+		d.observe(strconv.Itoa(1000000 + i))
+	}
+	assert.LessOrEqual(t, len(d.valueHits), maxValueHits)
+}
+
+func TestDictionarySeed(t *testing.T) {
+	seed := NewDictionarySeed([]string{"http.method", "net.peer.ip", "http.method", ""})
+	assert.Equal(t, []string{"http.method", "net.peer.ip"}, seed.Keys())
+	assert.NotEmpty(t, seed.Hash())
+	assert.Equal(t, seed.Hash(), NewDictionarySeed([]string{"http.method", "net.peer.ip"}).Hash())
+	assert.NotEqual(t, seed.Hash(), NewDictionarySeed([]string{"net.peer.ip", "http.method"}).Hash())
+	assert.Empty(t, NewDictionarySeed(nil).Hash())
+
+	d := NewSeededDictionary(seed)
+	ref, entry := d.reference("net.peer.ip")
+	assert.Equal(t, "1", ref)
+	assert.Nil(t, entry)
+	ref, entry = d.reference("db.system")
+	assert.Equal(t, "2", ref)
+	assert.Equal(t, &UpdatesEntry{Key: "db.system", Value: "2"}, entry)
+	assert.Equal(t, []UpdatesEntry{{Key: "db.system", Value: "2"}}, d.Entries())
+	assert.Equal(t, seed.Hash(), d.Snapshot().Seed)
+	assert.Equal(t, uint64(1), d.Version().Version)
+
+	// The seed survives a new epoch and a restore, and is never evicted.
+	decoder := NewSeededDictionary(seed)
+	assert.NoError(t, decoder.sync(DictionaryVersion{Epoch: "other"}, nil))
+	key, ok := decoder.Key("0")
+	assert.True(t, ok)
+	assert.Equal(t, "http.method", key)
+	decoder.Restore(d.Snapshot())
+	assert.Equal(t, 3, decoder.Len())
+	decoder.Apply([]UpdatesEntry{{Kind: UpdateKindEvict, Value: "0"}, {Key: "http.route", Value: "1"}})
+	key, _ = decoder.Key("1")
+	assert.Equal(t, "net.peer.ip", key)
+	assert.Equal(t, 3, decoder.Len())
+
+	d.SetLimits(DictionaryLimits{MaxEntries: 1})
+	d.advance()
+	assert.Empty(t, d.evict())
+}
+
+func TestParseDictionarySeed(t *testing.T) {
+	keys := ParseDictionarySeed([]byte("# semantic conventions\nhttp.method\n\n  net.peer.ip \r\ndb.system"))
+	assert.Equal(t, []string{"http.method", "net.peer.ip", "db.system"}, keys)
+}
+
+func TestDictionarySeedConfigLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "seed.txt")
+	assert.NoError(t, os.WriteFile(file, []byte("# semantic conventions\nnet.peer.ip\nhttp.method\n"), 0o600))
+	want := NewDictionarySeed([]string{"http.method", "net.peer.ip"})
+
+	seed, err := DictionarySeedConfig{Keys: []string{"http.method"}, File: file, Hash: want.Hash()}.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, want, seed)
+
+	_, err = DictionarySeedConfig{Keys: []string{"net.peer.ip"}, Hash: want.Hash()}.Load()
+	assert.ErrorContains(t, err, "the configuration expects")
+	_, err = DictionarySeedConfig{File: filepath.Join(t.TempDir(), "missing.txt")}.Load()
+	assert.ErrorContains(t, err, "failed to read the seed dictionary")
+}
@@ -11,7 +11,10 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-var _ json.Unmarshaler = ExportRequest{}
+var (
+	_ json.Marshaler   = ExportRequest{}
+	_ json.Unmarshaler = ExportRequest{}
+)
 
 var tracesRequestJSON = []byte(`
 	{
@@ -48,7 +51,28 @@ func TestRequestJSON(t *testing.T) {
 	assert.NoError(t, tr.UnmarshalJSON(tracesRequestJSON))
 	assert.Equal(t, "test_span", tr.Traces().ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Name())
 
-	got, _, err := tr.MarshalJSON()
+	got, err := tr.MarshalJSON()
 	assert.NoError(t, err)
 	assert.Equal(t, strings.Join(strings.Fields(string(tracesRequestJSON)), ""), string(got))
 }
+
+func TestRequestMarshalPrefixTrie(t *testing.T) {
+	tr := NewExportRequest()
+	assert.NoError(t, tr.UnmarshalJSON(tracesRequestJSON))
+
+	dict := NewDictionary()
+	c := NewTraceCompressor()
+	got, updates, err := tr.MarshalPrefixTrie(c)
+	assert.NoError(t, err)
+	dict.Apply(updates)
+	td, err := DecodeCompressed(got, dict)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_span", td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Name())
+
+	got, updates, err = tr.MarshalPrefixTrieProto(c)
+	assert.NoError(t, err)
+	dict.Apply(updates)
+	td, err = DecodeCompressedProto(got, dict)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_span", td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Name())
+}
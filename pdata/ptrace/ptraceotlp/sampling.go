@@ -0,0 +1,174 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"strconv"
+
+	"go.opentelemetry.io/collector/pdata/internal"
+	"go.opentelemetry.io/collector/pdata/internal/data"
+	otlpcommon "go.opentelemetry.io/collector/pdata/internal/data/protogen/common/v1"
+	otlptrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/trace/v1"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// SamplingPolicy decides which spans TraceCompressor.SampleTraces keeps. The zero policy is
+// disabled and keeps every span.
+type SamplingPolicy struct {
+	// Enabled turns sampling on.
+	Enabled bool
+	// Rate is the fraction of the ordinary traces kept, from 0 to 1. The decision is made on the
+	// trace ID, see sampleTrace, and recorded in the tracestate of the kept spans.
+	Rate float64
+	// KeepAbnormal keeps the spans with a rare name or a rare attribute path whatever the rate,
+	// along with the other spans of their trace in the batch.
+	KeepAbnormal bool
+	// AlwaysKeep keeps the spans matching any of the rules whatever the rate, along with the
+	// other spans of their trace in the batch.
+	AlwaysKeep []SamplingRule
+}
+
+// SamplingRule matches the spans by name and attribute, an empty field matches anything.
+type SamplingRule struct {
+	// SpanName is the name of the spans.
+	SpanName string
+	// Attribute is an attribute key the spans have.
+	Attribute string
+	// Value is the value of Attribute, compared with its string form.
+	Value string
+}
+
+// matches reports whether the span of record matches the rule.
+func (r SamplingRule) matches(record *trieRecord) bool {
+	if r.SpanName != "" && r.SpanName != record.name {
+		return false
+	}
+	if r.Attribute == "" {
+		return true
+	}
+	for _, attr := range record.leaf.span.Attributes {
+		if attr.Key == r.Attribute {
+			return r.Value == "" || r.Value == anyValueString(attr.Value)
+		}
+	}
+	return false
+}
+
+// anyValueString returns the string form of the scalar values, the empty string for the others.
+func anyValueString(v otlpcommon.AnyValue) string {
+	switch v := v.Value.(type) {
+	case *otlpcommon.AnyValue_StringValue:
+		return v.StringValue
+	case *otlpcommon.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *otlpcommon.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *otlpcommon.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	}
+	return ""
+}
+
+// SetSamplingPolicy replaces the sampling policy of SampleTraces, which keeps every span until
+// it is called.
+func (c *TraceCompressor) SetSamplingPolicy(policy SamplingPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sampling = policy
+}
+
+// SampledOutSpans returns the number of spans the sampling policy dropped so far.
+func (c *TraceCompressor) SampledOutSpans() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sampledOut
+}
+
+// SampleTraces applies the sampling policy to td, once per batch and before it is marshaled:
+// the dropped spans are removed from td and counted by SampledOutSpans, the kept ones carry the
+// sampling threshold in their tracestate, th:0 for those kept whatever the rate. The marshaling does not sample, a batch marshaled
+// again, e.g. on a retry, is neither sampled nor counted twice. It does nothing when the policy
+// is disabled.
+func (c *TraceCompressor) SampleTraces(td ptrace.Traces) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.sampling.Enabled {
+		return
+	}
+	rss := internal.GetOrigTraces(internal.Traces(td)).ResourceSpans
+	// The rare names are told from the counts of the whole batch.
+	for _, rspan := range rss {
+		for _, sspan := range rspan.ScopeSpans {
+			for _, span := range sspan.Spans {
+				c.totalRecord++
+				c.recordsList[span.Name]++
+				c.nameUse[span.Name] = c.builds
+			}
+		}
+	}
+	// A span kept whatever the rate keeps the other spans of its trace in the batch as well.
+	overridden := make(map[data.TraceID]bool)
+	for _, rspan := range rss {
+		for _, sspan := range rspan.ScopeSpans {
+			for _, span := range sspan.Spans {
+				if c.override(c.samplingRecord(span)) {
+					overridden[span.TraceId] = true
+				}
+			}
+		}
+	}
+	threshold := samplingThreshold(c.sampling.Rate)
+	for _, rspan := range rss {
+		for _, sspan := range rspan.ScopeSpans {
+			kept := sspan.Spans[:0]
+			for _, span := range sspan.Spans {
+				keep, sampled := sampleTrace(span, threshold)
+				switch {
+				case keep:
+					kept = append(kept, sampled)
+				case overridden[span.TraceId]:
+					// Kept whatever the rate, the span is recorded with the threshold of the
+					// probability 1.
+					_, sampled = sampleTrace(span, 0)
+					kept = append(kept, sampled)
+				default:
+					c.sampledOut++
+				}
+			}
+			clear(sspan.Spans[len(kept):])
+			sspan.Spans = kept
+		}
+	}
+}
+
+// samplingRecord returns the record of span the policy is applied to, its attributes keyed by
+// the attr_<n> levels of the keys referenced already. The other keys are no level yet.
+func (c *TraceCompressor) samplingRecord(span *otlptrace.Span) *trieRecord {
+	record := &trieRecord{
+		name:  span.Name,
+		attrs: make(map[string]otlpcommon.AnyValue, len(span.Attributes)),
+		leaf:  &trieLeaf{span: span},
+	}
+	for _, attr := range span.Attributes {
+		if ref, ok := c.builder.dict.lookup(attr.Key); ok {
+			record.attrs[trieAttrPrefix+ref] = attr.Value
+		}
+	}
+	return record
+}
+
+// override reports whether the policy keeps record whatever the rate: an abnormal span with
+// KeepAbnormal set, or a span matching an AlwaysKeep rule.
+func (c *TraceCompressor) override(record *trieRecord) bool {
+	// The statistics of the abnormal detection are kept up to date with every span.
+	if c.abnormal(record) && c.sampling.KeepAbnormal {
+		return true
+	}
+	for _, rule := range c.sampling.AlwaysKeep {
+		if rule.matches(record) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	otlptrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/trace/v1"
+)
+
+// The rate of a SamplingPolicy is applied per trace, following the consistent probability
+// sampling of OpenTelemetry: every span of a trace has the same 56 bits of randomness, the
+// explicit rv of the ot tracestate entry or else the last 7 bytes of the trace ID, and is kept
+// when it is at least the rejection threshold of the rate. Every agent sampling at the same
+// rate keeps the same traces. The threshold is written to the th of the ot entry of the kept
+// spans, the adjusted count of a span being 2^56 / (2^56 - th).
+const (
+	// samplingMaxThreshold is the threshold of the zero rate, 2^56.
+	samplingMaxThreshold = 1 << 56
+	// samplingHexDigits is the length of rv and of the longest th.
+	samplingHexDigits = 14
+
+	traceStateOTKey = "ot"
+)
+
+// samplingThreshold returns the rejection threshold of rate, 0 for 1 and samplingMaxThreshold
+// for 0.
+func samplingThreshold(rate float64) uint64 {
+	switch {
+	case rate >= 1:
+		return 0
+	case rate <= 0:
+		return samplingMaxThreshold
+	}
+	return min(uint64((1-rate)*samplingMaxThreshold), samplingMaxThreshold)
+}
+
+// sampleTrace reports whether the span is kept at threshold. The returned span is span with the
+// threshold recorded in its tracestate, a copy when it changes.
+func sampleTrace(span *otlptrace.Span, threshold uint64) (bool, *otlptrace.Span) {
+	if threshold >= samplingMaxThreshold {
+		return false, span
+	}
+	ot, others := splitTraceState(span.TraceState)
+	randomness, ok := parseSamplingHex(traceStateField(ot, "rv"), true)
+	if !ok {
+		randomness = binary.BigEndian.Uint64(span.TraceId[8:]) & (samplingMaxThreshold - 1)
+	}
+	// A span sampled already keeps the higher threshold, its randomness is above it anyway.
+	if prev, ok := parseSamplingHex(traceStateField(ot, "th"), false); ok && prev > threshold {
+		threshold = prev
+	}
+	if randomness < threshold {
+		return false, span
+	}
+	ot = setTraceStateField(ot, "th", formatSamplingThreshold(threshold))
+	traceState := strings.Join(append([]string{traceStateOTKey + "=" + ot}, others...), ",")
+	if traceState == span.TraceState {
+		return true, span
+	}
+	kept := *span
+	kept.TraceState = traceState
+	return true, &kept
+}
+
+// splitTraceState returns the value of the ot entry of a W3C tracestate and the other entries.
+func splitTraceState(traceState string) (string, []string) {
+	var ot string
+	var others []string
+	for _, member := range strings.Split(traceState, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		if value, ok := strings.CutPrefix(member, traceStateOTKey+"="); ok {
+			ot = value
+			continue
+		}
+		others = append(others, member)
+	}
+	return ot, others
+}
+
+// traceStateField returns the value of the key field of an ot entry value.
+func traceStateField(ot, key string) string {
+	for _, field := range strings.Split(ot, ";") {
+		if value, ok := strings.CutPrefix(field, key+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// setTraceStateField sets the key field of an ot entry value to value.
+func setTraceStateField(ot, key, value string) string {
+	fields := []string{key + ":" + value}
+	for _, field := range strings.Split(ot, ";") {
+		if field != "" && !strings.HasPrefix(field, key+":") {
+			fields = append(fields, field)
+		}
+	}
+	return strings.Join(fields, ";")
+}
+
+// parseSamplingHex parses a th, right padded with zeros, or an rv, which must have every digit.
+func parseSamplingHex(s string, full bool) (uint64, bool) {
+	if s == "" || len(s) > samplingHexDigits || (full && len(s) != samplingHexDigits) {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v << (4 * (samplingHexDigits - len(s))), true
+}
+
+// formatSamplingThreshold returns the th of threshold, without the trailing zeros.
+func formatSamplingThreshold(threshold uint64) string {
+	if threshold == 0 {
+		return "0"
+	}
+	return strings.TrimRight(fmt.Sprintf("%0*x", samplingHexDigits, threshold), "0")
+}
@@ -0,0 +1,255 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.opentelemetry.io/collector/pdata/internal/data"
+	otlptrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/trace/v1"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func TestTraceCompressorSampling(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SamplingPolicy
+		kept   int
+	}{
+		{
+			name:   "disabled",
+			policy: SamplingPolicy{Rate: 0},
+			kept:   100,
+		},
+		{
+			name:   "rate 1",
+			policy: SamplingPolicy{Enabled: true, Rate: 1},
+			kept:   100,
+		},
+		{
+			name:   "rate 0",
+			policy: SamplingPolicy{Enabled: true, Rate: 0},
+			kept:   0,
+		},
+		{
+			name: "always keep span name",
+			policy: SamplingPolicy{Enabled: true, AlwaysKeep: []SamplingRule{
+				{SpanName: "GET /cart/1"},
+			}},
+			kept: 20,
+		},
+		{
+			name: "always keep attribute value",
+			policy: SamplingPolicy{Enabled: true, AlwaysKeep: []SamplingRule{
+				{Attribute: "http.status_code", Value: "201"},
+			}},
+			kept: 33,
+		},
+		{
+			name: "always keep any rule",
+			policy: SamplingPolicy{Enabled: true, AlwaysKeep: []SamplingRule{
+				{SpanName: "GET /cart/1"},
+				{SpanName: "GET /cart/2", Attribute: "user.id"},
+				{Attribute: "missing"},
+			}},
+			kept: 40,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewTraceCompressor()
+			c.SetSamplingPolicy(tt.policy)
+			td := newZstdTestTraces(0, 100)
+			// A trace per span, the rules keep single spans. The trace IDs have no randomness,
+			// a rate below 1 drops them.
+			spans := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+			for i := 0; i < spans.Len(); i++ {
+				spans.At(i).SetTraceID(pcommon.TraceID([16]byte{byte(i), 1}))
+			}
+			c.SampleTraces(td)
+			assert.Equal(t, tt.kept, td.SpanCount())
+			assert.Equal(t, int64(100-tt.kept), c.SampledOutSpans())
+			seen := c.totalRecord
+
+			// A retry marshals the sampled batch again, it is neither sampled nor counted twice.
+			for i := 0; i < 2; i++ {
+				buf, updates, err := c.MarshalTracesProto(td)
+				require.NoError(t, err)
+				dict := NewDictionary()
+				dict.Apply(updates)
+				got, err := DecodeCompressedProto(buf, dict)
+				require.NoError(t, err)
+				assert.Equal(t, tt.kept, got.SpanCount())
+			}
+			assert.Equal(t, int64(100-tt.kept), c.SampledOutSpans())
+			assert.Equal(t, seen, c.totalRecord)
+		})
+	}
+}
+
+func TestTraceCompressorSamplingRate(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	td := ptrace.NewTraces()
+	spans := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	for trace := 0; trace < 200; trace++ {
+		var traceID pcommon.TraceID
+		rnd.Read(traceID[:])
+		for i := 0; i < 5; i++ {
+			span := spans.AppendEmpty()
+			span.SetName("GET /cart")
+			span.SetTraceID(traceID)
+			span.SetSpanID(pcommon.SpanID([8]byte{byte(trace), byte(trace >> 8), byte(i)}))
+			span.Attributes().PutStr("user.id", strconv.Itoa(trace))
+		}
+	}
+
+	kept := func() map[pcommon.TraceID][]ptrace.Span {
+		c := NewTraceCompressor()
+		c.SetSamplingPolicy(SamplingPolicy{Enabled: true, Rate: 0.5})
+		sampled := ptrace.NewTraces()
+		td.CopyTo(sampled)
+		c.SampleTraces(sampled)
+		buf, updates, err := c.MarshalTracesProto(sampled)
+		require.NoError(t, err)
+		dict := NewDictionary()
+		dict.Apply(updates)
+		got, err := DecodeCompressedProto(buf, dict)
+		require.NoError(t, err)
+		assert.Equal(t, int64(spans.Len()-got.SpanCount()), c.SampledOutSpans())
+
+		traces := map[pcommon.TraceID][]ptrace.Span{}
+		gotSpans := got.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+		for i := 0; i < gotSpans.Len(); i++ {
+			traces[gotSpans.At(i).TraceID()] = append(traces[gotSpans.At(i).TraceID()], gotSpans.At(i))
+		}
+		return traces
+	}
+	traces := kept()
+	assert.InDelta(t, 100, len(traces), 25)
+	for _, traceSpans := range traces {
+		// Traces are kept whole, with the threshold of the rate.
+		assert.Len(t, traceSpans, 5)
+		for _, span := range traceSpans {
+			assert.Equal(t, "ot=th:8", span.TraceState().AsRaw())
+		}
+	}
+	// Another agent keeps the same traces.
+	again := kept()
+	assert.Equal(t, len(traces), len(again))
+	for traceID := range traces {
+		assert.Contains(t, again, traceID)
+	}
+}
+
+func TestTraceCompressorSamplingWholeTraces(t *testing.T) {
+	td := ptrace.NewTraces()
+	spans := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	for trace := 0; trace < 2; trace++ {
+		for i := 0; i < 3; i++ {
+			span := spans.AppendEmpty()
+			span.SetName("GET /cart")
+			span.SetTraceID(pcommon.TraceID([16]byte{byte(trace), 1}))
+			span.SetSpanID(pcommon.SpanID([8]byte{byte(trace), byte(i)}))
+			if trace == 0 && i == 1 {
+				span.Attributes().PutStr("anomaly.reason", "rare span name")
+			}
+		}
+	}
+
+	c := NewTraceCompressor()
+	c.SetSamplingPolicy(SamplingPolicy{Enabled: true, Rate: 0.5, AlwaysKeep: []SamplingRule{
+		{Attribute: "anomaly.reason"},
+	}})
+	c.SampleTraces(td)
+
+	// The trace of the matching span is kept whole with the threshold of the probability 1, the
+	// other one is dropped on its trace ID.
+	require.Equal(t, 3, spans.Len())
+	for i := 0; i < spans.Len(); i++ {
+		assert.Equal(t, pcommon.TraceID([16]byte{0, 1}), spans.At(i).TraceID())
+		assert.Equal(t, "ot=th:0", spans.At(i).TraceState().AsRaw())
+	}
+	assert.Equal(t, int64(3), c.SampledOutSpans())
+}
+
+func TestSampleTrace(t *testing.T) {
+	tests := []struct {
+		name       string
+		traceState string
+		traceID    [16]byte
+		threshold  uint64
+		keep       bool
+		want       string
+	}{
+		{
+			name:      "randomness below",
+			traceID:   [16]byte{15: 1},
+			threshold: samplingThreshold(0.5),
+		},
+		{
+			name:      "trace ID randomness",
+			traceID:   [16]byte{8: 0xff, 9: 0x80},
+			threshold: samplingThreshold(0.5),
+			keep:      true,
+			want:      "ot=th:8",
+		},
+		{
+			name:       "explicit randomness",
+			traceState: "ot=rv:c0000000000000",
+			threshold:  samplingThreshold(0.25),
+			keep:       true,
+			want:       "ot=th:c;rv:c0000000000000",
+		},
+		{
+			name:       "other vendors kept after ot",
+			traceState: "vendor=x,ot=rv:ffffffffffffff,other=y",
+			threshold:  samplingThreshold(0.5),
+			keep:       true,
+			want:       "ot=th:8;rv:ffffffffffffff,vendor=x,other=y",
+		},
+		{
+			name:       "higher threshold kept",
+			traceState: "ot=th:c;rv:ffffffffffffff",
+			threshold:  samplingThreshold(0.5),
+			keep:       true,
+			want:       "ot=th:c;rv:ffffffffffffff",
+		},
+		{
+			name:       "lower threshold raised",
+			traceState: "ot=th:4;rv:90000000000000",
+			threshold:  samplingThreshold(0.5),
+			keep:       true,
+			want:       "ot=th:8;rv:90000000000000",
+		},
+		{
+			name:       "rate 1",
+			traceState: "ot=rv:00000000000000",
+			threshold:  samplingThreshold(1),
+			keep:       true,
+			want:       "ot=th:0;rv:00000000000000",
+		},
+		{
+			name:       "rate 0",
+			traceState: "ot=rv:ffffffffffffff",
+			threshold:  samplingThreshold(0),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span := &otlptrace.Span{TraceId: data.TraceID(tt.traceID), TraceState: tt.traceState}
+			keep, got := sampleTrace(span, tt.threshold)
+			assert.Equal(t, tt.keep, keep)
+			if tt.keep {
+				assert.Equal(t, tt.want, got.TraceState)
+			}
+			assert.Equal(t, tt.traceState, span.TraceState)
+		})
+	}
+}
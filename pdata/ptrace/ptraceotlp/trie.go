@@ -0,0 +1,515 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"bytes"
+	goJson "encoding/json"
+	"sort"
+
+	"go.opentelemetry.io/collector/pdata/internal/data"
+	otlpcommon "go.opentelemetry.io/collector/pdata/internal/data/protogen/common/v1"
+	otlptrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/trace/v1"
+	"go.opentelemetry.io/collector/pdata/internal/json"
+)
+
+const (
+	trieNameLevel  = "name"
+	trieAttrPrefix = "attr_"
+	trieNoneValue  = "NONE"
+)
+
+// TimestampMode selects how the span times of a ScopeSpan are written.
+type TimestampMode int
+
+const (
+	// TimestampModeOffset writes start and end times as offsets from ScopeSpan.TOffset.
+	TimestampModeOffset TimestampMode = iota
+	// TimestampModeDelta writes the start time of each leaf as the delta to the previous leaf of
+	// the same trie node, leaves being sorted by start time, and the end time as the span duration.
+	TimestampModeDelta
+)
+
+type TrieSpan struct {
+	AN    string
+	AV    interface{}
+	Son   []interface{}
+	Count int `json:"-"`
+
+	lastStart uint64 // start of the last leaf, the base of the next delta
+}
+
+// ScopeSpan is a scope of spans. ScopeID is the fingerprint of the scope and its schema URL,
+// announced through the dictionary.
+type ScopeSpan struct {
+	ScopeID       string         `json:"scopeId"`
+	TOffset       uint64         `json:"tOffset,omitempty"`
+	TimestampMode TimestampMode  `json:"tMode,omitempty"`
+	TraceIDs      []data.TraceID `json:"traceIds,omitempty"`
+	Spans         []interface{}  `json:"spans,omitempty"`
+}
+
+// ExportData is a resource of spans. ResourceID is the fingerprint of the resource and its
+// schema URL, announced through the dictionary.
+type ExportData struct {
+	ResourceID string       `json:"resourceId"`
+	ScopeSpans []*ScopeSpan `json:"scopeSpans,omitempty"`
+}
+
+// trieValueRef is the reference of an interned span name or string attribute value.
+type trieValueRef string
+
+// MarshalJSON encodes an attribute value as an OTLP/JSON AnyValue so the decoder can hand it
+// to the OTLP unmarshaler unchanged. The name and the NONE sentinel stay plain strings, an
+// interned value is written as {"ref":"<n>"}.
+func (t *TrieSpan) MarshalJSON() ([]byte, error) {
+	av, err := trieValueJSON(t.AV)
+	if err != nil {
+		return nil, err
+	}
+	return goJson.Marshal(struct {
+		AN  string
+		AV  interface{}
+		Son []interface{}
+	}{
+		AN:  t.AN,
+		AV:  av,
+		Son: t.Son,
+	})
+}
+
+// son returns the child of t on level an with value av, nil if there is none.
+func (t *TrieSpan) son(an string, av interface{}) *TrieSpan {
+	key := trieValueKey(av)
+	for _, son := range t.Son {
+		if node, ok := son.(*TrieSpan); ok && node.AN == an && trieValueKey(node.AV) == key {
+			return node
+		}
+	}
+	return nil
+}
+
+// trieValueKey returns a string identifying the trie node value av. Attribute values are compared
+// on their protobuf encoding, which keeps the value type and is exact for doubles.
+func trieValueKey(av interface{}) string {
+	switch v := av.(type) {
+	case otlpcommon.AnyValue:
+		b, _ := v.Marshal()
+		return "v" + string(b)
+	case string:
+		return "s" + v
+	case trieValueRef:
+		return "r" + string(v)
+	default:
+		return ""
+	}
+}
+
+// trieLeaf is a span stripped of the name and attributes already carried by its trie path.
+// stun and etun are the span start and end times relative to ScopeSpan.TOffset. With
+// TimestampModeDelta, delta is set and startDelta holds the start relative to the previous leaf.
+// trace is the 1-based index of the trace ID in ScopeSpan.TraceIDs and parent the 1-based index
+// of the parent leaf in the scope, 0 when the span carries the ID itself. When detailed is set the
+// span events and links are sent as events and links instead.
+type trieLeaf struct {
+	span       *otlptrace.Span
+	stun       uint64
+	etun       uint64
+	delta      bool
+	startDelta uint64
+	trace      uint32
+	parent     uint32
+	detailed   bool
+	events     []trieEvent
+	links      []trieLink
+}
+
+// duration returns the end time relative to the start time. An end before the start wraps
+// around, the decoder wraps it back.
+func (l *trieLeaf) duration() uint64 {
+	return l.etun - l.stun
+}
+
+// MarshalJSON encodes the leaf as an OTLP/JSON span without the fields carried by the trie path.
+func (l *trieLeaf) MarshalJSON() ([]byte, error) {
+	span := *l.span
+	span.Name = ""
+	span.Attributes = nil
+	span.StartTimeUnixNano = 0
+	span.EndTimeUnixNano = 0
+	var buf bytes.Buffer
+	if err := json.Marshal(&buf, &span); err != nil {
+		return nil, err
+	}
+	dec := goJson.NewDecoder(&buf)
+	dec.UseNumber()
+	var spanMap map[string]interface{}
+	if err := dec.Decode(&spanMap); err != nil {
+		return nil, err
+	}
+	if l.trace > 0 {
+		delete(spanMap, "traceId")
+		spanMap["t"] = l.trace - 1
+	}
+	if l.parent > 0 {
+		delete(spanMap, "parentSpanId")
+		spanMap["p"] = l.parent - 1
+	}
+	if l.detailed {
+		if err := l.detailsJSON(spanMap); err != nil {
+			return nil, err
+		}
+	}
+	if l.delta {
+		spanMap["sd"] = l.startDelta
+		spanMap["d"] = l.duration()
+	} else {
+		spanMap["stun"] = l.stun
+		spanMap["etun"] = l.etun
+	}
+	return goJson.Marshal(spanMap)
+}
+
+// trieRecord is a span waiting to be inserted into the trie, with its attributes keyed by attr_<n>.
+type trieRecord struct {
+	name  string
+	attrs map[string]otlpcommon.AnyValue
+	leaf  *trieLeaf
+}
+
+// value returns the trie value of the record on level attrName, the NONE sentinel if the span
+// does not have the attribute.
+func (r *trieRecord) value(attrName string) interface{} {
+	if v, ok := r.attrs[attrName]; ok {
+		return v
+	}
+	return trieNoneValue
+}
+
+const (
+	// trieReorderInterval is the number of builds between two evaluations of the level order.
+	trieReorderInterval = 16
+	// maxTrackedCardinality caps the distinct values remembered per level, a level reaching it
+	// is simply treated as high cardinality.
+	maxTrackedCardinality = 1024
+)
+
+// trieBuilder turns the spans of a request into prefix tries. attrList holds the order of the
+// attr_<n> levels per span name and attrExist the same levels as a set. cardinality holds the
+// distinct values seen per span name and level, the levels are ordered from low to high
+// cardinality every trieReorderInterval builds. updates collects the dictionary entries
+// created by the current build.
+type trieBuilder struct {
+	dict        *Dictionary
+	attrList    map[string][]string
+	attrExist   map[string]map[string]bool
+	cardinality map[string]map[string]map[string]struct{}
+	builds      int
+	timeMode    TimestampMode
+	updates     []UpdatesEntry
+}
+
+func newTrieBuilder(dict *Dictionary) *trieBuilder {
+	return &trieBuilder{
+		dict:        dict,
+		attrList:    make(map[string][]string),
+		attrExist:   make(map[string]map[string]bool),
+		cardinality: make(map[string]map[string]map[string]struct{}),
+		timeMode:    TimestampModeDelta,
+	}
+}
+
+// build flattens the attributes of every span into attr_<n> references and turns the spans of
+// each scope into a prefix trie. Dictionary entries created along the way are returned, nil if
+// there are none.
+func (b *trieBuilder) build(rss []*otlptrace.ResourceSpans) ([]ExportData, []UpdatesEntry) {
+	b.updates = nil
+	b.dict.advance()
+
+	type pendingScope struct {
+		sspan   *ScopeSpan
+		records []*trieRecord
+	}
+	var pending []pendingScope
+	resourceSpans := make([]ExportData, 0, len(rss))
+
+	// the following step is to flat the attributes object into attr_name format
+
+	for _, rspan := range rss {
+		rspanNew := ExportData{
+			ResourceID: b.fingerprintResource(rspan),
+			ScopeSpans: make([]*ScopeSpan, 0),
+		}
+
+		for _, sspan := range rspan.ScopeSpans {
+			sspanNew := &ScopeSpan{
+				ScopeID: b.fingerprintScope(sspan),
+				Spans:   make([]interface{}, 0),
+			}
+			var minTime uint64 = 1<<63 - 1
+			records := make([]*trieRecord, 0, len(sspan.Spans))
+
+			for _, span := range sspan.Spans {
+				record := &trieRecord{
+					name:  span.Name,
+					attrs: make(map[string]otlpcommon.AnyValue, len(span.Attributes)),
+					leaf: &trieLeaf{
+						span: span,
+						stun: span.StartTimeUnixNano,
+						etun: span.EndTimeUnixNano,
+					},
+				}
+				b.dict.observe(span.Name)
+				b.dict.useName(span.Name)
+				b.observeDetails(span)
+				for _, attribute := range span.Attributes {
+					ref, entry := b.dict.reference(attribute.Key)
+					b.addUpdate(entry)
+					if sv, ok := attribute.Value.Value.(*otlpcommon.AnyValue_StringValue); ok {
+						b.dict.observe(sv.StringValue)
+					}
+
+					attrName := trieAttrPrefix + ref
+					record.attrs[attrName] = attribute.Value
+					b.countValue(span.Name, attrName, attribute.Value)
+					if b.attrExist[span.Name] == nil {
+						b.attrExist[span.Name] = make(map[string]bool)
+					}
+					if !b.attrExist[span.Name][attrName] {
+						b.attrExist[span.Name][attrName] = true
+						b.attrList[span.Name] = append(b.attrList[span.Name], attrName)
+					}
+				}
+				minTime = min(span.StartTimeUnixNano, minTime)
+				records = append(records, record)
+			}
+			for _, record := range records {
+				record.leaf.stun -= minTime
+				record.leaf.etun -= minTime
+			}
+			sspanNew.TOffset = minTime
+			sspanNew.TimestampMode = b.timeMode
+			if b.timeMode == TimestampModeDelta {
+				// Leaves are appended in record order, sorted records keep every delta positive.
+				sort.SliceStable(records, func(i, j int) bool {
+					return records[i].leaf.stun < records[j].leaf.stun
+				})
+			}
+			pending = append(pending, pendingScope{sspan: sspanNew, records: records})
+			rspanNew.ScopeSpans = append(rspanNew.ScopeSpans, sspanNew)
+		}
+
+		resourceSpans = append(resourceSpans, rspanNew)
+	}
+
+	// The order is settled before any span is inserted, every span of a payload uses the same.
+	if b.builds%trieReorderInterval == 0 {
+		b.reorder()
+	}
+	b.builds++
+
+	// the following step is to turn span into trie format
+
+	names := make(map[string]struct{})
+	for _, scope := range pending {
+		newSpans := make([]*TrieSpan, 0)
+		for _, record := range scope.records {
+			newSpans = b.insert(newSpans, record)
+			names[record.name] = struct{}{}
+		}
+		linkLeaves(scope.sspan, newSpans)
+		for _, v := range newSpans {
+			scope.sspan.Spans = append(scope.sspan.Spans, v)
+		}
+	}
+
+	for name := range names {
+		b.dict.useLevels(b.attrList[name])
+	}
+	for _, entry := range b.dict.evict() {
+		b.addUpdate(&entry)
+		b.forget(entry)
+	}
+	return resourceSpans, b.updates
+}
+
+// forget drops the level state of an entry evicted from the dictionary: the levels of an
+// attribute key, or every level of a span name.
+func (b *trieBuilder) forget(evicted UpdatesEntry) {
+	switch evicted.Key {
+	case UpdateKindOrder:
+		name := evicted.Value
+		delete(b.attrList, name)
+		delete(b.attrExist, name)
+		delete(b.cardinality, name)
+	case "":
+		attrName := trieAttrPrefix + evicted.Value
+		for name, levels := range b.attrList {
+			if !b.attrExist[name][attrName] {
+				continue
+			}
+			delete(b.attrExist[name], attrName)
+			delete(b.cardinality[name], attrName)
+			kept := levels[:0]
+			for _, level := range levels {
+				if level != attrName {
+					kept = append(kept, level)
+				}
+			}
+			b.attrList[name] = kept
+		}
+	}
+}
+
+// linkLeaves numbers the leaves below roots in payload order, collects their trace IDs into
+// ss.TraceIDs and points every leaf whose parent is in the scope at the parent leaf. A node has
+// either sons or leaves, every span of a name has the same levels, so decoders walking sons and
+// leaves separately see the leaves in the same order.
+func linkLeaves(ss *ScopeSpan, roots []*TrieSpan) {
+	var leaves []*trieLeaf
+	var walk func(node *TrieSpan)
+	walk = func(node *TrieSpan) {
+		for _, son := range node.Son {
+			switch son := son.(type) {
+			case *TrieSpan:
+				walk(son)
+			case *trieLeaf:
+				leaves = append(leaves, son)
+			}
+		}
+	}
+	for _, root := range roots {
+		walk(root)
+	}
+
+	type spanKey struct {
+		trace data.TraceID
+		span  data.SpanID
+	}
+	traces := make(map[data.TraceID]uint32)
+	index := make(map[spanKey]uint32, len(leaves))
+	for i, leaf := range leaves {
+		trace, ok := traces[leaf.span.TraceId]
+		if !ok {
+			ss.TraceIDs = append(ss.TraceIDs, leaf.span.TraceId)
+			trace = uint32(len(ss.TraceIDs))
+			traces[leaf.span.TraceId] = trace
+		}
+		leaf.trace = trace
+		key := spanKey{trace: leaf.span.TraceId, span: leaf.span.SpanId}
+		if _, ok = index[key]; !ok {
+			index[key] = uint32(i + 1)
+		}
+	}
+	for _, leaf := range leaves {
+		if !leaf.span.ParentSpanId.IsEmpty() {
+			leaf.parent = index[spanKey{trace: leaf.span.TraceId, span: leaf.span.ParentSpanId}]
+		}
+	}
+}
+
+// countValue records value as seen on level attrName of the spans called name.
+func (b *trieBuilder) countValue(name, attrName string, value otlpcommon.AnyValue) {
+	levels := b.cardinality[name]
+	if levels == nil {
+		levels = make(map[string]map[string]struct{})
+		b.cardinality[name] = levels
+	}
+	values := levels[attrName]
+	if values == nil {
+		values = make(map[string]struct{})
+		levels[attrName] = values
+	}
+	if len(values) < maxTrackedCardinality {
+		values[trieValueKey(value)] = struct{}{}
+	}
+}
+
+// reorder sorts the levels of every span name from low to high cardinality, so the levels
+// shared by most spans come first, and announces the orders that changed.
+func (b *trieBuilder) reorder() {
+	for name, levels := range b.attrList {
+		cardinality := b.cardinality[name]
+		sort.SliceStable(levels, func(i, j int) bool {
+			return len(cardinality[levels[i]]) < len(cardinality[levels[j]])
+		})
+		b.addUpdate(b.dict.order(name, levels))
+	}
+}
+
+func (b *trieBuilder) addUpdate(entry *UpdatesEntry) {
+	if entry != nil {
+		b.updates = append(b.updates, *entry)
+	}
+}
+
+// internName returns the trie value of a span name, its reference if it is interned.
+func (b *trieBuilder) internName(name string) interface{} {
+	ref, entry, ok := b.dict.valueReference(name)
+	if !ok {
+		return name
+	}
+	b.addUpdate(entry)
+	return trieValueRef(ref)
+}
+
+// internValue returns the trie value of an attribute level, the reference of interned strings.
+func (b *trieBuilder) internValue(av interface{}) interface{} {
+	v, ok := av.(otlpcommon.AnyValue)
+	if !ok {
+		return av
+	}
+	sv, ok := v.Value.(*otlpcommon.AnyValue_StringValue)
+	if !ok {
+		return av
+	}
+	ref, entry, ok := b.dict.valueReference(sv.StringValue)
+	if !ok {
+		return av
+	}
+	b.addUpdate(entry)
+	return trieValueRef(ref)
+}
+
+// insert adds the record below the name node of roots, creating the missing trie levels.
+func (b *trieBuilder) insert(roots []*TrieSpan, record *trieRecord) []*TrieSpan {
+	name := b.internName(record.name)
+	nameKey := trieValueKey(name)
+	var iter *TrieSpan
+	for _, root := range roots { // find next hop
+		if trieValueKey(root.AV) == nameKey {
+			iter = root
+			break
+		}
+	}
+	if iter == nil { // if didn't find, create it
+		iter = &TrieSpan{
+			AN:  trieNameLevel,
+			AV:  name,
+			Son: make([]interface{}, 0),
+		}
+		roots = append(roots, iter)
+	}
+	for _, attrName := range b.attrList[record.name] {
+		av := b.internValue(record.value(attrName))
+		next := iter.son(attrName, av)
+		if next == nil {
+			next = &TrieSpan{
+				AN:  attrName,
+				AV:  av,
+				Son: make([]interface{}, 0),
+			}
+			iter.Son = append(iter.Son, next)
+		}
+		iter = next
+	}
+	if b.timeMode == TimestampModeDelta {
+		record.leaf.delta = true
+		record.leaf.startDelta = record.leaf.stun - iter.lastStart
+		iter.lastStart = record.leaf.stun
+	}
+	b.encodeDetails(record.leaf)
+	iter.Son = append(iter.Son, record.leaf)
+	return roots
+}
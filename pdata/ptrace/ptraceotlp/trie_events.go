@@ -0,0 +1,178 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"bytes"
+	goJson "encoding/json"
+
+	otlpcommon "go.opentelemetry.io/collector/pdata/internal/data/protogen/common/v1"
+	otlptrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/trace/v1"
+	"go.opentelemetry.io/collector/pdata/internal/json"
+)
+
+// trieAttribute is an event or link attribute with its key replaced by the key reference.
+// value is an otlpcommon.AnyValue, or a trieValueRef for interned strings.
+type trieAttribute struct {
+	keyRef string
+	value  interface{}
+}
+
+// trieEvent is a span event. timeDelta is the event time minus the span start time, modulo 2^64.
+// name is a string, or a trieValueRef for interned names.
+type trieEvent struct {
+	timeDelta int64
+	name      interface{}
+	attrs     []trieAttribute
+	dropped   uint32
+}
+
+// trieLink is a span link, link holds everything but the attributes.
+type trieLink struct {
+	link  otlptrace.Span_Link
+	attrs []trieAttribute
+}
+
+// observeDetails counts the event names and string attribute values of span for interning, and
+// assigns the references of the event and link attribute keys.
+func (b *trieBuilder) observeDetails(span *otlptrace.Span) {
+	for _, event := range span.Events {
+		b.dict.observe(event.Name)
+		b.observeAttributes(event.Attributes)
+	}
+	for _, link := range span.Links {
+		b.observeAttributes(link.Attributes)
+	}
+}
+
+func (b *trieBuilder) observeAttributes(attrs []otlpcommon.KeyValue) {
+	for _, attribute := range attrs {
+		_, entry := b.dict.reference(attribute.Key)
+		b.addUpdate(entry)
+		if sv, ok := attribute.Value.Value.(*otlpcommon.AnyValue_StringValue); ok {
+			b.dict.observe(sv.StringValue)
+		}
+	}
+}
+
+// encodeDetails moves the events and links of the leaf span into their dictionary encoded form.
+func (b *trieBuilder) encodeDetails(leaf *trieLeaf) {
+	span := leaf.span
+	if len(span.Events) == 0 && len(span.Links) == 0 {
+		return
+	}
+	leaf.detailed = true
+	leaf.events = make([]trieEvent, len(span.Events))
+	for i, event := range span.Events {
+		leaf.events[i] = trieEvent{
+			timeDelta: int64(event.TimeUnixNano - span.StartTimeUnixNano),
+			name:      b.internName(event.Name),
+			attrs:     b.encodeAttributes(event.Attributes),
+			dropped:   event.DroppedAttributesCount,
+		}
+	}
+	leaf.links = make([]trieLink, len(span.Links))
+	for i, l := range span.Links {
+		link := *l
+		attrs := b.encodeAttributes(link.Attributes)
+		link.Attributes = nil
+		leaf.links[i] = trieLink{link: link, attrs: attrs}
+	}
+}
+
+func (b *trieBuilder) encodeAttributes(attrs []otlpcommon.KeyValue) []trieAttribute {
+	if len(attrs) == 0 {
+		return nil
+	}
+	ret := make([]trieAttribute, len(attrs))
+	for i, attribute := range attrs {
+		ref, entry := b.dict.reference(attribute.Key)
+		b.addUpdate(entry)
+		ret[i] = trieAttribute{keyRef: ref, value: b.internValue(attribute.Value)}
+	}
+	return ret
+}
+
+// trieValueJSON returns the JSON form of a trie value: OTLP/JSON for an otlpcommon.AnyValue,
+// {"ref":"<n>"} for an interned value, and the value itself otherwise.
+func trieValueJSON(av interface{}) (interface{}, error) {
+	switch v := av.(type) {
+	case otlpcommon.AnyValue:
+		var buf bytes.Buffer
+		if err := json.Marshal(&buf, &v); err != nil {
+			return nil, err
+		}
+		return goJson.RawMessage(buf.Bytes()), nil
+	case trieValueRef:
+		return map[string]string{"ref": string(v)}, nil
+	default:
+		return av, nil
+	}
+}
+
+func trieAttributesJSON(attrs []trieAttribute) ([]interface{}, error) {
+	ret := make([]interface{}, len(attrs))
+	for i, attribute := range attrs {
+		value, err := trieValueJSON(attribute.value)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = map[string]interface{}{"k": attribute.keyRef, "v": value}
+	}
+	return ret, nil
+}
+
+// detailsJSON adds the events ("ev") and links ("ln") of the leaf to its JSON form.
+func (l *trieLeaf) detailsJSON(spanMap map[string]interface{}) error {
+	delete(spanMap, "events")
+	delete(spanMap, "links")
+	if len(l.events) > 0 {
+		events := make([]interface{}, len(l.events))
+		for i, event := range l.events {
+			name, err := trieValueJSON(event.name)
+			if err != nil {
+				return err
+			}
+			attrs, err := trieAttributesJSON(event.attrs)
+			if err != nil {
+				return err
+			}
+			e := map[string]interface{}{"dt": event.timeDelta, "n": name}
+			if len(attrs) > 0 {
+				e["a"] = attrs
+			}
+			if event.dropped > 0 {
+				e["dac"] = event.dropped
+			}
+			events[i] = e
+		}
+		spanMap["ev"] = events
+	}
+	if len(l.links) > 0 {
+		links := make([]interface{}, len(l.links))
+		for i := range l.links {
+			var buf bytes.Buffer
+			if err := json.Marshal(&buf, &l.links[i].link); err != nil {
+				return err
+			}
+			dec := goJson.NewDecoder(&buf)
+			dec.UseNumber()
+			var link map[string]interface{}
+			if err := dec.Decode(&link); err != nil {
+				return err
+			}
+			attrs, err := trieAttributesJSON(l.links[i].attrs)
+			if err != nil {
+				return err
+			}
+			delete(link, "attributes")
+			if len(attrs) > 0 {
+				link["a"] = attrs
+			}
+			links[i] = link
+		}
+		spanMap["ln"] = links
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	otlptrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/trace/v1"
+)
+
+// Resources and scopes rarely change between batches, each is announced once through the
+// dictionary and the payloads carry its fingerprint. The definition is the base64 protobuf of
+// a ResourceSpans or ScopeSpans holding only the schema URL and the resource or scope.
+
+// fingerprintResource returns the fingerprint of the resource of rs, announcing it if it is new.
+func (b *trieBuilder) fingerprintResource(rs *otlptrace.ResourceSpans) string {
+	def := otlptrace.ResourceSpans{SchemaUrl: rs.SchemaUrl, Resource: rs.Resource}
+	return b.fingerprint(UpdateKindResource, &def)
+}
+
+// fingerprintScope returns the fingerprint of the scope of ss, announcing it if it is new.
+func (b *trieBuilder) fingerprintScope(ss *otlptrace.ScopeSpans) string {
+	def := otlptrace.ScopeSpans{SchemaUrl: ss.SchemaUrl, Scope: ss.Scope}
+	return b.fingerprint(UpdateKindScope, &def)
+}
+
+func (b *trieBuilder) fingerprint(kind string, def interface{ Marshal() ([]byte, error) }) string {
+	// The messages hold no maps, their encoding is deterministic. Marshal cannot fail on them.
+	buf, _ := def.Marshal()
+	id, entry := b.dict.fingerprint(kind, base64.StdEncoding.EncodeToString(buf))
+	b.addUpdate(entry)
+	return id
+}
+
+// resolveResource returns the schema URL and resource announced as id, in a ResourceSpans
+// without scopes.
+func resolveResource(dict *Dictionary, id string) (*otlptrace.ResourceSpans, error) {
+	rs := &otlptrace.ResourceSpans{}
+	if err := resolveDefinition(dict, UpdateKindResource, id, rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// resolveScope returns the schema URL and scope announced as id, in a ScopeSpans without spans.
+func resolveScope(dict *Dictionary, id string) (*otlptrace.ScopeSpans, error) {
+	ss := &otlptrace.ScopeSpans{}
+	if err := resolveDefinition(dict, UpdateKindScope, id, ss); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func resolveDefinition(dict *Dictionary, kind, id string, msg interface{ Unmarshal([]byte) error }) error {
+	def, ok := dict.definition(kind, id)
+	if !ok {
+		return fmt.Errorf("%w: %s fingerprint %q", ErrUnknownReference, kind, id)
+	}
+	buf, err := base64.StdEncoding.DecodeString(def)
+	if err != nil {
+		return fmt.Errorf("prefix trie: malformed %s definition: %w", kind, err)
+	}
+	return msg.Unmarshal(buf)
+}
@@ -0,0 +1,308 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"go.opentelemetry.io/collector/pdata/internal"
+	otlpcollectortrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/collector/trace/v1"
+)
+
+// Names of the prefix-trie traces service of trie.proto and its methods.
+const (
+	trieServiceName            = "batcher.trie.v1.TrieService"
+	trieExportCompressedMethod = "/" + trieServiceName + "/ExportCompressed"
+	trieSyncDictionaryMethod   = "/" + trieServiceName + "/SyncDictionary"
+)
+
+// Field numbers of the messages of the service in trie.proto.
+const (
+	exportCompressedRequestPayload protowire.Number = 1
+
+	dictionarySyncEpoch    protowire.Number = 1
+	dictionarySyncVersion  protowire.Number = 2
+	dictionarySyncEntries  protowire.Number = 3
+	dictionarySyncSnapshot protowire.Number = 4
+)
+
+// DictionarySync is a message of the SyncDictionary stream. The client sends its whole
+// dictionary with Snapshot set, or entries to Apply. The server answers every message with the
+// version of its dictionary and no entries.
+type DictionarySync struct {
+	DictionaryVersion
+	Entries  []UpdatesEntry
+	Snapshot bool
+}
+
+// TrieGRPCClient is the client API of the prefix-trie traces service.
+type TrieGRPCClient interface {
+	// ExportCompressed sends a payload of TraceCompressor.MarshalTracesProto to the server.
+	ExportCompressed(ctx context.Context, payload []byte, opts ...grpc.CallOption) (ExportResponse, error)
+
+	// SyncDictionary opens a stream to synchronize the dictionary of the client on. It is meant
+	// to stay open as long as the client.
+	SyncDictionary(ctx context.Context, opts ...grpc.CallOption) (DictionarySyncClient, error)
+
+	// unexported disallow implementation of the TrieGRPCClient.
+	unexported()
+}
+
+// DictionarySyncClient is the client side of the SyncDictionary stream.
+type DictionarySyncClient interface {
+	Send(DictionarySync) error
+	Recv() (DictionarySync, error)
+	CloseSend() error
+}
+
+// NewTrieGRPCClient returns a new TrieGRPCClient connected using the given connection.
+func NewTrieGRPCClient(cc *grpc.ClientConn) TrieGRPCClient {
+	return &trieGRPCClient{cc: cc}
+}
+
+type trieGRPCClient struct {
+	cc *grpc.ClientConn
+}
+
+// ExportCompressed implements the TrieGRPCClient interface.
+func (c *trieGRPCClient) ExportCompressed(ctx context.Context, payload []byte, opts ...grpc.CallOption) (ExportResponse, error) {
+	rsp := new(otlpcollectortrace.ExportTraceServiceResponse)
+	if err := c.cc.Invoke(ctx, trieExportCompressedMethod, &exportCompressedRequest{payload: payload}, rsp, opts...); err != nil {
+		return ExportResponse{}, err
+	}
+	state := internal.StateMutable
+	return ExportResponse{orig: rsp, state: &state}, nil
+}
+
+// SyncDictionary implements the TrieGRPCClient interface.
+func (c *trieGRPCClient) SyncDictionary(ctx context.Context, opts ...grpc.CallOption) (DictionarySyncClient, error) {
+	stream, err := c.cc.NewStream(ctx, &trieServiceDesc.Streams[0], trieSyncDictionaryMethod, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &dictionarySyncClient{ClientStream: stream}, nil
+}
+
+func (c *trieGRPCClient) unexported() {}
+
+type dictionarySyncClient struct {
+	grpc.ClientStream
+}
+
+func (s *dictionarySyncClient) Send(m DictionarySync) error {
+	return s.SendMsg(&dictionarySyncMessage{sync: m})
+}
+
+func (s *dictionarySyncClient) Recv() (DictionarySync, error) {
+	m := new(dictionarySyncMessage)
+	if err := s.RecvMsg(m); err != nil {
+		return DictionarySync{}, err
+	}
+	return m.sync, nil
+}
+
+// TrieGRPCServer is the server API of the prefix-trie traces service.
+// Implementations MUST embed UnimplementedTrieGRPCServer.
+type TrieGRPCServer interface {
+	// ExportCompressed is called with every payload of TraceCompressor.MarshalTracesProto
+	// received. A payload referencing entries the dictionary of the client lacks should be
+	// answered with codes.FailedPrecondition, the client then synchronizes its dictionary.
+	ExportCompressed(context.Context, []byte) (ExportResponse, error)
+
+	// SyncDictionary is called for every SyncDictionary stream opened by a client.
+	SyncDictionary(DictionarySyncServer) error
+
+	// unexported disallow implementation of the TrieGRPCServer.
+	unexported()
+}
+
+// DictionarySyncServer is the server side of the SyncDictionary stream.
+type DictionarySyncServer interface {
+	Send(DictionarySync) error
+	Recv() (DictionarySync, error)
+	Context() context.Context
+}
+
+var _ TrieGRPCServer = (*UnimplementedTrieGRPCServer)(nil)
+
+// UnimplementedTrieGRPCServer MUST be embedded to have forward compatible implementations.
+type UnimplementedTrieGRPCServer struct{}
+
+func (*UnimplementedTrieGRPCServer) ExportCompressed(context.Context, []byte) (ExportResponse, error) {
+	return ExportResponse{}, status.Errorf(codes.Unimplemented, "method ExportCompressed not implemented")
+}
+
+func (*UnimplementedTrieGRPCServer) SyncDictionary(DictionarySyncServer) error {
+	return status.Errorf(codes.Unimplemented, "method SyncDictionary not implemented")
+}
+
+func (*UnimplementedTrieGRPCServer) unexported() {}
+
+// RegisterTrieGRPCServer registers the TrieGRPCServer to the grpc.Server.
+func RegisterTrieGRPCServer(s *grpc.Server, srv TrieGRPCServer) {
+	s.RegisterService(&trieServiceDesc, srv)
+}
+
+var trieServiceDesc = grpc.ServiceDesc{
+	ServiceName: trieServiceName,
+	HandlerType: (*TrieGRPCServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ExportCompressed",
+			Handler:    trieExportCompressedHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SyncDictionary",
+			Handler:       trieSyncDictionaryHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "ptrace/ptraceotlp/trie.proto",
+}
+
+func trieExportCompressedHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(exportCompressedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		rsp, err := srv.(TrieGRPCServer).ExportCompressed(ctx, req.(*exportCompressedRequest).payload)
+		if err != nil {
+			return nil, err
+		}
+		return rsp.orig, nil
+	}
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: trieExportCompressedMethod,
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func trieSyncDictionaryHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TrieGRPCServer).SyncDictionary(&dictionarySyncServer{ServerStream: stream})
+}
+
+type dictionarySyncServer struct {
+	grpc.ServerStream
+}
+
+func (s *dictionarySyncServer) Send(m DictionarySync) error {
+	return s.SendMsg(&dictionarySyncMessage{sync: m})
+}
+
+func (s *dictionarySyncServer) Recv() (DictionarySync, error) {
+	m := new(dictionarySyncMessage)
+	if err := s.RecvMsg(m); err != nil {
+		return DictionarySync{}, err
+	}
+	return m.sync, nil
+}
+
+// exportCompressedRequest and dictionarySyncMessage are the messages of the service without
+// generated code. They marshal themselves with protowire, the gRPC proto codec calls their
+// Marshal and Unmarshal methods like it does for the gogo generated messages.
+type exportCompressedRequest struct {
+	payload []byte
+}
+
+func (m *exportCompressedRequest) Reset() { *m = exportCompressedRequest{} }
+func (m *exportCompressedRequest) String() string {
+	return fmt.Sprintf("payload:%d bytes", len(m.payload))
+}
+func (*exportCompressedRequest) ProtoMessage() {}
+
+func (m *exportCompressedRequest) Marshal() ([]byte, error) {
+	b := protowire.AppendTag(nil, exportCompressedRequestPayload, protowire.BytesType)
+	return protowire.AppendBytes(b, m.payload), nil
+}
+
+func (m *exportCompressedRequest) Unmarshal(b []byte) error {
+	return rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != exportCompressedRequestPayload {
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return errTrieProtoWireType
+		}
+		m.payload = append([]byte(nil), v...)
+		return nil
+	})
+}
+
+type dictionarySyncMessage struct {
+	sync DictionarySync
+}
+
+func (m *dictionarySyncMessage) Reset() { *m = dictionarySyncMessage{} }
+func (m *dictionarySyncMessage) String() string {
+	return fmt.Sprintf("epoch:%q version:%d entries:%d snapshot:%t", m.sync.Epoch, m.sync.Version, len(m.sync.Entries), m.sync.Snapshot)
+}
+func (*dictionarySyncMessage) ProtoMessage() {}
+
+func (m *dictionarySyncMessage) Marshal() ([]byte, error) {
+	var b []byte
+	if m.sync.Epoch != "" {
+		b = protowire.AppendTag(b, dictionarySyncEpoch, protowire.BytesType)
+		b = protowire.AppendString(b, m.sync.Epoch)
+	}
+	if m.sync.Version != 0 {
+		b = protowire.AppendTag(b, dictionarySyncVersion, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.sync.Version)
+	}
+	for _, entry := range m.sync.Entries {
+		b = protowire.AppendTag(b, dictionarySyncEntries, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendUpdatesEntry(nil, entry))
+	}
+	if m.sync.Snapshot {
+		b = protowire.AppendTag(b, dictionarySyncSnapshot, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b, nil
+}
+
+func (m *dictionarySyncMessage) Unmarshal(b []byte) error {
+	return rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case dictionarySyncEpoch:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			m.sync.Epoch = string(v)
+		case dictionarySyncVersion:
+			if typ != protowire.VarintType {
+				return errTrieProtoWireType
+			}
+			m.sync.Version, _ = protowire.ConsumeVarint(v)
+		case dictionarySyncEntries:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			entry, err := unmarshalUpdatesEntry(v)
+			if err != nil {
+				return err
+			}
+			m.sync.Entries = append(m.sync.Entries, entry)
+		case dictionarySyncSnapshot:
+			if typ != protowire.VarintType {
+				return errTrieProtoWireType
+			}
+			snapshot, _ := protowire.ConsumeVarint(v)
+			m.sync.Snapshot = snapshot != 0
+		}
+		return nil
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTrieGRPCClient(t *testing.T, srv TrieGRPCServer) TrieGRPCClient {
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	RegisterTrieGRPCServer(s, srv)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, s.Serve(lis))
+	}()
+	t.Cleanup(func() {
+		s.Stop()
+		wg.Wait()
+	})
+
+	cc, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, cc.Close())
+	})
+	return NewTrieGRPCClient(cc)
+}
+
+func TestTrieGrpcExportCompressed(t *testing.T) {
+	srv := &fakeTrieServer{dict: NewDictionary()}
+	client := newTrieGRPCClient(t, srv)
+
+	c := NewTraceCompressor()
+	payload, updates, err := c.MarshalTracesProto(newZstdTestTraces(0, 100))
+	require.NoError(t, err)
+	resp, err := client.ExportCompressed(context.Background(), payload)
+	require.NoError(t, err)
+	assert.Equal(t, NewExportResponse(), resp)
+	c.Acknowledge(updates)
+	assert.Equal(t, c.DictionarySnapshot().DictionaryVersion, srv.dict.Version())
+	assert.Positive(t, srv.spans)
+
+	// A receiver that lost its dictionary answers FailedPrecondition until it is synchronized.
+	payload, _, err = c.MarshalTracesProto(newZstdTestTraces(0, 100))
+	require.NoError(t, err)
+	srv.dict = NewDictionary()
+	_, err = client.ExportCompressed(context.Background(), payload)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	stream, err := client.SyncDictionary(context.Background())
+	require.NoError(t, err)
+	snapshot := c.DictionarySnapshot()
+	require.NoError(t, stream.Send(DictionarySync{DictionaryVersion: snapshot.DictionaryVersion, Entries: snapshot.Entries, Snapshot: true}))
+	ack, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, DictionarySync{DictionaryVersion: snapshot.DictionaryVersion}, ack)
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = client.ExportCompressed(context.Background(), payload)
+	require.NoError(t, err)
+}
+
+func TestTrieGrpcUnimplemented(t *testing.T) {
+	client := newTrieGRPCClient(t, &UnimplementedTrieGRPCServer{})
+	resp, err := client.ExportCompressed(context.Background(), nil)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	assert.Equal(t, ExportResponse{}, resp)
+
+	stream, err := client.SyncDictionary(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestDictionarySyncMessage(t *testing.T) {
+	in := dictionarySyncMessage{sync: DictionarySync{
+		DictionaryVersion: DictionaryVersion{Epoch: "e", Version: 3},
+		Entries:           []UpdatesEntry{{Key: "http.method", Value: "0"}, {Kind: UpdateKindValue, Key: "GET", Value: "0"}},
+		Snapshot:          true,
+	}}
+	buf, err := in.Marshal()
+	require.NoError(t, err)
+	var out dictionarySyncMessage
+	require.NoError(t, out.Unmarshal(buf))
+	assert.Equal(t, in, out)
+}
+
+type fakeTrieServer struct {
+	UnimplementedTrieGRPCServer
+	dict  *Dictionary
+	spans int
+}
+
+func (f *fakeTrieServer) ExportCompressed(_ context.Context, payload []byte) (ExportResponse, error) {
+	td, err := DecodeCompressedProto(payload, f.dict)
+	if errors.Is(err, ErrUnknownReference) {
+		return ExportResponse{}, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return ExportResponse{}, err
+	}
+	f.spans += td.SpanCount()
+	return NewExportResponse(), nil
+}
+
+func (f *fakeTrieServer) SyncDictionary(stream DictionarySyncServer) error {
+	for {
+		m, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if m.Snapshot {
+			f.dict.Restore(DictionarySnapshot{DictionaryVersion: m.DictionaryVersion, Entries: m.Entries})
+		} else {
+			f.dict.Apply(m.Entries)
+		}
+		if err = stream.Send(DictionarySync{DictionaryVersion: f.dict.Version()}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,806 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"go.opentelemetry.io/collector/pdata/internal/data"
+	otlpcommon "go.opentelemetry.io/collector/pdata/internal/data/protogen/common/v1"
+	otlptrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/trace/v1"
+)
+
+// Field numbers of the messages in trie.proto.
+const (
+	exportTrieRequestResourceSpans protowire.Number = 1
+	exportTrieRequestUpdates       protowire.Number = 2
+	exportTrieRequestEpoch         protowire.Number = 3
+	exportTrieRequestVersion       protowire.Number = 4
+
+	updatesEntryKind  protowire.Number = 1
+	updatesEntryKey   protowire.Number = 2
+	updatesEntryValue protowire.Number = 3
+
+	exportDataScopeSpans protowire.Number = 3
+	exportDataResourceID protowire.Number = 5
+
+	scopeSpanTOffset  protowire.Number = 3
+	scopeSpanSpans    protowire.Number = 4
+	scopeSpanTimeMode protowire.Number = 5
+	scopeSpanTraceIDs protowire.Number = 6
+	scopeSpanScopeID  protowire.Number = 7
+
+	trieSpanAN     protowire.Number = 1
+	trieSpanName   protowire.Number = 2
+	trieSpanValue  protowire.Number = 3
+	trieSpanNone   protowire.Number = 4
+	trieSpanSons   protowire.Number = 5
+	trieSpanLeaves protowire.Number = 6
+	trieSpanRef    protowire.Number = 7
+
+	trieSpanStartDeltas protowire.Number = 8
+	trieSpanDurations   protowire.Number = 9
+	trieSpanTraces      protowire.Number = 10
+	trieSpanParents     protowire.Number = 11
+	trieSpanDetails     protowire.Number = 12
+
+	leafDetailsEvents protowire.Number = 1
+	leafDetailsLinks  protowire.Number = 2
+
+	trieEventTimeDelta protowire.Number = 1
+	trieEventName      protowire.Number = 2
+	trieEventNameRef   protowire.Number = 3
+	trieEventAttrs     protowire.Number = 4
+	trieEventDropped   protowire.Number = 5
+
+	trieLinkLink  protowire.Number = 1
+	trieLinkAttrs protowire.Number = 2
+
+	trieAttributeKey   protowire.Number = 1
+	trieAttributeValue protowire.Number = 2
+	trieAttributeRef   protowire.Number = 3
+)
+
+var errTrieProtoWireType = errors.New("prefix trie: unexpected wire type")
+
+func marshalTrieProto(version DictionaryVersion, updates []UpdatesEntry, resourceSpans []ExportData) ([]byte, error) {
+	var b []byte
+	if version.Epoch != "" {
+		b = protowire.AppendTag(b, exportTrieRequestEpoch, protowire.BytesType)
+		b = protowire.AppendString(b, version.Epoch)
+		b = protowire.AppendTag(b, exportTrieRequestVersion, protowire.VarintType)
+		b = protowire.AppendVarint(b, version.Version)
+	}
+	for _, entry := range updates {
+		b = protowire.AppendTag(b, exportTrieRequestUpdates, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendUpdatesEntry(nil, entry))
+	}
+	for i := range resourceSpans {
+		rs, err := appendExportData(nil, &resourceSpans[i])
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, exportTrieRequestResourceSpans, protowire.BytesType)
+		b = protowire.AppendBytes(b, rs)
+	}
+	return b, nil
+}
+
+func appendUpdatesEntry(b []byte, entry UpdatesEntry) []byte {
+	if entry.Kind != "" {
+		b = protowire.AppendTag(b, updatesEntryKind, protowire.BytesType)
+		b = protowire.AppendString(b, entry.Kind)
+	}
+	b = protowire.AppendTag(b, updatesEntryKey, protowire.BytesType)
+	b = protowire.AppendString(b, entry.Key)
+	b = protowire.AppendTag(b, updatesEntryValue, protowire.BytesType)
+	return protowire.AppendString(b, entry.Value)
+}
+
+func appendExportData(b []byte, rs *ExportData) ([]byte, error) {
+	b = protowire.AppendTag(b, exportDataResourceID, protowire.BytesType)
+	b = protowire.AppendString(b, rs.ResourceID)
+	for _, ss := range rs.ScopeSpans {
+		ssBytes, err := appendScopeSpan(nil, ss)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, exportDataScopeSpans, protowire.BytesType)
+		b = protowire.AppendBytes(b, ssBytes)
+	}
+	return b, nil
+}
+
+func appendScopeSpan(b []byte, ss *ScopeSpan) ([]byte, error) {
+	b = protowire.AppendTag(b, scopeSpanScopeID, protowire.BytesType)
+	b = protowire.AppendString(b, ss.ScopeID)
+	b = protowire.AppendTag(b, scopeSpanTOffset, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, ss.TOffset)
+	if ss.TimestampMode != TimestampModeOffset {
+		b = protowire.AppendTag(b, scopeSpanTimeMode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ss.TimestampMode))
+	}
+	for _, id := range ss.TraceIDs {
+		b = protowire.AppendTag(b, scopeSpanTraceIDs, protowire.BytesType)
+		b = protowire.AppendBytes(b, id[:])
+	}
+	for _, son := range ss.Spans {
+		node, ok := son.(*TrieSpan)
+		if !ok {
+			return nil, fmt.Errorf("prefix trie: unexpected scope span entry %T", son)
+		}
+		nodeBytes, err := appendTrieSpan(nil, node)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, scopeSpanSpans, protowire.BytesType)
+		b = protowire.AppendBytes(b, nodeBytes)
+	}
+	return b, nil
+}
+
+func appendTrieSpan(b []byte, node *TrieSpan) ([]byte, error) {
+	b = protowire.AppendTag(b, trieSpanAN, protowire.BytesType)
+	b = protowire.AppendString(b, node.AN)
+	switch av := node.AV.(type) {
+	case otlpcommon.AnyValue:
+		valBytes, err := av.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, trieSpanValue, protowire.BytesType)
+		b = protowire.AppendBytes(b, valBytes)
+	case trieValueRef:
+		b = protowire.AppendTag(b, trieSpanRef, protowire.BytesType)
+		b = protowire.AppendString(b, string(av))
+	case string:
+		if node.AN == trieNameLevel {
+			b = protowire.AppendTag(b, trieSpanName, protowire.BytesType)
+			b = protowire.AppendString(b, av)
+		} else {
+			b = protowire.AppendTag(b, trieSpanNone, protowire.VarintType)
+			b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+		}
+	default:
+		return nil, fmt.Errorf("prefix trie: unexpected value %T for %q", node.AV, node.AN)
+	}
+	var startDeltas, durations, traces, parents []byte
+	var details [][]byte
+	linked, detailed := false, false
+	for _, son := range node.Son {
+		switch son := son.(type) {
+		case *TrieSpan:
+			sonBytes, err := appendTrieSpan(nil, son)
+			if err != nil {
+				return nil, err
+			}
+			b = protowire.AppendTag(b, trieSpanSons, protowire.BytesType)
+			b = protowire.AppendBytes(b, sonBytes)
+		case *trieLeaf:
+			span := *son.span
+			span.Name = ""
+			span.Attributes = nil
+			span.StartTimeUnixNano = son.stun
+			span.EndTimeUnixNano = son.etun
+			if son.trace > 0 {
+				span.TraceId = data.TraceID{}
+				linked = true
+			}
+			if son.parent > 0 {
+				span.ParentSpanId = data.SpanID{}
+				linked = true
+			}
+			var leafDetails []byte
+			if son.detailed {
+				span.Events = nil
+				span.Links = nil
+				var err error
+				if leafDetails, err = appendLeafDetails(nil, son); err != nil {
+					return nil, err
+				}
+				detailed = true
+			}
+			details = append(details, leafDetails)
+			traces = protowire.AppendVarint(traces, uint64(son.trace))
+			parents = protowire.AppendVarint(parents, uint64(son.parent))
+			if son.delta {
+				// The times go to the packed varint fields, fixed64 zeros are not written.
+				span.StartTimeUnixNano = 0
+				span.EndTimeUnixNano = 0
+				startDeltas = protowire.AppendVarint(startDeltas, son.startDelta)
+				durations = protowire.AppendVarint(durations, son.duration())
+			}
+			leafBytes, err := span.Marshal()
+			if err != nil {
+				return nil, err
+			}
+			b = protowire.AppendTag(b, trieSpanLeaves, protowire.BytesType)
+			b = protowire.AppendBytes(b, leafBytes)
+		default:
+			return nil, fmt.Errorf("prefix trie: unexpected son %T under %q", son, node.AN)
+		}
+	}
+	if len(startDeltas) > 0 {
+		b = protowire.AppendTag(b, trieSpanStartDeltas, protowire.BytesType)
+		b = protowire.AppendBytes(b, startDeltas)
+		b = protowire.AppendTag(b, trieSpanDurations, protowire.BytesType)
+		b = protowire.AppendBytes(b, durations)
+	}
+	if linked {
+		b = protowire.AppendTag(b, trieSpanTraces, protowire.BytesType)
+		b = protowire.AppendBytes(b, traces)
+		b = protowire.AppendTag(b, trieSpanParents, protowire.BytesType)
+		b = protowire.AppendBytes(b, parents)
+	}
+	if detailed {
+		for _, leafDetails := range details {
+			b = protowire.AppendTag(b, trieSpanDetails, protowire.BytesType)
+			b = protowire.AppendBytes(b, leafDetails)
+		}
+	}
+	return b, nil
+}
+
+func appendLeafDetails(b []byte, leaf *trieLeaf) ([]byte, error) {
+	for _, event := range leaf.events {
+		var e []byte
+		e = protowire.AppendTag(e, trieEventTimeDelta, protowire.VarintType)
+		e = protowire.AppendVarint(e, protowire.EncodeZigZag(event.timeDelta))
+		switch name := event.name.(type) {
+		case trieValueRef:
+			e = protowire.AppendTag(e, trieEventNameRef, protowire.BytesType)
+			e = protowire.AppendString(e, string(name))
+		case string:
+			if name != "" {
+				e = protowire.AppendTag(e, trieEventName, protowire.BytesType)
+				e = protowire.AppendString(e, name)
+			}
+		}
+		e, err := appendTrieAttributes(e, trieEventAttrs, event.attrs)
+		if err != nil {
+			return nil, err
+		}
+		if event.dropped > 0 {
+			e = protowire.AppendTag(e, trieEventDropped, protowire.VarintType)
+			e = protowire.AppendVarint(e, uint64(event.dropped))
+		}
+		b = protowire.AppendTag(b, leafDetailsEvents, protowire.BytesType)
+		b = protowire.AppendBytes(b, e)
+	}
+	for i := range leaf.links {
+		linkBytes, err := leaf.links[i].link.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		var l []byte
+		l = protowire.AppendTag(l, trieLinkLink, protowire.BytesType)
+		l = protowire.AppendBytes(l, linkBytes)
+		if l, err = appendTrieAttributes(l, trieLinkAttrs, leaf.links[i].attrs); err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, leafDetailsLinks, protowire.BytesType)
+		b = protowire.AppendBytes(b, l)
+	}
+	return b, nil
+}
+
+func appendTrieAttributes(b []byte, num protowire.Number, attrs []trieAttribute) ([]byte, error) {
+	for _, attribute := range attrs {
+		var a []byte
+		a = protowire.AppendTag(a, trieAttributeKey, protowire.BytesType)
+		a = protowire.AppendString(a, attribute.keyRef)
+		switch v := attribute.value.(type) {
+		case trieValueRef:
+			a = protowire.AppendTag(a, trieAttributeRef, protowire.BytesType)
+			a = protowire.AppendString(a, string(v))
+		case otlpcommon.AnyValue:
+			valBytes, err := v.Marshal()
+			if err != nil {
+				return nil, err
+			}
+			a = protowire.AppendTag(a, trieAttributeValue, protowire.BytesType)
+			a = protowire.AppendBytes(a, valBytes)
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, a)
+	}
+	return b, nil
+}
+
+// trieProtoPath is what the levels above a trie node have fixed for the spans below it.
+type trieProtoPath struct {
+	name  string
+	attrs []otlpcommon.KeyValue
+}
+
+// trieProtoScope is what the leaves of a ScopeSpan need from it. parents holds the 1-based leaf
+// index of the parent of each decoded span, 0 if the span keeps its own parent span ID.
+type trieProtoScope struct {
+	dict     *Dictionary
+	tOffset  uint64
+	timeMode TimestampMode
+	traceIDs []data.TraceID
+	parents  []uint64
+}
+
+// unmarshalTrieProto applies the updates carried by the payload to dict and decodes the
+// resource spans with it.
+func unmarshalTrieProto(b []byte, dict *Dictionary) ([]*otlptrace.ResourceSpans, error) {
+	var version DictionaryVersion
+	var updates []UpdatesEntry
+	var resourceSpans [][]byte
+	err := rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case exportTrieRequestEpoch:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			version.Epoch = string(v)
+		case exportTrieRequestVersion:
+			if typ != protowire.VarintType {
+				return errTrieProtoWireType
+			}
+			version.Version, _ = protowire.ConsumeVarint(v)
+		case exportTrieRequestUpdates:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			entry, err := unmarshalUpdatesEntry(v)
+			if err != nil {
+				return err
+			}
+			updates = append(updates, entry)
+		case exportTrieRequestResourceSpans:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			resourceSpans = append(resourceSpans, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The spans may use every update, wherever it is in the payload.
+	if err = dict.sync(version, updates); err != nil {
+		return nil, err
+	}
+	rss := make([]*otlptrace.ResourceSpans, 0, len(resourceSpans))
+	for _, v := range resourceSpans {
+		rs, err := unmarshalExportData(v, dict)
+		if err != nil {
+			return nil, err
+		}
+		rss = append(rss, rs)
+	}
+	return rss, nil
+}
+
+func unmarshalUpdatesEntry(b []byte) (UpdatesEntry, error) {
+	var entry UpdatesEntry
+	err := rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		var field *string
+		switch num {
+		case updatesEntryKind:
+			field = &entry.Kind
+		case updatesEntryKey:
+			field = &entry.Key
+		case updatesEntryValue:
+			field = &entry.Value
+		default:
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return errTrieProtoWireType
+		}
+		*field = string(v)
+		return nil
+	})
+	return entry, err
+}
+
+func unmarshalExportData(b []byte, dict *Dictionary) (*otlptrace.ResourceSpans, error) {
+	var id string
+	var scopeSpans []*otlptrace.ScopeSpans
+	err := rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case exportDataResourceID:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			id = string(v)
+		case exportDataScopeSpans:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			ss, err := unmarshalScopeSpan(v, dict)
+			if err != nil {
+				return err
+			}
+			scopeSpans = append(scopeSpans, ss)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rs, err := resolveResource(dict, id)
+	if err != nil {
+		return nil, err
+	}
+	rs.ScopeSpans = scopeSpans
+	return rs, nil
+}
+
+func unmarshalScopeSpan(b []byte, dict *Dictionary) (*otlptrace.ScopeSpans, error) {
+	var id string
+	scope := &trieProtoScope{dict: dict}
+	var nodes [][]byte
+	err := rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case scopeSpanScopeID:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			id = string(v)
+		case scopeSpanTOffset:
+			if typ != protowire.Fixed64Type {
+				return errTrieProtoWireType
+			}
+			scope.tOffset, _ = protowire.ConsumeFixed64(v)
+		case scopeSpanTimeMode:
+			if typ != protowire.VarintType {
+				return errTrieProtoWireType
+			}
+			x, _ := protowire.ConsumeVarint(v)
+			scope.timeMode = TimestampMode(x)
+		case scopeSpanTraceIDs:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			var id data.TraceID
+			if err := id.Unmarshal(v); err != nil {
+				return err
+			}
+			scope.traceIDs = append(scope.traceIDs, id)
+		case scopeSpanSpans:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			nodes = append(nodes, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ss, err := resolveScope(dict, id)
+	if err != nil {
+		return nil, err
+	}
+	// Nodes are decoded once all fields are read, the leaves need tOffset and the trace IDs.
+	for _, node := range nodes {
+		if err = unmarshalTrieSpan(node, trieProtoPath{}, scope, &ss.Spans); err != nil {
+			return nil, err
+		}
+	}
+	// Parents may come after their children.
+	for i, parent := range scope.parents {
+		if parent == 0 {
+			continue
+		}
+		if parent > uint64(len(ss.Spans)) {
+			return nil, fmt.Errorf("prefix trie: parent index %d out of range", parent-1)
+		}
+		ss.Spans[i].ParentSpanId = ss.Spans[parent-1].SpanId
+	}
+	return ss, nil
+}
+
+func unmarshalTrieSpan(b []byte, path trieProtoPath, scope *trieProtoScope, spans *[]*otlptrace.Span) error {
+	var an string
+	var name string
+	var value otlpcommon.AnyValue
+	var ref *string
+	none := false
+	var sons, leaves [][]byte
+	var startDeltas, durations, traces, parents []uint64
+	var details [][]byte
+	err := rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case trieSpanAN:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			an = string(v)
+		case trieSpanName:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			name = string(v)
+		case trieSpanValue:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			return value.Unmarshal(v)
+		case trieSpanNone:
+			if typ != protowire.VarintType {
+				return errTrieProtoWireType
+			}
+			x, _ := protowire.ConsumeVarint(v)
+			none = protowire.DecodeBool(x)
+		case trieSpanRef:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			r := string(v)
+			ref = &r
+		case trieSpanSons:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			sons = append(sons, v)
+		case trieSpanLeaves:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			leaves = append(leaves, v)
+		case trieSpanStartDeltas:
+			return appendPackedVarints(&startDeltas, typ, v)
+		case trieSpanDurations:
+			return appendPackedVarints(&durations, typ, v)
+		case trieSpanTraces:
+			return appendPackedVarints(&traces, typ, v)
+		case trieSpanParents:
+			return appendPackedVarints(&parents, typ, v)
+		case trieSpanDetails:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			details = append(details, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ref != nil {
+		sv, ok := scope.dict.Value(*ref)
+		if !ok {
+			return fmt.Errorf("%w: value %q", ErrUnknownReference, *ref)
+		}
+		name = sv
+		value = otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_StringValue{StringValue: sv}}
+	}
+
+	switch {
+	case an == trieNameLevel:
+		path.name = name
+	case strings.HasPrefix(an, trieAttrPrefix):
+		key, ok := scope.dict.Key(an[len(trieAttrPrefix):])
+		if !ok {
+			return fmt.Errorf("%w: attribute %q", ErrUnknownReference, an)
+		}
+		if !none {
+			attrs := make([]otlpcommon.KeyValue, len(path.attrs), len(path.attrs)+1)
+			copy(attrs, path.attrs)
+			path.attrs = append(attrs, otlpcommon.KeyValue{Key: key, Value: value})
+		}
+	default:
+		return fmt.Errorf("prefix trie: unexpected level %q", an)
+	}
+
+	for _, son := range sons {
+		if err = unmarshalTrieSpan(son, path, scope, spans); err != nil {
+			return err
+		}
+	}
+	if scope.timeMode == TimestampModeDelta && (len(startDeltas) != len(leaves) || len(durations) != len(leaves)) {
+		return fmt.Errorf("prefix trie: %d leaves with %d start deltas and %d durations", len(leaves), len(startDeltas), len(durations))
+	}
+	if (traces != nil || parents != nil) && (len(traces) != len(leaves) || len(parents) != len(leaves)) {
+		return fmt.Errorf("prefix trie: %d leaves with %d trace and %d parent indexes", len(leaves), len(traces), len(parents))
+	}
+	if details != nil && len(details) != len(leaves) {
+		return fmt.Errorf("prefix trie: %d leaves with %d details", len(leaves), len(details))
+	}
+	var start uint64
+	for i, leaf := range leaves {
+		span := &otlptrace.Span{}
+		if err = span.Unmarshal(leaf); err != nil {
+			return err
+		}
+		span.Name = path.name
+		if len(path.attrs) > 0 {
+			span.Attributes = make([]otlpcommon.KeyValue, len(path.attrs))
+			copy(span.Attributes, path.attrs)
+		}
+		var parent uint64
+		if traces != nil {
+			if trace := traces[i]; trace > 0 {
+				if trace > uint64(len(scope.traceIDs)) {
+					return fmt.Errorf("prefix trie: trace index %d out of range", trace-1)
+				}
+				span.TraceId = scope.traceIDs[trace-1]
+			}
+			parent = parents[i]
+		}
+		scope.parents = append(scope.parents, parent)
+		if scope.timeMode == TimestampModeDelta {
+			start += startDeltas[i]
+			span.StartTimeUnixNano = start
+			span.EndTimeUnixNano = start + durations[i]
+		}
+		span.StartTimeUnixNano += scope.tOffset
+		span.EndTimeUnixNano += scope.tOffset
+		if details != nil && len(details[i]) > 0 {
+			if err = unmarshalLeafDetails(details[i], span, scope.dict); err != nil {
+				return err
+			}
+		}
+		*spans = append(*spans, span)
+	}
+	return nil
+}
+
+func unmarshalLeafDetails(b []byte, span *otlptrace.Span, dict *Dictionary) error {
+	return rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return errTrieProtoWireType
+		}
+		switch num {
+		case leafDetailsEvents:
+			event, err := unmarshalTrieEvent(v, span.StartTimeUnixNano, dict)
+			if err != nil {
+				return err
+			}
+			span.Events = append(span.Events, event)
+		case leafDetailsLinks:
+			link := &otlptrace.Span_Link{}
+			err := rangeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if typ != protowire.BytesType {
+					return errTrieProtoWireType
+				}
+				switch num {
+				case trieLinkLink:
+					return link.Unmarshal(v)
+				case trieLinkAttrs:
+					kv, err := unmarshalTrieAttribute(v, dict)
+					if err != nil {
+						return err
+					}
+					link.Attributes = append(link.Attributes, kv)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			span.Links = append(span.Links, link)
+		}
+		return nil
+	})
+}
+
+func unmarshalTrieEvent(b []byte, start uint64, dict *Dictionary) (*otlptrace.Span_Event, error) {
+	event := &otlptrace.Span_Event{TimeUnixNano: start}
+	err := rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case trieEventTimeDelta:
+			if typ != protowire.VarintType {
+				return errTrieProtoWireType
+			}
+			x, _ := protowire.ConsumeVarint(v)
+			event.TimeUnixNano = start + uint64(protowire.DecodeZigZag(x))
+		case trieEventName:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			event.Name = string(v)
+		case trieEventNameRef:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			name, ok := dict.Value(string(v))
+			if !ok {
+				return fmt.Errorf("%w: value %q", ErrUnknownReference, string(v))
+			}
+			event.Name = name
+		case trieEventAttrs:
+			if typ != protowire.BytesType {
+				return errTrieProtoWireType
+			}
+			kv, err := unmarshalTrieAttribute(v, dict)
+			if err != nil {
+				return err
+			}
+			event.Attributes = append(event.Attributes, kv)
+		case trieEventDropped:
+			if typ != protowire.VarintType {
+				return errTrieProtoWireType
+			}
+			x, _ := protowire.ConsumeVarint(v)
+			event.DroppedAttributesCount = uint32(x)
+		}
+		return nil
+	})
+	return event, err
+}
+
+func unmarshalTrieAttribute(b []byte, dict *Dictionary) (otlpcommon.KeyValue, error) {
+	var kv otlpcommon.KeyValue
+	err := rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return errTrieProtoWireType
+		}
+		switch num {
+		case trieAttributeKey:
+			key, ok := dict.Key(string(v))
+			if !ok {
+				return fmt.Errorf("%w: attribute %q", ErrUnknownReference, trieAttrPrefix+string(v))
+			}
+			kv.Key = key
+		case trieAttributeValue:
+			return kv.Value.Unmarshal(v)
+		case trieAttributeRef:
+			value, ok := dict.Value(string(v))
+			if !ok {
+				return fmt.Errorf("%w: value %q", ErrUnknownReference, string(v))
+			}
+			kv.Value = otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_StringValue{StringValue: value}}
+		}
+		return nil
+	})
+	return kv, err
+}
+
+// appendPackedVarints appends the values of a repeated uint64 field to dst, packed or not.
+func appendPackedVarints(dst *[]uint64, typ protowire.Type, v []byte) error {
+	switch typ {
+	case protowire.VarintType:
+		x, _ := protowire.ConsumeVarint(v)
+		*dst = append(*dst, x)
+	case protowire.BytesType:
+		for len(v) > 0 {
+			x, n := protowire.ConsumeVarint(v)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*dst = append(*dst, x)
+			v = v[n:]
+		}
+	default:
+		return errTrieProtoWireType
+	}
+	return nil
+}
+
+// rangeFields calls f for every field of the protobuf message b. For length-delimited fields v is
+// the field content, for the other wire types it is the raw encoded value.
+func rangeFields(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		v := b[:m]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+		if err := f(num, typ, v); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	otlpcommon "go.opentelemetry.io/collector/pdata/internal/data/protogen/common/v1"
+	otlptrace "go.opentelemetry.io/collector/pdata/internal/data/protogen/trace/v1"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func newTrieTestTraces() ptrace.Traces {
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.SetSchemaUrl("https://opentelemetry.io/schemas/1.21.0")
+	rs.Resource().Attributes().PutStr("service.name", "checkout")
+	ss := rs.ScopeSpans().AppendEmpty()
+	ss.Scope().SetName("trie-test")
+	ss.Scope().SetVersion("v1")
+	for i, name := range []string{"GET /cart", "GET /cart", "SELECT"} {
+		span := ss.Spans().AppendEmpty()
+		span.SetName(name)
+		span.SetTraceID(pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}))
+		span.SetSpanID(pcommon.SpanID([8]byte{1, 2, 3, 4, 5, 6, 7, byte(i + 1)}))
+		span.SetKind(ptrace.SpanKindServer)
+		span.SetStartTimestamp(pcommon.Timestamp(1700000000000000000 + uint64(i)*1000))
+		span.SetEndTimestamp(pcommon.Timestamp(1700000000000005000 + uint64(i)*1000))
+		span.Status().SetCode(ptrace.StatusCodeOk)
+	}
+	return td
+}
+
+func TestPrefixTrieProtoRoundTrip(t *testing.T) {
+	td := newTrieTestTraces()
+	buf, updates, err := NewTraceCompressor().MarshalTracesProto(td)
+	require.NoError(t, err)
+	// No attribute has to be announced, only the resource and the scope.
+	require.Len(t, updates, 2)
+	assert.Equal(t, UpdateKindResource, updates[0].Kind)
+	assert.Equal(t, UpdateKindScope, updates[1].Kind)
+
+	dict := NewDictionary()
+	dict.Apply(updates)
+	got, err := DecodeCompressedProto(buf, dict)
+	require.NoError(t, err)
+
+	rs := got.ResourceSpans()
+	require.Equal(t, 1, rs.Len())
+	assert.Equal(t, "https://opentelemetry.io/schemas/1.21.0", rs.At(0).SchemaUrl())
+	assert.Equal(t, td.ResourceSpans().At(0).Resource().Attributes().AsRaw(), rs.At(0).Resource().Attributes().AsRaw())
+	assert.Equal(t, "trie-test", rs.At(0).ScopeSpans().At(0).Scope().Name())
+
+	want := map[pcommon.SpanID]ptrace.Span{}
+	spans := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	for i := 0; i < spans.Len(); i++ {
+		want[spans.At(i).SpanID()] = spans.At(i)
+	}
+	gotSpans := rs.At(0).ScopeSpans().At(0).Spans()
+	require.Equal(t, spans.Len(), gotSpans.Len())
+	for i := 0; i < gotSpans.Len(); i++ {
+		assert.Equal(t, want[gotSpans.At(i).SpanID()], gotSpans.At(i))
+	}
+}
+
+func TestPrefixTrieProtoAttributes(t *testing.T) {
+	td := newTrieTestTraces()
+	spans := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	for i := 0; i < spans.Len(); i++ {
+		spans.At(i).Attributes().PutStr("http.method", "GET")
+		spans.At(i).Attributes().PutInt("http.status_code", int64(200+i))
+	}
+	buf, updates, err := NewTraceCompressor().MarshalTracesProto(td)
+	require.NoError(t, err)
+
+	dict := NewDictionary()
+	dict.Apply(updates)
+	got, err := DecodeCompressedProto(buf, dict)
+	require.NoError(t, err)
+
+	// Without a sampling policy every span is encoded and must come back unchanged.
+	want := map[pcommon.SpanID]ptrace.Span{}
+	for i := 0; i < spans.Len(); i++ {
+		want[spans.At(i).SpanID()] = spans.At(i)
+	}
+	gotSpans := got.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	require.Equal(t, spans.Len(), gotSpans.Len())
+	for i := 0; i < gotSpans.Len(); i++ {
+		span := gotSpans.At(i)
+		assert.Equal(t, want[span.SpanID()].Name(), span.Name())
+		assert.Equal(t, want[span.SpanID()].StartTimestamp(), span.StartTimestamp())
+		assert.Equal(t, want[span.SpanID()].Attributes().AsRaw(), span.Attributes().AsRaw())
+	}
+}
+
+func TestPrefixTrieProtoUnknownReference(t *testing.T) {
+	encDict := NewDictionary()
+	b := newTrieBuilder(encDict)
+	buf, err := marshalTrieProto(DictionaryVersion{}, nil, []ExportData{{
+		ResourceID: b.fingerprintResource(&otlptrace.ResourceSpans{}),
+		ScopeSpans: []*ScopeSpan{{
+			ScopeID: b.fingerprintScope(&otlptrace.ScopeSpans{}),
+			Spans: []interface{}{&TrieSpan{
+				AN: trieNameLevel,
+				AV: "SELECT",
+				Son: []interface{}{&TrieSpan{
+					AN:  "attr_7",
+					AV:  otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_StringValue{StringValue: "x"}},
+					Son: []interface{}{&trieLeaf{span: &otlptrace.Span{}}},
+				}},
+			}},
+		}},
+	}})
+	require.NoError(t, err)
+	_, err = DecodeCompressedProto(buf, NewDictionary())
+	assert.ErrorIs(t, err, ErrUnknownReference)
+
+	dict := NewDictionary()
+	dict.Apply(encDict.Entries())
+	_, err = DecodeCompressedProto(buf, dict)
+	assert.ErrorIs(t, err, ErrUnknownReference)
+
+	dict.Apply([]UpdatesEntry{{Key: "db.statement", Value: "7"}})
+	got, err := DecodeCompressedProto(buf, dict)
+	require.NoError(t, err)
+	span := got.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0)
+	assert.Equal(t, "SELECT", span.Name())
+	assert.Equal(t, map[string]any{"db.statement": "x"}, span.Attributes().AsRaw())
+}
+
+func TestPrefixTrieProtoInvalid(t *testing.T) {
+	_, err := DecodeCompressedProto([]byte{0xff}, NewDictionary())
+	assert.Error(t, err)
+
+	var b []byte
+	b = protowire.AppendTag(b, exportTrieRequestResourceSpans, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	_, err = DecodeCompressedProto(b, NewDictionary())
+	assert.Error(t, err)
+}
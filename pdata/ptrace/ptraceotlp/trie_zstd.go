@@ -0,0 +1,262 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp // import "go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// zstdSamples is the number of recent payloads the zstd dictionary is trained on.
+	zstdSamples = 64
+	// zstdMinSamples is the number of payloads needed before the first training.
+	zstdMinSamples = 8
+	// zstdMinSampleBytes is the sample volume needed for a training, the trainer needs a few
+	// hundred matches to build its statistics.
+	zstdMinSampleBytes = 32 << 10
+	// zstdMaxDictSize bounds the trained dictionary, it is sent to the receiver once per training.
+	zstdMaxDictSize = 32 << 10
+	// zstdRatioWindow is the number of payloads the compression ratio is averaged over.
+	zstdRatioWindow = 16
+	// zstdRetrainRatio retrains the dictionary once the average ratio is that much worse than
+	// the one measured right after the last training.
+	zstdRetrainRatio = 1.25
+	// zstdKeptDicts is the number of zstd dictionaries a Dictionary keeps, the current one and
+	// the one before it for the payloads compressed before its acknowledgement.
+	zstdKeptDicts = 2
+)
+
+// zstdMagic starts every zstd frame, neither trie encoding starts with it.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdStage compresses trie payloads with a zstd dictionary trained on the recent payloads.
+// Payloads repeat the same names, keys and structure from request to request, which a
+// per-request compressor cannot exploit. Until the first training frames use no dictionary.
+// A trained dictionary is only used once the receiver acknowledged it, the frames it cannot
+// decompress yet would carry the dictionary themselves.
+type zstdStage struct {
+	samples     [][]byte // ring of the last zstdSamples payloads
+	next        int
+	sampleBytes int
+
+	enc       *zstd.Encoder
+	trained   bool
+	attempted bool
+
+	pendingEnc *zstd.Encoder // trained encoder waiting for the acknowledgement of its dictionary
+	pendingRef string
+
+	baseline float64 // average ratio of the first window after a training, 0 until measured
+	ratioSum float64
+	ratioN   int
+}
+
+func newZstdStage() (*zstdStage, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdStage{enc: enc}, nil
+}
+
+// compress returns payload as a zstd frame. A newly trained dictionary is added to d and
+// returned as the update the decoding side has to Apply, it is used after acknowledge.
+func (z *zstdStage) compress(payload []byte, d *Dictionary) ([]byte, *UpdatesEntry, error) {
+	z.sample(payload)
+	var entry *UpdatesEntry
+	if z.needsTraining() {
+		var err error
+		if entry, err = z.train(d); err != nil {
+			return nil, nil, err
+		}
+	}
+	out := z.enc.EncodeAll(payload, nil)
+	z.ratioSum += float64(len(out)) / float64(len(payload)+1)
+	z.ratioN++
+	return out, entry, nil
+}
+
+func (z *zstdStage) sample(payload []byte) {
+	s := make([]byte, len(payload))
+	copy(s, payload)
+	z.sampleBytes += len(s)
+	if len(z.samples) < zstdSamples {
+		z.samples = append(z.samples, s)
+		return
+	}
+	z.sampleBytes -= len(z.samples[z.next])
+	z.samples[z.next] = s
+	z.next = (z.next + 1) % zstdSamples
+}
+
+// needsTraining reports whether the dictionary has to be trained. Without one, training is
+// attempted once per window as soon as there are enough samples, until it succeeds. Afterwards
+// it is retrained when the ratio of a window falls behind the baseline.
+func (z *zstdStage) needsTraining() bool {
+	if z.pendingEnc != nil {
+		return false
+	}
+	if len(z.samples) < zstdMinSamples || z.sampleBytes < zstdMinSampleBytes {
+		return false
+	}
+	if !z.trained {
+		return !z.attempted || z.ratioN >= zstdRatioWindow
+	}
+	if z.ratioN < zstdRatioWindow {
+		return false
+	}
+	avg := z.ratioSum / float64(z.ratioN)
+	z.ratioSum, z.ratioN = 0, 0
+	if z.baseline == 0 {
+		z.baseline = avg
+		return false
+	}
+	return avg > z.baseline*zstdRetrainRatio
+}
+
+// train builds a dictionary from the samples and prepares its encoder. Samples too uniform or
+// too small to train on keep the current dictionary.
+func (z *zstdStage) train(d *Dictionary) (*UpdatesEntry, error) {
+	z.ratioSum, z.ratioN = 0, 0
+	z.attempted = true
+	raw, err := buildZstdDict(z.samples)
+	if err != nil {
+		// Not enough material, the samples of the next window get another try.
+		return nil, nil
+	}
+	info, err := zstd.InspectDictionary(raw)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(raw))
+	if err != nil {
+		return nil, err
+	}
+	entry := d.zstdDictionary(info.ID(), base64.StdEncoding.EncodeToString(raw))
+	if entry == nil {
+		return nil, nil
+	}
+	z.pendingEnc, z.pendingRef = enc, entry.Value
+	return entry, nil
+}
+
+// acknowledge switches to the trained dictionary ref once the receiver has it.
+func (z *zstdStage) acknowledge(ref string) {
+	if z.pendingEnc == nil || ref != z.pendingRef {
+		return
+	}
+	z.enc, z.pendingEnc, z.pendingRef = z.pendingEnc, nil, ""
+	z.trained = true
+	z.baseline, z.ratioSum, z.ratioN = 0, 0, 0
+}
+
+// buildZstdDict trains a zstd dictionary on samples. The trainer panics on some degenerate
+// inputs, that is reported as an error like the inputs it rejects.
+func buildZstdDict(samples [][]byte) (raw []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("prefix trie: zstd dictionary training failed: %v", r)
+		}
+	}()
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: zstdMaxDictSize,
+		HashBytes:   6,
+		ZstdLevel:   zstd.SpeedDefault,
+	})
+}
+
+// decompressZstd returns buf unchanged unless it is a zstd frame, which it decompresses with
+// the zstd dictionary of d named in the frame header.
+func decompressZstd(buf []byte, d *Dictionary) ([]byte, error) {
+	if !bytes.HasPrefix(buf, zstdMagic) {
+		return buf, nil
+	}
+	var header zstd.Header
+	if err := header.Decode(buf); err != nil {
+		return nil, err
+	}
+	dec, err := d.zstdDecoder(header.DictionaryID)
+	if err != nil {
+		return nil, err
+	}
+	return dec.DecodeAll(buf, nil)
+}
+
+// zstdDictionary records the base64 zstd dictionary raw as id. The returned entry is nil if it
+// was recorded already.
+func (d *Dictionary) zstdDictionary(id uint32, raw string) *UpdatesEntry {
+	ref := strconv.FormatUint(uint64(id), 10)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.zstdDicts[ref] == raw {
+		return nil
+	}
+	d.recordZstd(ref, raw)
+	d.version++
+	return &UpdatesEntry{Kind: UpdateKindZstd, Key: raw, Value: ref}
+}
+
+// recordZstd records the base64 zstd dictionary raw as ref, the latest one. Only the last
+// zstdKeptDicts dictionaries are kept, the older ones are dropped along with their decoders.
+// d.mu must be held.
+func (d *Dictionary) recordZstd(ref, raw string) {
+	d.zstdDicts[ref] = raw
+	d.dropZstdDecoder(ref)
+	for i, kept := range d.zstdOrder {
+		if kept == ref {
+			d.zstdOrder = append(d.zstdOrder[:i], d.zstdOrder[i+1:]...)
+			break
+		}
+	}
+	d.zstdOrder = append(d.zstdOrder, ref)
+	for len(d.zstdOrder) > zstdKeptDicts {
+		old := d.zstdOrder[0]
+		d.zstdOrder = d.zstdOrder[1:]
+		delete(d.zstdDicts, old)
+		d.dropZstdDecoder(old)
+	}
+}
+
+// dropZstdDecoder forgets the decoder of the zstd dictionary ref. It is not closed, a payload may
+// still be decompressed with it. d.mu must be held.
+func (d *Dictionary) dropZstdDecoder(ref string) {
+	if id, err := strconv.ParseUint(ref, 10, 32); err == nil {
+		delete(d.zstdDecoders, uint32(id))
+	}
+}
+
+// zstdDecoder returns the decoder for frames compressed with the zstd dictionary id, 0 for
+// frames without dictionary. Decoders are created on first use.
+func (d *Dictionary) zstdDecoder(id uint32) (*zstd.Decoder, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dec, ok := d.zstdDecoders[id]; ok {
+		return dec, nil
+	}
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if id != 0 {
+		ref := strconv.FormatUint(uint64(id), 10)
+		encoded, ok := d.zstdDicts[ref]
+		if !ok {
+			return nil, fmt.Errorf("%w: zstd dictionary %q", ErrUnknownReference, ref)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("prefix trie: malformed zstd dictionary: %w", err)
+		}
+		opts = append(opts, zstd.WithDecoderDicts(raw))
+	}
+	dec, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	d.zstdDecoders[id] = dec
+	return dec, nil
+}
@@ -0,0 +1,181 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ptraceotlp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// newZstdTestTraces returns a batch of n spans, large enough for the payloads to train on.
+func newZstdTestTraces(batch, n int) ptrace.Traces {
+	td := newTrieTestTraces()
+	spans := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	spans.RemoveIf(func(ptrace.Span) bool { return true })
+	for i := 0; i < n; i++ {
+		span := spans.AppendEmpty()
+		span.SetName("GET /cart/" + strconv.Itoa(i%5))
+		span.SetTraceID(pcommon.TraceID([16]byte{byte(batch), byte(i / 10), 1}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(batch), byte(batch >> 8), 0, 0, 0, 0, 0, byte(i)}))
+		span.SetStartTimestamp(pcommon.Timestamp(1700000000000000000 + uint64(batch*n+i)*1000))
+		span.SetEndTimestamp(pcommon.Timestamp(1700000000000005000 + uint64(batch*n+i)*1700))
+		span.Attributes().PutStr("http.url", "https://shop.example/cart/"+strconv.Itoa(batch*n+i))
+		span.Attributes().PutInt("http.status_code", int64(200+i%3))
+		span.Attributes().PutStr("user.id", "user-"+strconv.Itoa((batch*7+i)%97))
+	}
+	return td
+}
+
+func TestTraceCompressorZstd(t *testing.T) {
+	c := NewTraceCompressor()
+	require.NoError(t, c.EnableZstd())
+
+	dict := NewDictionary()
+	var trained []byte
+	acked := false
+	for batch := 0; batch < 4*zstdMinSamples && trained == nil; batch++ {
+		buf, updates, err := c.MarshalTracesProto(newZstdTestTraces(batch, 100))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(buf, zstdMagic))
+		_, err = DecodeCompressedProto(buf, dict)
+		require.NoError(t, err)
+		if acked {
+			// The first payload compressed with the acknowledged dictionary.
+			trained = buf
+		}
+		for _, entry := range updates {
+			acked = acked || entry.Kind == UpdateKindZstd
+		}
+		c.Acknowledge(updates)
+	}
+	require.NotNil(t, trained, "no zstd dictionary was trained")
+
+	// The receiver needs the trained dictionary, the other entries alone do not decode the payload.
+	var withoutZstd []UpdatesEntry
+	for _, entry := range c.DictionaryEntries() {
+		if entry.Kind != UpdateKindZstd {
+			withoutZstd = append(withoutZstd, entry)
+		}
+	}
+	lost := NewDictionary()
+	lost.Apply(withoutZstd)
+	_, err := DecodeCompressedProto(trained, lost)
+	assert.ErrorIs(t, err, ErrUnknownReference)
+	lost.Restore(c.DictionarySnapshot())
+	_, err = DecodeCompressedProto(trained, lost)
+	require.NoError(t, err)
+}
+
+func TestTraceCompressorZstdJSON(t *testing.T) {
+	c := NewTraceCompressor()
+	require.NoError(t, c.EnableZstd())
+	td := newCodecTestTraces()
+	buf, updates, err := c.MarshalTraces(td)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(buf, zstdMagic))
+
+	dict := NewDictionary()
+	dict.Apply(updates)
+	_, err = DecodeCompressed(buf, dict)
+	require.NoError(t, err)
+}
+
+func TestZstdStageRetrain(t *testing.T) {
+	z, err := newZstdStage()
+	require.NoError(t, err)
+	d := NewDictionary()
+
+	payload := func(batch int) []byte {
+		buf, _, err := EncodeCompressedProto(newZstdTestTraces(batch, 100), NewDictionary())
+		require.NoError(t, err)
+		return buf
+	}
+	trainings := 0
+	compress := func(p []byte) {
+		out, entry, err := z.compress(p, d)
+		require.NoError(t, err)
+		got, err := decompressZstd(out, d)
+		require.NoError(t, err)
+		assert.Equal(t, p, got)
+		if entry != nil {
+			trainings++
+			z.acknowledge(entry.Value)
+		}
+	}
+
+	batch := 0
+	for ; batch < zstdMinSamples+2*zstdRatioWindow; batch++ {
+		compress(payload(batch))
+	}
+	assert.Equal(t, 1, trainings)
+	assert.True(t, z.trained)
+	assert.Positive(t, z.baseline)
+
+	// Payloads the dictionary does not fit degrade the ratio until it is retrained.
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 4*zstdRatioWindow && trainings == 1; i++ {
+		p := payload(batch)
+		rnd.Read(p[len(p)/2:])
+		compress(p)
+	}
+	assert.Equal(t, 2, trainings)
+}
+
+func TestDecompressZstdPassThrough(t *testing.T) {
+	buf := []byte(`{"resourceSpans":[]}`)
+	got, err := decompressZstd(buf, NewDictionary())
+	require.NoError(t, err)
+	assert.Equal(t, buf, got)
+}
+
+func TestDictionaryZstdKeepsPrevious(t *testing.T) {
+	var samples [][]byte
+	for batch := 0; batch < zstdSamples; batch++ {
+		buf, _, err := EncodeCompressedProto(newZstdTestTraces(batch, 100), NewDictionary())
+		require.NoError(t, err)
+		samples = append(samples, buf)
+	}
+	raw, err := buildZstdDict(samples)
+	require.NoError(t, err)
+	info, err := zstd.InspectDictionary(raw)
+	require.NoError(t, err)
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(raw))
+	require.NoError(t, err)
+	frame := enc.EncodeAll(samples[0], nil)
+	encoded := base64.StdEncoding.EncodeToString(raw)
+
+	d := NewDictionary()
+	d.Apply([]UpdatesEntry{{Kind: UpdateKindZstd, Key: encoded, Value: strconv.FormatUint(uint64(info.ID()), 10)}})
+	_, err = decompressZstd(frame, d)
+	require.NoError(t, err)
+
+	// The previous dictionary still decompresses the payloads sent before the new one.
+	d.Apply([]UpdatesEntry{{Kind: UpdateKindZstd, Key: encoded, Value: "1"}})
+	got, err := decompressZstd(frame, d)
+	require.NoError(t, err)
+	assert.Equal(t, samples[0], got)
+	assert.Len(t, d.zstdDicts, 2)
+
+	// The one before is dropped along with its decoder.
+	d.Apply([]UpdatesEntry{{Kind: UpdateKindZstd, Key: encoded, Value: "2"}})
+	_, err = decompressZstd(frame, d)
+	assert.ErrorIs(t, err, ErrUnknownReference)
+	assert.Len(t, d.zstdDicts, 2)
+	assert.NotContains(t, d.zstdDecoders, info.ID())
+	assert.Equal(t, []string{"1", "2"}, d.zstdOrder)
+
+	restored := NewDictionary()
+	restored.Restore(d.Snapshot())
+	assert.Equal(t, d.zstdOrder, restored.zstdOrder)
+}
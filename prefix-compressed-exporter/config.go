@@ -9,9 +9,11 @@ import (
 	"fmt"
 
 	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/config/configgrpc"
 	"go.opentelemetry.io/collector/config/confighttp"
 	"go.opentelemetry.io/collector/config/configretry"
 	"go.opentelemetry.io/collector/exporter/exporterhelper"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
 )
 
 // EncodingType defines the type for content encoding
@@ -43,15 +45,52 @@ func (e *EncodingType) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// TimestampModeType defines how span times are written in the prefix trie
+type TimestampModeType string
+
+const (
+	TimestampModeDelta  TimestampModeType = "delta"
+	TimestampModeOffset TimestampModeType = "offset"
+)
+
+var _ encoding.TextUnmarshaler = (*TimestampModeType)(nil)
+
+// UnmarshalText unmarshalls text to a TimestampModeType.
+func (m *TimestampModeType) UnmarshalText(text []byte) error {
+	if m == nil {
+		return errors.New("cannot unmarshal to a nil *TimestampModeType")
+	}
+
+	str := string(text)
+	switch str {
+	case string(TimestampModeDelta):
+		*m = TimestampModeDelta
+	case string(TimestampModeOffset):
+		*m = TimestampModeOffset
+	default:
+		return fmt.Errorf("invalid timestamp mode: %s", str)
+	}
+
+	return nil
+}
+
 // Config defines configuration for OTLP/HTTP exporter.
 type Config struct {
 	confighttp.ClientConfig `mapstructure:",squash"`     // squash ensures fields are correctly decoded in embedded struct.
 	QueueConfig             exporterhelper.QueueSettings `mapstructure:"sending_queue"`
 	RetryConfig             configretry.BackOffConfig    `mapstructure:"retry_on_failure"`
 
+	// Makes the sending queue of the traces send the abnormal batches first.
+	PriorityQueue PriorityQueueConfig `mapstructure:"priority_queue"`
+
 	// The URL to send traces to. If omitted the Endpoint + "/v1/traces" will be used.
 	TracesEndpoint string `mapstructure:"traces_endpoint"`
 
+	// The URL the traces dictionary is posted to and, with a seed, read from. If omitted the
+	// Endpoint + "/v1/tracesdict" will be used, or else the "/v1/tracesdict" path next to the
+	// "/v1/traces" one of TracesEndpoint.
+	TracesDictEndpoint string `mapstructure:"tracesdict_endpoint"`
+
 	// The URL to send metrics to. If omitted the Endpoint + "/v1/metrics" will be used.
 	MetricsEndpoint string `mapstructure:"metrics_endpoint"`
 
@@ -60,14 +99,165 @@ type Config struct {
 
 	// The encoding to export telemetry (default: "json")
 	Encoding EncodingType `mapstructure:"encoding"`
+
+	// How span times are written in the prefix trie (default: "delta"). "offset" writes them
+	// as offsets from the smallest start time, for gateways that predate the delta mode.
+	TimestampMode TimestampModeType `mapstructure:"timestamp_mode"`
+
+	// Identifies this agent to the gateway, which keeps a traces dictionary per agent. If
+	// omitted a random ID is generated when the exporter is created. A gateway requiring client
+	// certificates identifies the agent by their common name instead.
+	AgentID string `mapstructure:"agent_id"`
+
+	// The storage extension the traces dictionary and the generated agent ID are persisted to,
+	// they are restored when the exporter starts. If omitted they only live in memory.
+	StorageID *component.ID `mapstructure:"storage"`
+
+	// Bounds of the traces dictionary, the receiver evicts the same entries.
+	Dictionary DictionaryConfig `mapstructure:"dictionary"`
+
+	// The attribute keys the agent and the gateway know beforehand, they are never synchronized.
+	// The exporter fails to start when the gateway is configured with another seed.
+	Seed ptraceotlp.DictionarySeedConfig `mapstructure:"seed"`
+
+	// Which spans are sent. Sampling is off by default, every span is sent. The dropped spans
+	// are counted by the exporter/sampled_out_spans metric.
+	Sampling SamplingConfig `mapstructure:"sampling"`
+
+	// Sends the traces to the prefix-trie gRPC service of the receiver at this endpoint instead
+	// of the HTTP endpoints, always in the protobuf encoding, and synchronizes the dictionary on
+	// its SyncDictionary stream. Metrics and logs still use HTTP.
+	GRPC *configgrpc.ClientConfig `mapstructure:"grpc"`
+
+	// Serves the traces dictionary as JSON on /debug/tracesdict when set. It takes the
+	// confighttp server settings, auth included. If omitted no debug server is started.
+	Debug *confighttp.ServerConfig `mapstructure:"debug"`
+}
+
+// DictionaryConfig bounds the traces dictionary and the span name statistics of the exporter.
+type DictionaryConfig struct {
+	// The number of entries kept (default: 0, no limit).
+	MaxEntries int `mapstructure:"max_entries"`
+
+	// The size in bytes of the keys and values kept (default: 0, no limit).
+	MaxBytes int `mapstructure:"max_bytes"`
+
+	// Which entries are evicted first: "lru" (default) or "lfu".
+	Eviction ptraceotlp.EvictionPolicy `mapstructure:"eviction"`
+}
+
+// SamplingConfig is the sampling policy of the traces.
+type SamplingConfig struct {
+	// Turns sampling on (default: false).
+	Enabled bool `mapstructure:"enabled"`
+
+	// The fraction of the ordinary traces sent, from 0 to 1 (default: 0.5). The decision is made
+	// on the trace ID, every agent keeps the same traces, and the sampling threshold is written to
+	// the ot tracestate entry of the spans sent.
+	Rate float64 `mapstructure:"rate"`
+
+	// Sends the spans with a rare name or a rare attribute path whatever the rate (default: true).
+	// Like for always_keep, the other spans of their trace in the batch are sent as well.
+	KeepAbnormal bool `mapstructure:"keep_abnormal"`
+
+	// The spans sent whatever the rate, along with the other spans of their trace in the batch.
+	AlwaysKeep []SamplingRuleConfig `mapstructure:"always_keep"`
+}
+
+// SamplingRuleConfig matches spans by name and attribute, the fields left empty match anything.
+type SamplingRuleConfig struct {
+	SpanName  string `mapstructure:"span_name"`
+	Attribute string `mapstructure:"attribute"`
+	Value     string `mapstructure:"value"`
+}
+
+// policy returns the sampling policy of the compressor.
+func (cfg SamplingConfig) policy() ptraceotlp.SamplingPolicy {
+	policy := ptraceotlp.SamplingPolicy{
+		Enabled:      cfg.Enabled,
+		Rate:         cfg.Rate,
+		KeepAbnormal: cfg.KeepAbnormal,
+	}
+	for _, rule := range cfg.AlwaysKeep {
+		policy.AlwaysKeep = append(policy.AlwaysKeep, ptraceotlp.SamplingRule{
+			SpanName:  rule.SpanName,
+			Attribute: rule.Attribute,
+			Value:     rule.Value,
+		})
+	}
+	return policy
+}
+
+// PriorityQueueConfig makes the sending queue of the traces hand out the abnormal batches
+// first: those with a span with an error status, an anomaly score or an outlier duration.
+type PriorityQueueConfig struct {
+	// Turns the priority queue on (default: false). It takes the size and consumers of the
+	// sending_queue, which must be enabled and without storage.
+	Enabled bool `mapstructure:"enabled"`
+
+	// The share of the sending queue only the abnormal batches may use, from 0 to below 1
+	// (default: 0.2), the normal batches need some room. On a full queue the oldest normal batch
+	// is shed for an abnormal one.
+	Reserved float64 `mapstructure:"reserved"`
+
+	// The attribute of the anomaly processor score and the score from which a span is abnormal
+	// (default: "anomaly.score" and 0.9).
+	ScoreAttribute string  `mapstructure:"score_attribute"`
+	MinScore       float64 `mapstructure:"min_score"`
+
+	// A span lasting this many times the moving average of its span name is abnormal (default:
+	// 3, 0 to turn it off).
+	LatencyFactor float64 `mapstructure:"latency_factor"`
 }
 
 var _ component.Config = (*Config)(nil)
 
 // Validate checks if the exporter configuration is valid
 func (cfg *Config) Validate() error {
-	if cfg.Endpoint == "" && cfg.TracesEndpoint == "" && cfg.MetricsEndpoint == "" && cfg.LogsEndpoint == "" {
+	if cfg.Endpoint == "" && cfg.TracesEndpoint == "" && cfg.MetricsEndpoint == "" && cfg.LogsEndpoint == "" && cfg.GRPC == nil {
 		return errors.New("at least one endpoint must be specified")
 	}
+	if cfg.GRPC != nil && cfg.GRPC.Endpoint == "" {
+		return errors.New("grpc endpoint must be specified")
+	}
+	if cfg.Dictionary.MaxEntries < 0 || cfg.Dictionary.MaxBytes < 0 {
+		return errors.New("dictionary limits must not be negative")
+	}
+	switch cfg.Dictionary.Eviction {
+	case "", ptraceotlp.EvictionLRU, ptraceotlp.EvictionLFU:
+	default:
+		return fmt.Errorf("invalid dictionary eviction: %s", cfg.Dictionary.Eviction)
+	}
+	if cfg.Sampling.Rate < 0 || cfg.Sampling.Rate > 1 {
+		return errors.New("sampling rate must be between 0 and 1")
+	}
+	for _, rule := range cfg.Sampling.AlwaysKeep {
+		if rule.SpanName == "" && rule.Attribute == "" {
+			return errors.New("sampling always_keep rules must set span_name or attribute")
+		}
+	}
+	if cfg.PriorityQueue.Enabled {
+		if !cfg.QueueConfig.Enabled {
+			return errors.New("priority_queue requires sending_queue to be enabled")
+		}
+		if cfg.QueueConfig.StorageID != nil {
+			return errors.New("priority_queue does not support the sending_queue storage")
+		}
+		if cfg.PriorityQueue.ScoreAttribute == "" {
+			return errors.New("priority_queue score_attribute must be specified")
+		}
+	}
+	if cfg.PriorityQueue.Reserved < 0 || cfg.PriorityQueue.Reserved >= 1 {
+		return errors.New("priority_queue reserved must be at least 0 and below 1")
+	}
+	if cfg.PriorityQueue.MinScore < 0 || cfg.PriorityQueue.MinScore > 1 {
+		return errors.New("priority_queue min_score must be between 0 and 1")
+	}
+	if cfg.PriorityQueue.LatencyFactor < 0 {
+		return errors.New("priority_queue latency_factor must not be negative")
+	}
+	if cfg.Debug != nil && cfg.Debug.Endpoint == "" {
+		return errors.New("debug endpoint must be specified")
+	}
 	return nil
 }
@@ -0,0 +1,94 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_exporter // import "go.opentelemetry.io/collector/exporter/otlpexporter"
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+)
+
+// debugDictionaryPath is where the debug server serves the traces dictionary, the receiver
+// serves its own on its traces dictionary path.
+const debugDictionaryPath = "/debug/tracesdict"
+
+// debugDictionary is the traces dictionary of the exporter as served by the debug server.
+// Pending are the entries the receiver has not acknowledged yet.
+type debugDictionary struct {
+	Agent string `json:"agent"`
+	ptraceotlp.DictionaryVersion
+	Size    int                       `json:"size"`
+	Bytes   int                       `json:"bytes"`
+	Pending []ptraceotlp.UpdatesEntry `json:"pending"`
+	Entries []ptraceotlp.UpdatesEntry `json:"entries"`
+}
+
+// startDebugServer serves the traces dictionary when the config enables the debug server. It
+// is a confighttp server, so it takes the same auth settings as the receiver endpoints.
+func (e *baseExporter) startDebugServer(host component.Host) error {
+	if e.config.Debug == nil {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(debugDictionaryPath, e.handleDebugDictionary)
+	server, err := e.config.Debug.ToServer(host, e.settings, mux)
+	if err != nil {
+		return err
+	}
+
+	e.logger.Info("Starting the debug server", zap.String("endpoint", e.config.Debug.Endpoint))
+	var ln net.Listener
+	if ln, err = e.config.Debug.ToListener(); err != nil {
+		return err
+	}
+	e.debugServer = server
+	e.debugWG.Add(1)
+	go func() {
+		defer e.debugWG.Done()
+
+		if errHTTP := server.Serve(ln); errHTTP != nil && !errors.Is(errHTTP, http.ErrServerClosed) {
+			e.settings.ReportStatus(component.NewFatalErrorEvent(errHTTP))
+		}
+	}()
+	return nil
+}
+
+// shutdownDebugServer stops the debug server, if it was started.
+func (e *baseExporter) shutdownDebugServer() error {
+	if e.debugServer == nil {
+		return nil
+	}
+	err := e.debugServer.Close()
+	e.debugWG.Wait()
+	return err
+}
+
+func (e *baseExporter) handleDebugDictionary(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.Header().Set("Allow", http.MethodGet)
+		http.Error(resp, "method not allowed, supported: [GET]", http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot := e.compressor.DictionarySnapshot()
+	msg, err := json.Marshal(debugDictionary{
+		Agent:             e.agentID,
+		DictionaryVersion: snapshot.DictionaryVersion,
+		Size:              len(snapshot.Entries),
+		Bytes:             snapshot.Bytes(),
+		Pending:           e.compressor.PendingUpdates(),
+		Entries:           snapshot.Entries,
+	})
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", jsonContentType)
+	_, _ = resp.Write(msg)
+}
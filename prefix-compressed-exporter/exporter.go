@@ -3,6 +3,8 @@ package prefix_compressed_exporter // import "go.opentelemetry.io/collector/expo
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,16 +13,21 @@ import (
 	"net/url"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/metric"
 	"go.uber.org/zap"
 	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/proto"
 
 	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/config/configcompression"
 	"go.opentelemetry.io/collector/consumer/consumererror"
 	"go.opentelemetry.io/collector/exporter"
 	"go.opentelemetry.io/collector/exporter/exporterhelper"
+	"go.opentelemetry.io/collector/extension/experimental/storage"
 	"go.opentelemetry.io/collector/pdata/plog"
 	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
 	"go.opentelemetry.io/collector/pdata/pmetric"
@@ -33,6 +40,7 @@ type baseExporter struct {
 	// Input configuration.
 	config        *Config
 	client        *http.Client
+	tracesClient  *http.Client
 	tracesURL     string
 	tracesdictURL string
 	metricsURL    string
@@ -41,6 +49,27 @@ type baseExporter struct {
 	settings      component.TelemetrySettings
 	// Default user-agent header.
 	userAgent string
+	// agentID is sent as headerAgentID with every request.
+	agentID string
+	// seedHash is sent as headerDictionarySeed, the receiver rejects the requests of another seed.
+	seedHash string
+	// compressor keeps the prefix-trie dictionary of this exporter.
+	compressor *ptraceotlp.TraceCompressor
+	// id and storage persist the dictionary when the config names a storage extension.
+	id      component.ID
+	storage storage.Client
+	// debugServer serves the dictionary when the config enables it.
+	debugServer *http.Server
+	debugWG     sync.WaitGroup
+	// trieConn and trieClient send the traces over gRPC when the config sets grpc. The
+	// dictionary is synchronized on syncStream, guarded by syncMu.
+	trieConn   *grpc.ClientConn
+	trieClient ptraceotlp.TrieGRPCClient
+	syncMu     sync.Mutex
+	syncStream ptraceotlp.DictionarySyncClient
+	syncCancel context.CancelFunc
+	// samplingMetric reports the spans dropped by the sampling policy of the compressor.
+	samplingMetric metric.Registration
 }
 
 const (
@@ -49,8 +78,24 @@ const (
 
 	jsonContentType     = "application/json"
 	protobufContentType = "application/x-protobuf"
+
+	// Keys of the state persisted to the storage extension.
+	storageKeyAgentID    = "agent_id"
+	storageKeyDictionary = "dictionary"
+
+	// headerAgentID names the dictionary namespace of the exporter on the receiver.
+	headerAgentID = "X-Agent-Id"
+	// headerDictionarySeed carries the hash of the seed dictionary of either side.
+	headerDictionarySeed = "X-Dictionary-Seed"
+	// Headers of a 409 Conflict answer, the dictionary epoch and version of the receiver.
+	headerDictionaryEpoch   = "X-Dictionary-Epoch"
+	headerDictionaryVersion = "X-Dictionary-Version"
 )
 
+// errDictionaryConflict is returned by export when the receiver answers 409 Conflict, it does
+// not know a dictionary reference or fingerprint of the traces payload.
+var errDictionaryConflict = errors.New("receiver dictionary out of sync")
+
 // Create new exporter.
 func newExporter(cfg component.Config, set exporter.CreateSettings) (*baseExporter, error) {
 	oCfg := cfg.(*Config)
@@ -65,12 +110,48 @@ func newExporter(cfg component.Config, set exporter.CreateSettings) (*baseExport
 	userAgent := fmt.Sprintf("%s/%s (%s/%s)",
 		set.BuildInfo.Description, set.BuildInfo.Version, runtime.GOOS, runtime.GOARCH)
 
+	agentID := oCfg.AgentID
+	if agentID == "" {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		agentID = hex.EncodeToString(b[:])
+	}
+
+	seed, err := oCfg.Seed.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	compressor := ptraceotlp.NewTraceCompressor()
+	compressor.SetDictionarySeed(seed)
+	if oCfg.TimestampMode == TimestampModeOffset {
+		compressor.SetTimestampMode(ptraceotlp.TimestampModeOffset)
+	}
+	compressor.SetDictionaryLimits(ptraceotlp.DictionaryLimits{
+		MaxEntries: oCfg.Dictionary.MaxEntries,
+		MaxBytes:   oCfg.Dictionary.MaxBytes,
+		Policy:     oCfg.Dictionary.Eviction,
+	})
+	compressor.SetSamplingPolicy(oCfg.Sampling.policy())
+	if oCfg.Compression == configcompression.TypeZstd {
+		// Traces get zstd with a dictionary trained on the recent payloads instead.
+		if err := compressor.EnableZstd(); err != nil {
+			return nil, err
+		}
+	}
+
 	// client construction is deferred to start
 	return &baseExporter{
-		config:    oCfg,
-		logger:    set.Logger,
-		userAgent: userAgent,
-		settings:  set.TelemetrySettings,
+		config:     oCfg,
+		logger:     set.Logger,
+		userAgent:  userAgent,
+		agentID:    agentID,
+		seedHash:   seed.Hash(),
+		settings:   set.TelemetrySettings,
+		compressor: compressor,
+		id:         set.ID,
 	}, nil
 }
 
@@ -82,59 +163,212 @@ func (e *baseExporter) start(_ context.Context, host component.Host) error {
 		return err
 	}
 	e.client = client
+	e.tracesClient = client
+	if e.config.Compression == configcompression.TypeZstd {
+		// The trie payload is compressed by the zstd stage already, compressing it again gains nothing.
+		tracesConfig := e.config.ClientConfig
+		tracesConfig.Compression = ""
+		if e.tracesClient, err = tracesConfig.ToClient(host, e.settings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startTraces starts the exporter, restores the traces dictionary and the agent ID from the
+// storage extension, if one is configured, and checks the seed dictionary of the receiver.
+func (e *baseExporter) startTraces(ctx context.Context, host component.Host) error {
+	if err := e.start(ctx, host); err != nil {
+		return err
+	}
+	if err := e.startTrieGRPC(ctx, host); err != nil {
+		return err
+	}
+	if err := e.startDebugServer(host); err != nil {
+		return err
+	}
+	if err := e.startSamplingMetric(); err != nil {
+		return err
+	}
+	if err := e.restoreDictionary(ctx, host); err != nil {
+		return err
+	}
+	// After the restore, the receiver is asked with the restored agent ID.
+	return e.checkSeed(ctx)
+}
+
+// restoreDictionary restores the traces dictionary and the agent ID from the storage extension,
+// if one is configured.
+func (e *baseExporter) restoreDictionary(ctx context.Context, host component.Host) error {
+	if e.config.StorageID == nil {
+		return nil
+	}
+	ext, ok := host.GetExtensions()[*e.config.StorageID]
+	if !ok {
+		return fmt.Errorf("storage extension %q not found", e.config.StorageID)
+	}
+	storageExt, ok := ext.(storage.Extension)
+	if !ok {
+		return fmt.Errorf("extension %q is not a storage extension", e.config.StorageID)
+	}
+	client, err := storageExt.GetClient(ctx, component.KindExporter, e.id, "traces_dictionary")
+	if err != nil {
+		return err
+	}
+	e.storage = client
+
+	if e.config.AgentID == "" {
+		// The gateway keeps the dictionary under the agent ID, the restored one needs the same ID.
+		agentID, err := client.Get(ctx, storageKeyAgentID)
+		if err != nil {
+			return err
+		}
+		if agentID != nil {
+			e.agentID = string(agentID)
+		} else if err = client.Set(ctx, storageKeyAgentID, []byte(e.agentID)); err != nil {
+			return err
+		}
+	}
+	buf, err := client.Get(ctx, storageKeyDictionary)
+	if err != nil || buf == nil {
+		return err
+	}
+	var snapshot ptraceotlp.DictionarySnapshot
+	if err = json.Unmarshal(buf, &snapshot); err != nil {
+		return fmt.Errorf("failed to restore the traces dictionary: %w", err)
+	}
+	if snapshot.Seed != e.seedHash {
+		// The references of the snapshot may collide with the seeded ones, start over.
+		e.logger.Info("Discarding the traces dictionary persisted with another seed dictionary")
+		return nil
+	}
+	e.compressor.RestoreDictionary(snapshot)
 	return nil
 }
 
+// shutdownTraces closes the gRPC connection, stops the debug server, unregisters the sampling
+// metric and releases the storage client.
+func (e *baseExporter) shutdownTraces(ctx context.Context) error {
+	err := errors.Join(e.shutdownTrieGRPC(), e.shutdownDebugServer(), e.shutdownSamplingMetric())
+	if e.storage == nil {
+		return err
+	}
+	return errors.Join(err, e.storage.Close(ctx))
+}
+
+// persistDictionary writes the traces dictionary to the storage extension, if one is configured.
+func (e *baseExporter) persistDictionary(ctx context.Context) error {
+	if e.storage == nil {
+		return nil
+	}
+	buf, err := json.Marshal(e.compressor.DictionarySnapshot())
+	if err != nil {
+		return err
+	}
+	return e.storage.Set(ctx, storageKeyDictionary, buf)
+}
+
 func (e *baseExporter) pushTraces(ctx context.Context, td ptrace.Traces) error {
 	tr := ptraceotlp.NewExportRequestFromTraces(td)
 
 	var err error
 	var request []byte
 	var updates []ptraceotlp.UpdatesEntry
-	switch e.config.Encoding {
+	encoding := e.config.Encoding
+	if e.trieClient != nil {
+		// The gRPC service only carries the protobuf form.
+		encoding = EncodingProto
+	}
+	switch encoding {
 	case EncodingJSON:
-		request, updates, err = tr.MarshalJSON()
+		request, updates, err = tr.MarshalPrefixTrie(e.compressor)
 	case EncodingProto:
-		request, err = tr.MarshalProto()
+		request, updates, err = tr.MarshalPrefixTrieProto(e.compressor)
 	default:
 		err = fmt.Errorf("invalid encoding: %s", e.config.Encoding)
 	}
 
-	// fmt.Println(string(request))
-	// fmt.Println("came from fmt")
-	// e.logger.Info(string(request))
-
 	if err != nil {
 		return consumererror.NewPermanent(err)
 	}
 
-	var reqBody *bytes.Buffer = bytes.NewBuffer([]byte(``))
+	export := func() error {
+		return e.export(ctx, e.tracesClient, e.tracesURL, request, e.tracesPartialSuccessHandler)
+	}
+	syncDictionary := func() error {
+		return e.syncDictionary(ctx, e.compressor.DictionarySnapshot())
+	}
+	if e.trieClient != nil {
+		export = func() error { return e.exportGRPC(ctx, request) }
+		syncDictionary = func() error { return e.syncDictionaryGRPC(ctx, e.compressor.DictionarySnapshot()) }
+	}
 
-	if updates != nil {
-		dictJson, err := json.Marshal(updates)
-		if err != nil {
+	// The request carries the dictionary updates the receiver has not acknowledged yet.
+	err = export()
+	if errors.Is(err, errDictionaryConflict) {
+		// The receiver lost the acknowledged entries, e.g. it restarted. Resend all of them along
+		// with the dictionary version and retry once.
+		e.logger.Warn("Resynchronizing the traces dictionary", zap.Error(err))
+		if err = syncDictionary(); err != nil {
 			return err
 		}
-		reqBody = bytes.NewBuffer(dictJson)
+		err = export()
+	}
+	if err == nil {
+		e.compressor.Acknowledge(updates)
+		if len(updates) > 0 {
+			if perr := e.persistDictionary(ctx); perr != nil {
+				// The batch is exported, the dictionary is persisted again with the next updates.
+				e.logger.Warn("Failed to persist the traces dictionary", zap.Error(perr))
+			}
+		}
 	}
+	return err
+}
 
-	rsp, err := http.Post(e.tracesdictURL, "application/json", reqBody)
+// syncDictionary posts the dictionary snapshot to the receiver, which restores it. It goes
+// through the configured HTTP client and fails like export, so the retry and queue settings
+// apply to it.
+func (e *baseExporter) syncDictionary(ctx context.Context, snapshot ptraceotlp.DictionarySnapshot) error {
+	dictJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return consumererror.NewPermanent(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.tracesdictURL, bytes.NewReader(dictJSON))
+	if err != nil {
+		return consumererror.NewPermanent(err)
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	req.Header.Set("User-Agent", e.userAgent)
+	e.setDictionaryHeaders(req.Header)
 
+	resp, err := e.client.Do(req)
 	if err != nil {
-		panic("Synchronize Dictionary Failed")
+		return fmt.Errorf("failed to synchronize the traces dictionary: %w", err)
 	}
+	defer func() {
+		// Discard any remaining response body when we are done reading.
+		io.CopyN(io.Discard, resp.Body, maxHTTPResponseReadBytes) // nolint:errcheck
+		resp.Body.Close()
+	}()
 
-	if rsp.StatusCode < 400 && rsp.StatusCode >= 200 {
-		defer rsp.Body.Close()
-		content, err := io.ReadAll(rsp.Body)
-		if err != nil {
-			panic(err)
-		}
-		fmt.Println(string(content))
-		return e.export(ctx, e.tracesURL, request, e.tracesPartialSuccessHandler)
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		content, _ := readResponseBody(resp)
+		e.logger.Debug("Synchronized the traces dictionary", zap.ByteString("response", content))
+		return nil
+	}
+
+	var formattedErr error
+	if respStatus := readResponseStatus(resp); respStatus != nil {
+		formattedErr = fmt.Errorf(
+			"failed to synchronize the traces dictionary, request to %s responded with HTTP Status Code %d, Message=%s, Details=%v",
+			e.tracesdictURL, resp.StatusCode, respStatus.Message, respStatus.Details)
 	} else {
-		panic("Synchronize Dictionary Failed")
+		formattedErr = fmt.Errorf(
+			"failed to synchronize the traces dictionary, request to %s responded with HTTP Status Code %d",
+			e.tracesdictURL, resp.StatusCode)
 	}
+	return responseStatusError(resp, formattedErr)
 }
 
 func (e *baseExporter) pushMetrics(ctx context.Context, md pmetric.Metrics) error {
@@ -154,7 +388,7 @@ func (e *baseExporter) pushMetrics(ctx context.Context, md pmetric.Metrics) erro
 	if err != nil {
 		return consumererror.NewPermanent(err)
 	}
-	return e.export(ctx, e.metricsURL, request, e.metricsPartialSuccessHandler)
+	return e.export(ctx, e.client, e.metricsURL, request, e.metricsPartialSuccessHandler)
 }
 
 func (e *baseExporter) pushLogs(ctx context.Context, ld plog.Logs) error {
@@ -175,10 +409,10 @@ func (e *baseExporter) pushLogs(ctx context.Context, ld plog.Logs) error {
 		return consumererror.NewPermanent(err)
 	}
 
-	return e.export(ctx, e.logsURL, request, e.logsPartialSuccessHandler)
+	return e.export(ctx, e.client, e.logsURL, request, e.logsPartialSuccessHandler)
 }
 
-func (e *baseExporter) export(ctx context.Context, url string, request []byte, partialSuccessHandler partialSuccessHandler) error {
+func (e *baseExporter) export(ctx context.Context, client *http.Client, url string, request []byte, partialSuccessHandler partialSuccessHandler) error {
 	e.logger.Debug("Preparing to make HTTP request", zap.String("url", url))
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(request))
 	if err != nil {
@@ -195,8 +429,9 @@ func (e *baseExporter) export(ctx context.Context, url string, request []byte, p
 	}
 
 	req.Header.Set("User-Agent", e.userAgent)
+	e.setDictionaryHeaders(req.Header)
 
-	resp, err := e.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to make an HTTP request: %w", err)
 	}
@@ -225,6 +460,19 @@ func (e *baseExporter) export(ctx context.Context, url string, request []byte, p
 			url, resp.StatusCode)
 	}
 
+	if resp.StatusCode == http.StatusConflict {
+		// The receiver does not know a reference of the payload or is behind its dictionary version.
+		formattedErr = fmt.Errorf("%w, receiver dictionary %s at version %s", formattedErr,
+			resp.Header.Get(headerDictionaryEpoch), resp.Header.Get(headerDictionaryVersion))
+		return consumererror.NewPermanent(fmt.Errorf("%w: %w", errDictionaryConflict, formattedErr))
+	}
+
+	return responseStatusError(resp, formattedErr)
+}
+
+// responseStatusError wraps formattedErr, the error of the failed response resp, into a throttle
+// retry error if the status code is retryable and into a permanent error otherwise.
+func responseStatusError(resp *http.Response, formattedErr error) error {
 	if isRetryableStatusCode(resp.StatusCode) {
 		// A retry duration of 0 seconds will trigger the default backoff policy
 		// of our caller (retry handler).
@@ -346,7 +594,11 @@ func (e *baseExporter) tracesPartialSuccessHandler(protoBytes []byte, contentTyp
 	default:
 		return nil
 	}
+	e.logTracesPartialSuccess(exportResponse)
+	return nil
+}
 
+func (e *baseExporter) logTracesPartialSuccess(exportResponse ptraceotlp.ExportResponse) {
 	partialSuccess := exportResponse.PartialSuccess()
 	if !(partialSuccess.ErrorMessage() == "" && partialSuccess.RejectedSpans() == 0) {
 		e.logger.Warn("Partial success response",
@@ -354,7 +606,6 @@ func (e *baseExporter) tracesPartialSuccessHandler(protoBytes []byte, contentTyp
 			zap.Int64("dropped_spans", exportResponse.PartialSuccess().RejectedSpans()),
 		)
 	}
-	return nil
 }
 
 func (e *baseExporter) metricsPartialSuccessHandler(protoBytes []byte, contentType string) error {
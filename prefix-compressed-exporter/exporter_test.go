@@ -0,0 +1,57 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_exporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.opentelemetry.io/collector/component/componenttest"
+	"go.opentelemetry.io/collector/exporter/exportertest"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func TestPushTracesDictionaryEndpoint(t *testing.T) {
+	var traces, dictionaries atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/custom/traces", func(w http.ResponseWriter, _ *http.Request) {
+		// The first payload conflicts, the exporter posts its dictionary and retries it.
+		if traces.Add(1) == 1 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v1/tracesdict", func(w http.ResponseWriter, r *http.Request) {
+		// The exporter reads the seed of the receiver on start.
+		if r.Method == http.MethodPost {
+			dictionaries.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := createDefaultConfig().(*Config)
+	cfg.Endpoint = srv.URL
+	cfg.TracesEndpoint = srv.URL + "/custom/traces"
+	cfg.QueueConfig.Enabled = false
+	cfg.RetryConfig.Enabled = false
+	exp, err := createTracesExporter(context.Background(), exportertest.NewNopCreateSettings(), cfg)
+	require.NoError(t, err)
+	require.NoError(t, exp.Start(context.Background(), componenttest.NewNopHost()))
+	t.Cleanup(func() { require.NoError(t, exp.Shutdown(context.Background())) })
+
+	td := ptrace.NewTraces()
+	td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans().AppendEmpty().SetName("GET /cart")
+	require.NoError(t, exp.ConsumeTraces(context.Background(), td))
+	assert.Equal(t, int32(2), traces.Load())
+	assert.Equal(t, int32(1), dictionaries.Load())
+}
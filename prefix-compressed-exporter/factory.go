@@ -17,6 +17,7 @@ import (
 	"go.opentelemetry.io/collector/consumer"
 	"go.opentelemetry.io/collector/exporter"
 	"go.opentelemetry.io/collector/exporter/exporterhelper"
+	"go.opentelemetry.io/collector/exporter/exporterqueue"
 )
 
 // NewFactory creates a factory for OTLP exporter.
@@ -32,9 +33,20 @@ func NewFactory() exporter.Factory {
 
 func createDefaultConfig() component.Config {
 	return &Config{
-		RetryConfig: configretry.NewDefaultBackOffConfig(),
-		QueueConfig: exporterhelper.NewDefaultQueueSettings(),
-		Encoding:    EncodingJSON,
+		RetryConfig:   configretry.NewDefaultBackOffConfig(),
+		QueueConfig:   exporterhelper.NewDefaultQueueSettings(),
+		Encoding:      EncodingJSON,
+		TimestampMode: TimestampModeDelta,
+		Sampling: SamplingConfig{
+			Rate:         0.5,
+			KeepAbnormal: true,
+		},
+		PriorityQueue: PriorityQueueConfig{
+			Reserved:       0.2,
+			ScoreAttribute: "anomaly.score",
+			MinScore:       0.9,
+			LatencyFactor:  3,
+		},
 		ClientConfig: confighttp.ClientConfig{
 			Endpoint: "",
 			Timeout:  30 * time.Second,
@@ -65,6 +77,17 @@ func composeSignalURL(oCfg *Config, signalOverrideURL string, signalName string)
 	}
 }
 
+// composeDictionaryURL returns the URL of the traces dictionary. The traces_endpoint is the URL
+// of the traces payloads, only its /v1/traces path is replaced when the endpoint is omitted.
+func composeDictionaryURL(oCfg *Config) (string, error) {
+	if oCfg.TracesDictEndpoint == "" && oCfg.Endpoint == "" {
+		if base, ok := strings.CutSuffix(oCfg.TracesEndpoint, "/v1/traces"); ok {
+			return base + "/v1/tracesdict", nil
+		}
+	}
+	return composeSignalURL(oCfg, oCfg.TracesDictEndpoint, "tracesdict")
+}
+
 func createTracesExporter(
 	ctx context.Context,
 	set exporter.CreateSettings,
@@ -76,23 +99,47 @@ func createTracesExporter(
 	}
 	oCfg := cfg.(*Config)
 
-	oce.tracesURL, err = composeSignalURL(oCfg, oCfg.TracesEndpoint, "traces")
-	if err != nil {
-		return nil, err
-	}
-	oce.tracesdictURL, err = composeSignalURL(oCfg, oCfg.TracesEndpoint, "tracesdict")
-	if err != nil {
-		return nil, err
+	if oCfg.GRPC == nil {
+		oce.tracesURL, err = composeSignalURL(oCfg, oCfg.TracesEndpoint, "traces")
+		if err != nil {
+			return nil, err
+		}
+		oce.tracesdictURL, err = composeDictionaryURL(oCfg)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return exporterhelper.NewTracesExporter(ctx, set, cfg,
-		oce.pushTraces,
-		exporterhelper.WithStart(oce.start),
-		exporterhelper.WithCapabilities(consumer.Capabilities{MutatesData: false}),
+	options := []exporterhelper.Option{
+		exporterhelper.WithStart(oce.startTraces),
+		exporterhelper.WithShutdown(oce.shutdownTraces),
+		// The sampling removes the dropped spans from the batches.
+		exporterhelper.WithCapabilities(consumer.Capabilities{MutatesData: oCfg.Sampling.Enabled}),
 		// explicitly disable since we rely on http.Client timeout logic.
 		exporterhelper.WithTimeout(exporterhelper.TimeoutSettings{Timeout: 0}),
 		exporterhelper.WithRetry(oCfg.RetryConfig),
-		exporterhelper.WithQueue(oCfg.QueueConfig))
+	}
+	var exp exporter.Traces
+	if !oCfg.PriorityQueue.Enabled {
+		exp, err = exporterhelper.NewTracesExporter(ctx, set, cfg,
+			oce.pushTraces,
+			append(options, exporterhelper.WithQueue(oCfg.QueueConfig))...)
+	} else {
+		// The FIFO queue of exporterhelper is replaced with the priority queue, which takes the
+		// requests of the abnormal detector.
+		detector := newAbnormalDetector(oCfg.PriorityQueue)
+		exp, err = exporterhelper.NewTracesRequestExporter(ctx, set,
+			detector.requestFromTraces(oce.pushTraces),
+			append(options, exporterhelper.WithRequestQueue(exporterqueue.Config{
+				Enabled:      oCfg.QueueConfig.Enabled,
+				NumConsumers: oCfg.QueueConfig.NumConsumers,
+				QueueSize:    oCfg.QueueConfig.QueueSize,
+			}, newPriorityQueueFactory(oCfg.PriorityQueue)))...)
+	}
+	if err != nil || !oCfg.Sampling.Enabled {
+		return exp, err
+	}
+	return &samplingExporter{Traces: exp, compressor: oce.compressor}, nil
 }
 
 func createMetricsExporter(
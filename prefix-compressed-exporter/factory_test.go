@@ -0,0 +1,66 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_exporter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComposeDictionaryURL(t *testing.T) {
+	tests := []struct {
+		name               string
+		endpoint           string
+		tracesEndpoint     string
+		tracesDictEndpoint string
+		want               string
+		wantErr            bool
+	}{
+		{
+			name:     "endpoint",
+			endpoint: "http://gateway:4318",
+			want:     "http://gateway:4318/v1/tracesdict",
+		},
+		{
+			name:           "endpoint with traces endpoint",
+			endpoint:       "http://gateway:4318/",
+			tracesEndpoint: "http://gateway:4318/custom/traces",
+			want:           "http://gateway:4318/v1/tracesdict",
+		},
+		{
+			name:           "traces endpoint only",
+			tracesEndpoint: "http://gateway:4318/v1/traces",
+			want:           "http://gateway:4318/v1/tracesdict",
+		},
+		{
+			name:               "dictionary endpoint",
+			endpoint:           "http://gateway:4318",
+			tracesEndpoint:     "http://gateway:4318/v1/traces",
+			tracesDictEndpoint: "http://gateway:4318/custom/tracesdict",
+			want:               "http://gateway:4318/custom/tracesdict",
+		},
+		{
+			name:           "traces endpoint with another path",
+			tracesEndpoint: "http://gateway:4318/custom/traces",
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createDefaultConfig().(*Config)
+			cfg.Endpoint = tt.endpoint
+			cfg.TracesEndpoint = tt.tracesEndpoint
+			cfg.TracesDictEndpoint = tt.tracesDictEndpoint
+			got, err := composeDictionaryURL(cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
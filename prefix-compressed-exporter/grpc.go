@@ -0,0 +1,164 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_exporter // import "go.opentelemetry.io/collector/exporter/otlpexporter"
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+)
+
+// startTrieGRPC connects to the prefix-trie gRPC service of the receiver when the config sets
+// grpc, the traces are sent there instead of the HTTP endpoints.
+func (e *baseExporter) startTrieGRPC(ctx context.Context, host component.Host) error {
+	if e.config.GRPC == nil {
+		return nil
+	}
+	conn, err := e.config.GRPC.ToClientConn(ctx, host, e.settings, grpc.WithUserAgent(e.userAgent))
+	if err != nil {
+		return err
+	}
+	e.trieConn = conn
+	e.trieClient = ptraceotlp.NewTrieGRPCClient(conn)
+	return nil
+}
+
+// shutdownTrieGRPC closes the SyncDictionary stream and the connection, if they were opened.
+func (e *baseExporter) shutdownTrieGRPC() error {
+	if e.trieConn == nil {
+		return nil
+	}
+	e.closeSyncStream()
+	return e.trieConn.Close()
+}
+
+// exportGRPC is export for the prefix-trie gRPC service.
+func (e *baseExporter) exportGRPC(ctx context.Context, request []byte) error {
+	ctx = e.outgoingContext(ctx)
+	var header metadata.MD
+	resp, err := e.trieClient.ExportCompressed(ctx, request, grpc.Header(&header))
+	if err == nil {
+		e.logTracesPartialSuccess(resp)
+		return nil
+	}
+
+	st := status.Convert(err)
+	if st.Code() == codes.FailedPrecondition {
+		// The receiver does not know a reference of the payload or is behind its dictionary version.
+		err = fmt.Errorf("error exporting items, receiver dictionary %s at version %s: %w",
+			headerValue(header, headerDictionaryEpoch), headerValue(header, headerDictionaryVersion), err)
+		return consumererror.NewPermanent(fmt.Errorf("%w: %w", errDictionaryConflict, err))
+	}
+	if isRetryableCode(st.Code()) {
+		return fmt.Errorf("error exporting items: %w", err)
+	}
+	return consumererror.NewPermanent(fmt.Errorf("error exporting items: %w", err))
+}
+
+// syncDictionaryGRPC sends the dictionary snapshot on the SyncDictionary stream and waits for
+// the receiver to acknowledge it.
+func (e *baseExporter) syncDictionaryGRPC(ctx context.Context, snapshot ptraceotlp.DictionarySnapshot) error {
+	ack, err := e.sendSync(ctx, ptraceotlp.DictionarySync{
+		DictionaryVersion: snapshot.DictionaryVersion,
+		Entries:           snapshot.Entries,
+		Snapshot:          true,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to synchronize the traces dictionary: %w", err)
+		if st, ok := status.FromError(err); ok && !isRetryableCode(st.Code()) {
+			return consumererror.NewPermanent(err)
+		}
+		return err
+	}
+	e.logger.Debug("Synchronized the traces dictionary",
+		zap.String("epoch", ack.Epoch), zap.Uint64("version", ack.Version))
+	return nil
+}
+
+// sendSync sends msg on the SyncDictionary stream and returns the answer of the receiver. The
+// stream is opened on first use and kept open, a failure closes it and the next message opens
+// another.
+func (e *baseExporter) sendSync(ctx context.Context, msg ptraceotlp.DictionarySync) (ptraceotlp.DictionarySync, error) {
+	e.syncMu.Lock()
+	defer e.syncMu.Unlock()
+	if e.syncStream == nil {
+		// The stream outlives the request that opens it, it gets its own context.
+		streamCtx, cancel := context.WithCancel(e.outgoingContext(context.Background()))
+		stream, err := e.trieClient.SyncDictionary(streamCtx)
+		if err != nil {
+			cancel()
+			return ptraceotlp.DictionarySync{}, err
+		}
+		e.syncStream, e.syncCancel = stream, cancel
+	}
+
+	stream := e.syncStream
+	var ack ptraceotlp.DictionarySync
+	done := make(chan error, 1)
+	go func() {
+		err := stream.Send(msg)
+		if err == nil {
+			ack, err = stream.Recv()
+		}
+		done <- err
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		e.closeSyncStreamLocked()
+		return ptraceotlp.DictionarySync{}, err
+	}
+	return ack, nil
+}
+
+func (e *baseExporter) closeSyncStream() {
+	e.syncMu.Lock()
+	defer e.syncMu.Unlock()
+	e.closeSyncStreamLocked()
+}
+
+// closeSyncStreamLocked cancels the SyncDictionary stream. e.syncMu must be held.
+func (e *baseExporter) closeSyncStreamLocked() {
+	if e.syncCancel != nil {
+		e.syncCancel()
+	}
+	e.syncStream, e.syncCancel = nil, nil
+}
+
+// isRetryableCode reports whether a request failing with code may succeed later, the gRPC
+// counterpart of isRetryableStatusCode.
+func isRetryableCode(code codes.Code) bool {
+	switch code {
+	case codes.Canceled,
+		codes.DeadlineExceeded,
+		codes.Aborted,
+		codes.OutOfRange,
+		codes.Unavailable,
+		codes.DataLoss,
+		codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+func headerValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
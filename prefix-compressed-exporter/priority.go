@@ -0,0 +1,281 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_exporter // import "go.opentelemetry.io/collector/exporter/otlpexporter"
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+
+	"angrychow/otel/prefix-compressed-exporter/internal/metadata"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/exporter/exporterhelper"
+	"go.opentelemetry.io/collector/exporter/exporterqueue"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	// shedSpansMetric counts the spans of the normal batches the priority queue dropped to make
+	// room for abnormal ones.
+	shedSpansMetric = "exporter/priority_shed_spans"
+
+	// latencyWarmUp is the number of spans of a name seen before its latency outliers are
+	// flagged, latencyMaxNames bounds the names tracked.
+	latencyWarmUp   = 20
+	latencyMaxNames = 1024
+	// latencyWeight is the weight of a new duration in the moving average of its name.
+	latencyWeight = 0.05
+)
+
+var (
+	// errQueueIsFull is returned when a request is offered to a full priority queue, the
+	// exporterhelper counterpart is internal.
+	errQueueIsFull = errors.New("sending queue is full")
+	// errQueueStopped is returned when a request is offered to a priority queue shut down already.
+	errQueueStopped = errors.New("sending queue is stopped")
+)
+
+// priorityRequest is the exporterhelper request of a batch of traces, abnormal when one of its
+// spans is.
+type priorityRequest struct {
+	td       ptrace.Traces
+	pusher   consumer.ConsumeTracesFunc
+	abnormal bool
+}
+
+func (req *priorityRequest) Export(ctx context.Context) error {
+	return req.pusher(ctx, req.td)
+}
+
+func (req *priorityRequest) ItemsCount() int {
+	return req.td.SpanCount()
+}
+
+// OnError keeps the spans left to send after a partial failure, like the requests of
+// exporterhelper.NewTracesExporter do.
+func (req *priorityRequest) OnError(err error) exporterhelper.Request {
+	var traceError consumererror.Traces
+	if errors.As(err, &traceError) {
+		return &priorityRequest{td: traceError.Data(), pusher: req.pusher, abnormal: req.abnormal}
+	}
+	return req
+}
+
+// abnormalDetector tells the abnormal batches: those holding a span with an error status, an
+// anomaly score of the anomaly processor reaching the configured one, or a duration of more
+// than LatencyFactor times the moving average of its span name.
+type abnormalDetector struct {
+	config PriorityQueueConfig
+
+	mu      sync.Mutex
+	latency map[string]*latencyStats
+}
+
+type latencyStats struct {
+	count int
+	mean  float64
+}
+
+func newAbnormalDetector(cfg PriorityQueueConfig) *abnormalDetector {
+	return &abnormalDetector{config: cfg, latency: make(map[string]*latencyStats)}
+}
+
+// requestFromTraces returns the converter of the traces exporter with a priority queue.
+func (d *abnormalDetector) requestFromTraces(pusher consumer.ConsumeTracesFunc) exporterhelper.RequestFromTracesFunc {
+	return func(_ context.Context, td ptrace.Traces) (exporterhelper.Request, error) {
+		return &priorityRequest{td: td, pusher: pusher, abnormal: d.abnormal(td)}, nil
+	}
+}
+
+// abnormal reports whether td holds an abnormal span. Every span goes through the latency
+// statistics.
+func (d *abnormalDetector) abnormal(td ptrace.Traces) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	abnormal := false
+	rss := td.ResourceSpans()
+	for i := 0; i < rss.Len(); i++ {
+		sss := rss.At(i).ScopeSpans()
+		for j := 0; j < sss.Len(); j++ {
+			spans := sss.At(j).Spans()
+			for k := 0; k < spans.Len(); k++ {
+				span := spans.At(k)
+				if d.latencyOutlier(span) || span.Status().Code() == ptrace.StatusCodeError {
+					abnormal = true
+				} else if score, ok := span.Attributes().Get(d.config.ScoreAttribute); ok && scoreValue(score) >= d.config.MinScore {
+					abnormal = true
+				}
+			}
+		}
+	}
+	return abnormal
+}
+
+// latencyOutlier adds the duration of span to the moving average of its name and reports
+// whether it exceeds LatencyFactor times the average before it. d.mu must be held.
+func (d *abnormalDetector) latencyOutlier(span ptrace.Span) bool {
+	if d.config.LatencyFactor <= 0 || span.EndTimestamp() < span.StartTimestamp() {
+		return false
+	}
+	duration := float64(span.EndTimestamp() - span.StartTimestamp())
+	stats, ok := d.latency[span.Name()]
+	if !ok {
+		if len(d.latency) >= latencyMaxNames {
+			return false
+		}
+		stats = &latencyStats{mean: duration}
+		d.latency[span.Name()] = stats
+	}
+	outlier := stats.count >= latencyWarmUp && duration > d.config.LatencyFactor*stats.mean
+	stats.count++
+	stats.mean += latencyWeight * (duration - stats.mean)
+	return outlier
+}
+
+// scoreValue returns the score of an anomaly attribute, a double unless another processor wrote
+// it.
+func scoreValue(v pcommon.Value) float64 {
+	switch v.Type() {
+	case pcommon.ValueTypeDouble:
+		return v.Double()
+	case pcommon.ValueTypeInt:
+		return float64(v.Int())
+	}
+	return 0
+}
+
+// priorityQueue is a bounded memory queue of requests handing out the abnormal ones first. The
+// normal ones may only fill the capacity but the reserved share, and are shed, oldest first, to
+// make room for an abnormal one when the queue is full.
+type priorityQueue struct {
+	component.StartFunc
+	capacity int
+	reserved int
+	logger   *zap.Logger
+	shed     metric.Int64Counter
+	attrs    metric.MeasurementOption
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	abnormal list.List
+	normal   list.List
+	stopped  bool
+}
+
+type queuedRequest struct {
+	ctx context.Context
+	req exporterhelper.Request
+}
+
+// newPriorityQueueFactory returns the exporterqueue.Factory of the priority queue.
+func newPriorityQueueFactory(cfg PriorityQueueConfig) exporterqueue.Factory[exporterhelper.Request] {
+	return func(_ context.Context, set exporterqueue.Settings, qCfg exporterqueue.Config) exporterqueue.Queue[exporterhelper.Request] {
+		q := &priorityQueue{
+			capacity: qCfg.QueueSize,
+			reserved: int(float64(qCfg.QueueSize) * cfg.Reserved),
+			logger:   set.ExporterSettings.Logger,
+			attrs:    metric.WithAttributes(attribute.String("exporter", set.ExporterSettings.ID.String())),
+		}
+		q.cond = sync.NewCond(&q.mu)
+		shed, err := metadata.Meter(set.ExporterSettings.TelemetrySettings).Int64Counter(
+			shedSpansMetric,
+			metric.WithDescription("Number of spans of normal batches dropped from the sending queue to make room for abnormal ones."),
+			metric.WithUnit("1"))
+		if err != nil {
+			q.logger.Warn("Failed to create the shed spans metric", zap.Error(err))
+		}
+		q.shed = shed
+		return q
+	}
+}
+
+// Offer implements exporterqueue.Queue.
+func (q *priorityQueue) Offer(ctx context.Context, req exporterhelper.Request) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return errQueueStopped
+	}
+	item := queuedRequest{ctx: ctx, req: req}
+	if pr, ok := req.(*priorityRequest); !ok || !pr.abnormal {
+		if q.sizeLocked() >= q.capacity-q.reserved {
+			return errQueueIsFull
+		}
+		q.normal.PushBack(item)
+		q.cond.Signal()
+		return nil
+	}
+
+	if q.sizeLocked() >= q.capacity {
+		oldest := q.normal.Front()
+		if oldest == nil {
+			return errQueueIsFull
+		}
+		dropped := q.normal.Remove(oldest).(queuedRequest)
+		q.logger.Warn("Shedding a normal batch for an abnormal one, the sending queue is full",
+			zap.Int("dropped_items", dropped.req.ItemsCount()))
+		if q.shed != nil {
+			q.shed.Add(ctx, int64(dropped.req.ItemsCount()), q.attrs)
+		}
+	}
+	q.abnormal.PushBack(item)
+	q.cond.Signal()
+	return nil
+}
+
+// Consume implements exporterqueue.Queue, the abnormal requests are consumed first.
+func (q *priorityQueue) Consume(consumeFunc func(context.Context, exporterhelper.Request) error) bool {
+	q.mu.Lock()
+	for q.sizeLocked() == 0 && !q.stopped {
+		q.cond.Wait()
+	}
+	if q.sizeLocked() == 0 {
+		q.mu.Unlock()
+		return false
+	}
+	from := &q.abnormal
+	if from.Len() == 0 {
+		from = &q.normal
+	}
+	item := from.Remove(from.Front()).(queuedRequest)
+	q.mu.Unlock()
+
+	// Like the memory queue of exporterhelper, the consume errors are not handled.
+	_ = consumeFunc(item.ctx, item.req)
+	return true
+}
+
+// Shutdown implements exporterqueue.Queue. The consumers drain the queue and stop.
+func (q *priorityQueue) Shutdown(context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stopped = true
+	q.cond.Broadcast()
+	return nil
+}
+
+// Size implements exporterqueue.Queue, in requests like the queue_size setting.
+func (q *priorityQueue) Size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.sizeLocked()
+}
+
+// Capacity implements exporterqueue.Queue.
+func (q *priorityQueue) Capacity() int {
+	return q.capacity
+}
+
+func (q *priorityQueue) sizeLocked() int {
+	return q.abnormal.Len() + q.normal.Len()
+}
@@ -0,0 +1,277 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_exporter
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/exporter/exporterhelper"
+	"go.opentelemetry.io/collector/exporter/exporterqueue"
+	"go.opentelemetry.io/collector/exporter/exportertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// newPriorityTestTraces returns a batch of n spans called name lasting duration.
+func newPriorityTestTraces(name string, n int, duration uint64) ptrace.Traces {
+	td := ptrace.NewTraces()
+	spans := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	for i := 0; i < n; i++ {
+		span := spans.AppendEmpty()
+		span.SetName(name)
+		span.SetStartTimestamp(pcommon.Timestamp(1000))
+		span.SetEndTimestamp(pcommon.Timestamp(1000 + duration))
+	}
+	return td
+}
+
+func newTestPriorityQueue(t *testing.T, size int, logger *zap.Logger) exporterqueue.Queue[exporterhelper.Request] {
+	set := exportertest.NewNopCreateSettings()
+	set.Logger = logger
+	cfg := createDefaultConfig().(*Config).PriorityQueue
+	cfg.Enabled = true
+	q := newPriorityQueueFactory(cfg)(context.Background(), exporterqueue.Settings{ExporterSettings: set},
+		exporterqueue.Config{Enabled: true, NumConsumers: 1, QueueSize: size})
+	t.Cleanup(func() { require.NoError(t, q.Shutdown(context.Background())) })
+	return q
+}
+
+func priorityTestRequest(items int, abnormal bool) *priorityRequest {
+	return &priorityRequest{td: newPriorityTestTraces("op", items, 10), abnormal: abnormal}
+}
+
+// drain consumes the queue, shut down, and returns the item counts of the requests in order.
+func drain(t *testing.T, q exporterqueue.Queue[exporterhelper.Request]) []int {
+	require.NoError(t, q.Shutdown(context.Background()))
+	var items []int
+	for q.Consume(func(_ context.Context, req exporterhelper.Request) error {
+		items = append(items, req.ItemsCount())
+		return nil
+	}) {
+	}
+	return items
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	q := newTestPriorityQueue(t, 10, zap.NewNop())
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(1, false)))
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(2, true)))
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(3, false)))
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(4, true)))
+	assert.Equal(t, 4, q.Size())
+	assert.Equal(t, 10, q.Capacity())
+
+	// The abnormal requests first, each kind in the order offered.
+	assert.Equal(t, []int{2, 4, 1, 3}, drain(t, q))
+	assert.Equal(t, 0, q.Size())
+}
+
+func TestPriorityQueueReserved(t *testing.T) {
+	q := newTestPriorityQueue(t, 10, zap.NewNop())
+	// The normal requests leave the reserved 0.2 of the queue to the abnormal ones.
+	for i := 0; i < 8; i++ {
+		require.NoError(t, q.Offer(context.Background(), priorityTestRequest(1, false)))
+	}
+	assert.ErrorIs(t, q.Offer(context.Background(), priorityTestRequest(1, false)), errQueueIsFull)
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(2, true)))
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(2, true)))
+	assert.Equal(t, 10, q.Size())
+}
+
+func TestPriorityQueueShed(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	q := newTestPriorityQueue(t, 5, zap.New(core))
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, q.Offer(context.Background(), priorityTestRequest(i, false)))
+	}
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(10, true)))
+
+	// The queue is full, the oldest normal requests make room for the abnormal ones.
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(20, true)))
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(30, true)))
+	assert.Equal(t, 5, q.Size())
+	require.Equal(t, 2, logs.Len())
+	assert.Equal(t, int64(1), logs.All()[0].ContextMap()["dropped_items"])
+	assert.Equal(t, int64(2), logs.All()[1].ContextMap()["dropped_items"])
+
+	// A queue of abnormal requests only refuses the next one.
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(40, true)))
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(50, true)))
+	assert.ErrorIs(t, q.Offer(context.Background(), priorityTestRequest(60, true)), errQueueIsFull)
+	assert.Equal(t, []int{10, 20, 30, 40, 50}, drain(t, q))
+}
+
+func TestPriorityQueueShutdown(t *testing.T) {
+	q := newTestPriorityQueue(t, 5, zap.NewNop())
+	require.NoError(t, q.Offer(context.Background(), priorityTestRequest(1, false)))
+
+	consumed := make(chan int)
+	go func() {
+		for q.Consume(func(_ context.Context, req exporterhelper.Request) error {
+			consumed <- req.ItemsCount()
+			return nil
+		}) {
+		}
+		close(consumed)
+	}()
+	assert.Equal(t, 1, <-consumed)
+
+	// A consumer waiting on the empty queue stops with it.
+	require.NoError(t, q.Shutdown(context.Background()))
+	_, ok := <-consumed
+	assert.False(t, ok)
+	assert.ErrorIs(t, q.Offer(context.Background(), priorityTestRequest(1, true)), errQueueStopped)
+}
+
+func TestPriorityRequest(t *testing.T) {
+	var pushed ptrace.Traces
+	d := newAbnormalDetector(createDefaultConfig().(*Config).PriorityQueue)
+	req, err := d.requestFromTraces(func(_ context.Context, td ptrace.Traces) error {
+		pushed = td
+		return nil
+	})(context.Background(), newPriorityTestTraces("op", 3, 10))
+	require.NoError(t, err)
+	assert.Equal(t, 3, req.ItemsCount())
+	require.NoError(t, req.Export(context.Background()))
+	assert.Equal(t, 3, pushed.SpanCount())
+
+	// A partial failure keeps the spans left to send, along with the priority.
+	pr := req.(*priorityRequest)
+	pr.abnormal = true
+	left := pr.OnError(consumererror.NewTraces(errors.New("partial"), newPriorityTestTraces("op", 1, 10)))
+	assert.Equal(t, 1, left.ItemsCount())
+	assert.True(t, left.(*priorityRequest).abnormal)
+	assert.Same(t, pr, pr.OnError(errors.New("whole")))
+}
+
+func TestAbnormalDetector(t *testing.T) {
+	cfg := createDefaultConfig().(*Config).PriorityQueue
+	tests := []struct {
+		name     string
+		traces   func() ptrace.Traces
+		abnormal bool
+	}{
+		{
+			name:   "normal",
+			traces: func() ptrace.Traces { return newPriorityTestTraces("op", 2, 10) },
+		},
+		{
+			name: "error status",
+			traces: func() ptrace.Traces {
+				td := newPriorityTestTraces("op", 2, 10)
+				td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(1).Status().SetCode(ptrace.StatusCodeError)
+				return td
+			},
+			abnormal: true,
+		},
+		{
+			name: "score",
+			traces: func() ptrace.Traces {
+				td := newPriorityTestTraces("op", 2, 10)
+				td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().PutDouble(cfg.ScoreAttribute, 0.95)
+				return td
+			},
+			abnormal: true,
+		},
+		{
+			name: "score below min score",
+			traces: func() ptrace.Traces {
+				td := newPriorityTestTraces("op", 2, 10)
+				td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().PutDouble(cfg.ScoreAttribute, 0.5)
+				return td
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.abnormal, newAbnormalDetector(cfg).abnormal(tt.traces()))
+		})
+	}
+}
+
+func TestAbnormalDetectorLatency(t *testing.T) {
+	cfg := createDefaultConfig().(*Config).PriorityQueue
+	d := newAbnormalDetector(cfg)
+	// No span is an outlier during the warm-up. The average is then rounded to 100.
+	assert.False(t, d.abnormal(newPriorityTestTraces("op", 1, 1000)))
+	assert.False(t, d.abnormal(newPriorityTestTraces("op", latencyWarmUp-1, 100)))
+	assert.Equal(t, latencyWarmUp, d.latency["op"].count)
+	d.latency["op"].mean = 100
+
+	assert.False(t, d.abnormal(newPriorityTestTraces("op", 1, 300)))
+	assert.True(t, d.abnormal(newPriorityTestTraces("op", 1, 1000)))
+	// The outlier moved the average by latencyWeight of its distance.
+	assert.InDelta(t, 100+0.05*200+latencyWeight*(1000-110), d.latency["op"].mean, 1e-6)
+	// The other names have their own average.
+	assert.False(t, d.abnormal(newPriorityTestTraces("other", 1, 1000)))
+
+	cfg.LatencyFactor = 0
+	d = newAbnormalDetector(cfg)
+	assert.False(t, d.abnormal(newPriorityTestTraces("op", latencyWarmUp, 100)))
+	assert.False(t, d.abnormal(newPriorityTestTraces("op", 1, 100000)))
+	assert.Empty(t, d.latency)
+}
+
+func TestAbnormalDetectorLatencyMaxNames(t *testing.T) {
+	d := newAbnormalDetector(createDefaultConfig().(*Config).PriorityQueue)
+	for i := 0; i < latencyMaxNames+10; i++ {
+		d.abnormal(newPriorityTestTraces("GET /user/"+strconv.Itoa(i), 1, 10))
+	}
+	assert.Len(t, d.latency, latencyMaxNames)
+}
+
+func TestScoreValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value pcommon.Value
+		want  float64
+	}{
+		{name: "double", value: pcommon.NewValueDouble(0.95), want: 0.95},
+		{name: "int", value: pcommon.NewValueInt(1), want: 1},
+		{name: "string", value: pcommon.NewValueStr("0.95"), want: 0},
+		{name: "empty", value: pcommon.NewValueEmpty(), want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, scoreValue(tt.value))
+		})
+	}
+}
+
+func TestPriorityQueueConfigReserved(t *testing.T) {
+	tests := []struct {
+		reserved float64
+		wantErr  bool
+	}{
+		{reserved: -0.1, wantErr: true},
+		{reserved: 0},
+		{reserved: 0.99},
+		// Normal batches would never be queued.
+		{reserved: 1, wantErr: true},
+		{reserved: 1.5, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.FormatFloat(tt.reserved, 'g', -1, 64), func(t *testing.T) {
+			cfg := createDefaultConfig().(*Config)
+			cfg.Endpoint = "http://localhost:4318"
+			cfg.PriorityQueue.Enabled = true
+			cfg.PriorityQueue.Reserved = tt.reserved
+			err := cfg.Validate()
+			if tt.wantErr {
+				assert.EqualError(t, err, "priority_queue reserved must be at least 0 and below 1")
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
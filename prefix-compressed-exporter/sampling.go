@@ -0,0 +1,64 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_exporter // import "go.opentelemetry.io/collector/exporter/otlpexporter"
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"angrychow/otel/prefix-compressed-exporter/internal/metadata"
+
+	"go.opentelemetry.io/collector/exporter"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+)
+
+// sampledOutSpansMetric counts the spans the sampling policy dropped. They are dropped before
+// the exporterhelper, its exporter/sent_spans does not count them.
+const sampledOutSpansMetric = "exporter/sampled_out_spans"
+
+// samplingExporter applies the sampling policy of the compressor to every batch once, ahead of
+// the queue and the retries of the exporterhelper, which marshal the sampled batch.
+type samplingExporter struct {
+	exporter.Traces
+	compressor *ptraceotlp.TraceCompressor
+}
+
+// ConsumeTraces removes the spans the sampling policy drops from td, and sends nothing when none
+// is left.
+func (e *samplingExporter) ConsumeTraces(ctx context.Context, td ptrace.Traces) error {
+	e.compressor.SampleTraces(td)
+	if td.SpanCount() == 0 {
+		return nil
+	}
+	return e.Traces.ConsumeTraces(ctx, td)
+}
+
+// startSamplingMetric registers the sampledOutSpansMetric of the exporter.
+func (e *baseExporter) startSamplingMetric() error {
+	meter := metadata.Meter(e.settings)
+	sampledOut, err := meter.Int64ObservableCounter(
+		sampledOutSpansMetric,
+		metric.WithDescription("Number of spans dropped by the sampling policy instead of being sent to destination."),
+		metric.WithUnit("1"))
+	if err != nil {
+		return err
+	}
+	attrs := metric.WithAttributes(attribute.String("exporter", e.id.String()))
+	e.samplingMetric, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(sampledOut, e.compressor.SampledOutSpans(), attrs)
+		return nil
+	}, sampledOut)
+	return err
+}
+
+// shutdownSamplingMetric unregisters the sampledOutSpansMetric, if it was registered.
+func (e *baseExporter) shutdownSamplingMetric() error {
+	if e.samplingMetric == nil {
+		return nil
+	}
+	return e.samplingMetric.Unregister()
+}
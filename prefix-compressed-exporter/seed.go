@@ -0,0 +1,99 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_exporter // import "go.opentelemetry.io/collector/exporter/otlpexporter"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+)
+
+// seedCheckTimeout bounds the request comparing the seed dictionaries when the exporter starts.
+const seedCheckTimeout = 5 * time.Second
+
+// errSeedMismatch is returned by start when the receiver uses another seed dictionary.
+var errSeedMismatch = errors.New("seed dictionary mismatch")
+
+// setDictionaryHeaders names the dictionary of the exporter on an HTTP request.
+func (e *baseExporter) setDictionaryHeaders(header http.Header) {
+	header.Set(headerAgentID, e.agentID)
+	if e.seedHash != "" {
+		header.Set(headerDictionarySeed, e.seedHash)
+	}
+}
+
+// outgoingContext names the dictionary of the exporter in the metadata of a gRPC call.
+func (e *baseExporter) outgoingContext(ctx context.Context) context.Context {
+	kv := []string{headerAgentID, e.agentID}
+	if e.seedHash != "" {
+		kv = append(kv, headerDictionarySeed, e.seedHash)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// checkSeed compares the seed dictionary with the one of the receiver, every payload would be
+// rejected with different seeds. A receiver that cannot be asked is only logged, it rejects the
+// payloads itself if the seeds differ.
+func (e *baseExporter) checkSeed(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, seedCheckTimeout)
+	defer cancel()
+	var err error
+	if e.trieClient != nil {
+		err = e.checkSeedGRPC(ctx)
+	} else {
+		err = e.checkSeedHTTP(ctx)
+	}
+	if err != nil && !errors.Is(err, errSeedMismatch) {
+		e.logger.Warn("Failed to compare the seed dictionary with the receiver", zap.Error(err))
+		return nil
+	}
+	return err
+}
+
+// checkSeedHTTP reads the seed of the receiver from its dictionary inspection endpoint.
+func (e *baseExporter) checkSeedHTTP(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.tracesdictURL+"?agent="+url.QueryEscape(e.agentID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", e.userAgent)
+	e.setDictionaryHeaders(req.Header)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.CopyN(io.Discard, resp.Body, maxHTTPResponseReadBytes) // nolint:errcheck
+		resp.Body.Close()
+	}()
+	// Not found only means the receiver has no dictionary for the agent yet.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("request to %s responded with HTTP Status Code %d", e.tracesdictURL, resp.StatusCode)
+	}
+	if hash := resp.Header.Get(headerDictionarySeed); hash != e.seedHash {
+		return fmt.Errorf("%w: the exporter uses %q, the receiver %q", errSeedMismatch, e.seedHash, hash)
+	}
+	return nil
+}
+
+// checkSeedGRPC sends an empty message on the SyncDictionary stream, the receiver rejects the
+// stream of another seed.
+func (e *baseExporter) checkSeedGRPC(ctx context.Context) error {
+	_, err := e.sendSync(ctx, ptraceotlp.DictionarySync{})
+	if status.Code(err) == codes.InvalidArgument {
+		return fmt.Errorf("%w: %w", errSeedMismatch, err)
+	}
+	return err
+}
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"time"
 
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/config/configgrpc"
 	"go.opentelemetry.io/collector/config/confighttp"
 	"go.opentelemetry.io/collector/confmap"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
 )
 
 const (
@@ -27,6 +29,16 @@ type HTTPConfig struct {
 	// The URL path to receive traces on. If omitted "/v1/tracesdict" will be used.
 	TracesDictionaryURLPath string `mapstructure:"traces_dictionary_url_path,omitempty"`
 
+	// How long the traces dictionary of an agent is kept without requests (default: 1h). Each
+	// agent, named by its client certificate or else the X-Agent-Id header, has its own dictionary.
+	// 0 keeps them forever. It applies to the agents sending over gRPC as well.
+	DictionaryTTL time.Duration `mapstructure:"dictionary_ttl"`
+
+	// The number of agents with a traces dictionary (default: 10000), the requests of a new agent
+	// are rejected beyond it, with 429 Too Many Requests or ResourceExhausted over gRPC. 0 does not
+	// limit them.
+	MaxAgents int `mapstructure:"max_agents"`
+
 	// The URL path to receive metrics on. If omitted "/v1/metrics" will be used.
 	MetricsURLPath string `mapstructure:"metrics_url_path,omitempty"`
 
@@ -44,6 +56,14 @@ type Protocols struct {
 type Config struct {
 	// Protocols is the configuration for the supported protocols, currently gRPC and HTTP (Proto and JSON).
 	Protocols `mapstructure:"protocols"`
+
+	// The storage extension the traces dictionaries of the agents are persisted to, they are
+	// restored when the receiver starts. If omitted they only live in memory.
+	StorageID *component.ID `mapstructure:"storage"`
+
+	// The attribute keys every agent and the gateway know beforehand, they are never synchronized.
+	// The agents must be configured with the same seed, their requests are rejected otherwise.
+	Seed ptraceotlp.DictionarySeedConfig `mapstructure:"seed"`
 }
 
 var _ component.Config = (*Config)(nil)
@@ -54,6 +74,9 @@ func (cfg *Config) Validate() error {
 	if cfg.GRPC == nil && cfg.HTTP == nil {
 		return errors.New("must specify at least one protocol when using the OTLP receiver")
 	}
+	if cfg.HTTP != nil && cfg.HTTP.MaxAgents < 0 {
+		return errors.New("max_agents must not be negative")
+	}
 	return nil
 }
 
@@ -0,0 +1,277 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_receiver // import "go.opentelemetry.io/collector/receiver/otlpreceiver"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"go.opentelemetry.io/collector/extension/experimental/storage"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+)
+
+// headerAgentID names the agent a traces request comes from.
+const headerAgentID = "X-Agent-Id"
+
+// headerDictionarySeed carries the hash of the seed dictionary of the agent on its requests, and
+// the one of the receiver on the answers of the inspection endpoint.
+const headerDictionarySeed = "X-Dictionary-Seed"
+
+// Keys of the state persisted to the storage extension. The clients cannot list their keys, the
+// agents key holds the IDs of the agents whose dictionary is stored under the dictionary prefix.
+const (
+	storageKeyAgents           = "agents"
+	storageKeyDictionaryPrefix = "dictionary/"
+)
+
+// errTooManyAgents rejects the requests of a new agent while maxAgents agents have a dictionary.
+var errTooManyAgents = errors.New("too many agents have a traces dictionary")
+
+// dictionaries holds one prefix-trie dictionary per agent, the references an agent assigns are
+// only meaningful to its own dictionary. A dictionary unused for ttl is dropped, the agent
+// restores it after the conflict its next request gets.
+type dictionaries struct {
+	ttl       time.Duration // 0 keeps the dictionaries forever
+	maxAgents int           // 0 does not limit the number of dictionaries
+	seed      ptraceotlp.DictionarySeed
+	logger    *zap.Logger
+
+	mu        sync.Mutex
+	byAgent   map[string]*agentDictionary
+	lastSweep time.Time
+	storage   storage.Client // nil unless the dictionaries are persisted
+}
+
+type agentDictionary struct {
+	dict     *ptraceotlp.Dictionary
+	lastUsed time.Time
+}
+
+func newDictionaries(ttl time.Duration, maxAgents int, seed ptraceotlp.DictionarySeed, logger *zap.Logger) *dictionaries {
+	return &dictionaries{
+		ttl:       ttl,
+		maxAgents: maxAgents,
+		seed:      seed,
+		logger:    logger,
+		byAgent:   make(map[string]*agentDictionary),
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns the dictionary of agent, creating it for an agent not seen yet or expired. It
+// fails with errTooManyAgents when the agent is new and maxAgents agents have one already.
+func (d *dictionaries) get(agent string) (*ptraceotlp.Dictionary, error) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep(now)
+	ad, ok := d.byAgent[agent]
+	if !ok {
+		if d.maxAgents > 0 && len(d.byAgent) >= d.maxAgents {
+			return nil, errTooManyAgents
+		}
+		ad = &agentDictionary{dict: ptraceotlp.NewSeededDictionary(d.seed)}
+		d.byAgent[agent] = ad
+	}
+	ad.lastUsed = now
+	return ad.dict, nil
+}
+
+// sweep drops the expired dictionaries, at most once per half ttl.
+func (d *dictionaries) sweep(now time.Time) {
+	if d.ttl <= 0 || now.Sub(d.lastSweep) < d.ttl/2 {
+		return
+	}
+	d.lastSweep = now
+	var expired []storage.Operation
+	for agent, ad := range d.byAgent {
+		if now.Sub(ad.lastUsed) >= d.ttl {
+			delete(d.byAgent, agent)
+			expired = append(expired, storage.DeleteOperation(storageKeyDictionaryPrefix+agent))
+		}
+	}
+	if d.storage != nil && len(expired) > 0 {
+		if err := d.storage.Batch(context.Background(), append(expired, d.agentsOperation())...); err != nil {
+			d.logger.Warn("Failed to delete the expired traces dictionaries", zap.Error(err))
+		}
+	}
+}
+
+// load restores the dictionaries persisted to client, and persists them there from now on.
+func (d *dictionaries) load(ctx context.Context, client storage.Client) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.storage = client
+	buf, err := client.Get(ctx, storageKeyAgents)
+	if err != nil || buf == nil {
+		return err
+	}
+	var agents []string
+	if err = json.Unmarshal(buf, &agents); err != nil {
+		return fmt.Errorf("failed to restore the traces dictionaries: %w", err)
+	}
+	now := time.Now()
+	for _, agent := range agents {
+		if buf, err = client.Get(ctx, storageKeyDictionaryPrefix+agent); err != nil {
+			return err
+		}
+		if buf == nil {
+			continue
+		}
+		var snapshot ptraceotlp.DictionarySnapshot
+		if err = json.Unmarshal(buf, &snapshot); err != nil {
+			return fmt.Errorf("failed to restore the traces dictionary of agent %q: %w", agent, err)
+		}
+		if snapshot.Seed != d.seed.Hash() {
+			// Persisted with another seed, the agent restores it through a conflict.
+			continue
+		}
+		if d.maxAgents > 0 && len(d.byAgent) >= d.maxAgents {
+			d.logger.Warn("Not restoring the traces dictionaries beyond max_agents", zap.Int("max_agents", d.maxAgents))
+			break
+		}
+		dict := ptraceotlp.NewSeededDictionary(d.seed)
+		dict.Restore(snapshot)
+		// Restored dictionaries get a full ttl for their agent to come back.
+		d.byAgent[agent] = &agentDictionary{dict: dict, lastUsed: now}
+	}
+	return nil
+}
+
+// persist writes the dictionary of agent to the storage extension, if one is configured.
+// Failures are logged, the dictionary is persisted again with its next change.
+func (d *dictionaries) persist(ctx context.Context, agent string, dict *ptraceotlp.Dictionary) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.storage == nil {
+		return
+	}
+	buf, err := json.Marshal(dict.Snapshot())
+	if err == nil {
+		err = d.storage.Batch(ctx, storage.SetOperation(storageKeyDictionaryPrefix+agent, buf), d.agentsOperation())
+	}
+	if err != nil {
+		d.logger.Warn("Failed to persist the traces dictionary", zap.String("agent", agent), zap.Error(err))
+	}
+}
+
+// dictionaryInfo describes the dictionary of an agent on the inspection endpoint, Entries is only
+// set for a single agent.
+type dictionaryInfo struct {
+	Agent string `json:"agent"`
+	ptraceotlp.DictionaryVersion
+	Size     int                       `json:"size"`
+	Bytes    int                       `json:"bytes"`
+	LastUsed time.Time                 `json:"lastUsed"`
+	Entries  []ptraceotlp.UpdatesEntry `json:"entries,omitempty"`
+}
+
+func newDictionaryInfo(agent string, ad *agentDictionary) dictionaryInfo {
+	snapshot := ad.dict.Snapshot()
+	return dictionaryInfo{
+		Agent:             agent,
+		DictionaryVersion: snapshot.DictionaryVersion,
+		Size:              len(snapshot.Entries),
+		Bytes:             snapshot.Bytes(),
+		LastUsed:          ad.lastUsed,
+		Entries:           snapshot.Entries,
+	}
+}
+
+// list describes the dictionary of every agent, by agent ID. Inspecting a dictionary does not
+// count as using it.
+func (d *dictionaries) list() []dictionaryInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	infos := make([]dictionaryInfo, 0, len(d.byAgent))
+	for agent, ad := range d.byAgent {
+		info := newDictionaryInfo(agent, ad)
+		info.Entries = nil
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Agent < infos[j].Agent })
+	return infos
+}
+
+// lookup describes the dictionary of agent with its entries, if it has one.
+func (d *dictionaries) lookup(agent string) (dictionaryInfo, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ad, ok := d.byAgent[agent]
+	if !ok {
+		return dictionaryInfo{}, false
+	}
+	return newDictionaryInfo(agent, ad), true
+}
+
+// agentsOperation writes the IDs of the agents with a dictionary. d.mu must be held.
+func (d *dictionaries) agentsOperation() storage.Operation {
+	agents := make([]string, 0, len(d.byAgent))
+	for agent := range d.byAgent {
+		agents = append(agents, agent)
+	}
+	// A slice of strings always marshals.
+	buf, _ := json.Marshal(agents)
+	return storage.SetOperation(storageKeyAgents, buf)
+}
+
+// checkSeed returns an error unless hash is the one of the seed dictionary of the receiver, the
+// references of a payload encoded with another seed mean other keys.
+func (d *dictionaries) checkSeed(hash string) error {
+	if hash != d.seed.Hash() {
+		return fmt.Errorf("the seed dictionary %q of the agent does not match the seed dictionary %q of the gateway", hash, d.seed.Hash())
+	}
+	return nil
+}
+
+// close releases the storage client.
+func (d *dictionaries) close(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.storage == nil {
+		return nil
+	}
+	err := d.storage.Close(ctx)
+	d.storage = nil
+	return err
+}
+
+// agentID identifies the agent req comes from: the common name of its client certificate, else
+// the X-Agent-Id header. The header is ignored with a certificate, it would let an agent use the
+// dictionary of another one. Requests with neither share the "" dictionary.
+func agentID(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return req.Header.Get(headerAgentID)
+}
+
+// grpcAgentID is agentID for gRPC requests, the header is read from the metadata.
+func grpcAgentID(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+			return tlsInfo.State.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	return grpcHeader(ctx, headerAgentID)
+}
+
+// grpcHeader returns the first value of the key of the metadata of a gRPC request.
+func grpcHeader(ctx context.Context, key string) string {
+	if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
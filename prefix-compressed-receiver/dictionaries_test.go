@@ -0,0 +1,170 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_receiver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"go.opentelemetry.io/collector/extension/experimental/storage"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+)
+
+// memStorage is a storage.Client keeping the values in memory.
+type memStorage struct {
+	values map[string][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{values: make(map[string][]byte)}
+}
+
+func (m *memStorage) Get(_ context.Context, key string) ([]byte, error) {
+	return m.values[key], nil
+}
+
+func (m *memStorage) Set(_ context.Context, key string, value []byte) error {
+	m.values[key] = value
+	return nil
+}
+
+func (m *memStorage) Delete(_ context.Context, key string) error {
+	delete(m.values, key)
+	return nil
+}
+
+func (m *memStorage) Batch(_ context.Context, ops ...storage.Operation) error {
+	for _, op := range ops {
+		switch op.Type {
+		case storage.Get:
+			op.Value = m.values[op.Key]
+		case storage.Set:
+			m.values[op.Key] = op.Value
+		case storage.Delete:
+			delete(m.values, op.Key)
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) Close(context.Context) error {
+	return nil
+}
+
+func peerCertificates(cn string) []*x509.Certificate {
+	return []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}}
+}
+
+func TestAgentID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, defaultTracesURLPath, nil)
+	assert.Equal(t, "", agentID(req))
+
+	req.Header.Set(headerAgentID, "agent-1")
+	assert.Equal(t, "agent-1", agentID(req))
+
+	// The certificate names the agent, the header cannot claim another one.
+	req.TLS = &tls.ConnectionState{PeerCertificates: peerCertificates("agent-2")}
+	assert.Equal(t, "agent-2", agentID(req))
+}
+
+func TestGRPCAgentID(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", grpcAgentID(ctx))
+
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(headerAgentID, "agent-1"))
+	assert.Equal(t, "agent-1", grpcAgentID(ctx))
+
+	ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: peerCertificates("agent-2")}}})
+	assert.Equal(t, "agent-2", grpcAgentID(ctx))
+}
+
+func TestDictionariesMaxAgents(t *testing.T) {
+	d := newDictionaries(0, 2, ptraceotlp.DictionarySeed{}, zap.NewNop())
+	a, err := d.get("a")
+	require.NoError(t, err)
+	_, err = d.get("b")
+	require.NoError(t, err)
+
+	_, err = d.get("c")
+	assert.ErrorIs(t, err, errTooManyAgents)
+
+	// The agents with a dictionary keep it.
+	again, err := d.get("a")
+	require.NoError(t, err)
+	assert.Same(t, a, again)
+
+	unlimited := newDictionaries(0, 0, ptraceotlp.DictionarySeed{}, zap.NewNop())
+	for _, agent := range []string{"a", "b", "c"} {
+		_, err = unlimited.get(agent)
+		require.NoError(t, err)
+	}
+}
+
+func TestDictionariesPersist(t *testing.T) {
+	ctx := context.Background()
+	client := newMemStorage()
+	tracesReceiver, sink := newTestTracesReceiver(t)
+	dicts := newDictionaries(0, 0, ptraceotlp.DictionarySeed{}, zap.NewNop())
+	require.NoError(t, dicts.load(ctx, client))
+
+	c := ptraceotlp.NewTraceCompressor()
+	buf, updates, err := c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	resp := postTraces(tracesReceiver, dicts, "agent-1", buf)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	c.Acknowledge(updates)
+	assert.Contains(t, client.values, storageKeyDictionaryPrefix+"agent-1")
+	assert.JSONEq(t, `["agent-1"]`, string(client.values[storageKeyAgents]))
+
+	// A restarted receiver decodes the payloads without the acknowledged entries.
+	restarted := newDictionaries(0, 0, ptraceotlp.DictionarySeed{}, zap.NewNop())
+	require.NoError(t, restarted.load(ctx, client))
+	before, _ := dicts.lookup("agent-1")
+	after, ok := restarted.lookup("agent-1")
+	require.True(t, ok)
+	assert.Equal(t, before.DictionaryVersion, after.DictionaryVersion)
+	assert.Equal(t, before.Entries, after.Entries)
+	buf, _, err = c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	resp = postTraces(tracesReceiver, restarted, "agent-1", buf)
+	assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal(t, 2, sink.SpanCount())
+
+	// The dictionaries persisted with another seed are left to the agents to restore.
+	reseeded := newDictionaries(0, 0, ptraceotlp.NewDictionarySeed([]string{"http.method"}), zap.NewNop())
+	require.NoError(t, reseeded.load(ctx, client))
+	_, ok = reseeded.lookup("agent-1")
+	assert.False(t, ok)
+}
+
+func TestDictionariesExpire(t *testing.T) {
+	client := newMemStorage()
+	dicts := newDictionaries(time.Minute, 0, ptraceotlp.DictionarySeed{}, zap.NewNop())
+	require.NoError(t, dicts.load(context.Background(), client))
+	dict, err := dicts.get("agent-1")
+	require.NoError(t, err)
+	dicts.persist(context.Background(), "agent-1", dict)
+	require.Contains(t, client.values, storageKeyDictionaryPrefix+"agent-1")
+
+	dicts.mu.Lock()
+	dicts.sweep(time.Now().Add(time.Hour))
+	dicts.mu.Unlock()
+	_, ok := dicts.lookup("agent-1")
+	assert.False(t, ok)
+	assert.NotContains(t, client.values, storageKeyDictionaryPrefix+"agent-1")
+	assert.JSONEq(t, `[]`, string(client.values[storageKeyAgents]))
+}
@@ -28,6 +28,7 @@ var (
 
 type encoder interface {
 	unmarshalTracesRequest(buf []byte) (ptraceotlp.ExportRequest, error)
+	unmarshalTrieTracesRequest(buf []byte, dict *ptraceotlp.Dictionary) (ptraceotlp.ExportRequest, error)
 	unmarshalMetricsRequest(buf []byte) (pmetricotlp.ExportRequest, error)
 	unmarshalLogsRequest(buf []byte) (plogotlp.ExportRequest, error)
 
@@ -48,6 +49,14 @@ func (protoEncoder) unmarshalTracesRequest(buf []byte) (ptraceotlp.ExportRequest
 	return req, err
 }
 
+func (protoEncoder) unmarshalTrieTracesRequest(buf []byte, dict *ptraceotlp.Dictionary) (ptraceotlp.ExportRequest, error) {
+	td, err := ptraceotlp.DecodeCompressedProto(buf, dict)
+	if err != nil {
+		return ptraceotlp.NewExportRequest(), err
+	}
+	return ptraceotlp.NewExportRequestFromTraces(td), nil
+}
+
 func (protoEncoder) unmarshalMetricsRequest(buf []byte) (pmetricotlp.ExportRequest, error) {
 	req := pmetricotlp.NewExportRequest()
 	err := req.UnmarshalProto(buf)
@@ -88,6 +97,14 @@ func (jsonEncoder) unmarshalTracesRequest(buf []byte) (ptraceotlp.ExportRequest,
 	return req, err
 }
 
+func (jsonEncoder) unmarshalTrieTracesRequest(buf []byte, dict *ptraceotlp.Dictionary) (ptraceotlp.ExportRequest, error) {
+	td, err := ptraceotlp.DecodeCompressed(buf, dict)
+	if err != nil {
+		return ptraceotlp.NewExportRequest(), err
+	}
+	return ptraceotlp.NewExportRequestFromTraces(td), nil
+}
+
 func (jsonEncoder) unmarshalMetricsRequest(buf []byte) (pmetricotlp.ExportRequest, error) {
 	req := pmetricotlp.NewExportRequest()
 	err := req.UnmarshalJSON(buf)
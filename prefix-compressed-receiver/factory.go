@@ -2,6 +2,7 @@ package prefix_compressed_receiver // import "go.opentelemetry.io/collector/rece
 
 import (
 	"context"
+	"time"
 
 	"angrychow/otel/prefix-compressed-receiver/internal/localhostgate"
 	"angrychow/otel/prefix-compressed-receiver/internal/metadata"
@@ -24,6 +25,8 @@ const (
 	defaultMetricsURLPath          = "/v1/metrics"
 	defaultLogsURLPath             = "/v1/logs"
 	defaultTracesDictionaryURLPath = "/v1/tracesdict"
+	defaultDictionaryTTL           = time.Hour
+	defaultMaxAgents               = 10000
 )
 
 // NewFactory creates a new OTLP receiver factory.
@@ -57,6 +60,8 @@ func createDefaultConfig() component.Config {
 				MetricsURLPath:          defaultMetricsURLPath,
 				LogsURLPath:             defaultLogsURLPath,
 				TracesDictionaryURLPath: defaultTracesDictionaryURLPath,
+				DictionaryTTL:           defaultDictionaryTTL,
+				MaxAgents:               defaultMaxAgents,
 			},
 		},
 	}
@@ -0,0 +1,94 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_receiver // import "go.opentelemetry.io/collector/receiver/otlpreceiver"
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"angrychow/otel/prefix-compressed-receiver/internal/trace"
+
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+)
+
+// trieGRPCServer serves the prefix-trie traces service on the gRPC server. It shares the
+// dictionaries of the agents with the HTTP server, an agent may use either.
+type trieGRPCServer struct {
+	ptraceotlp.UnimplementedTrieGRPCServer
+	tracesReceiver *trace.Receiver
+	dicts          *dictionaries
+}
+
+// ExportCompressed is the gRPC counterpart of handleTraces. A conflict is answered with
+// FailedPrecondition and the dictionary epoch and version in the response headers.
+func (s *trieGRPCServer) ExportCompressed(ctx context.Context, payload []byte) (ptraceotlp.ExportResponse, error) {
+	if err := s.dicts.checkSeed(grpcHeader(ctx, headerDictionarySeed)); err != nil {
+		return ptraceotlp.ExportResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	agent := grpcAgentID(ctx)
+	dict, err := s.dicts.get(agent)
+	if err != nil {
+		return ptraceotlp.ExportResponse{}, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	before := dict.Version()
+	td, err := ptraceotlp.DecodeCompressedProto(payload, dict)
+	if dict.Version() != before {
+		s.dicts.persist(ctx, agent, dict)
+	}
+	if errors.Is(err, ptraceotlp.ErrUnknownReference) {
+		version := dict.Version()
+		// The headers are only informative, the client synchronizes on the status code.
+		_ = grpc.SetHeader(ctx, metadata.Pairs(
+			headerDictionaryEpoch, version.Epoch,
+			headerDictionaryVersion, strconv.FormatUint(version.Version, 10)))
+		return ptraceotlp.ExportResponse{}, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return ptraceotlp.ExportResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return s.tracesReceiver.Export(ctx, ptraceotlp.NewExportRequestFromTraces(td))
+}
+
+// SyncDictionary restores the snapshots and applies the entries the agent sends, and answers
+// each with the resulting dictionary version.
+func (s *trieGRPCServer) SyncDictionary(stream ptraceotlp.DictionarySyncServer) error {
+	ctx := stream.Context()
+	if err := s.dicts.checkSeed(grpcHeader(ctx, headerDictionarySeed)); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	agent := grpcAgentID(ctx)
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Looked up for every message, the dictionary may expire while the stream is open.
+		dict, err := s.dicts.get(agent)
+		if err != nil {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		before := dict.Version()
+		if msg.Snapshot {
+			dict.Restore(ptraceotlp.DictionarySnapshot{DictionaryVersion: msg.DictionaryVersion, Entries: msg.Entries})
+		} else {
+			dict.Apply(msg.Entries)
+		}
+		if msg.Snapshot || dict.Version() != before {
+			s.dicts.persist(ctx, agent, dict)
+		}
+		if err = stream.Send(ptraceotlp.DictionarySync{DictionaryVersion: dict.Version()}); err != nil {
+			return err
+		}
+	}
+}
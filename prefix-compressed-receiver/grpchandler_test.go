@@ -0,0 +1,154 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_receiver
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+)
+
+// newTestTrieGRPCClient serves the prefix-trie traces service of dicts over an in-memory
+// connection and returns its client and the sink of the traces.
+func newTestTrieGRPCClient(t *testing.T, dicts *dictionaries) (ptraceotlp.TrieGRPCClient, *consumertest.TracesSink) {
+	tracesReceiver, sink := newTestTracesReceiver(t)
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	ptraceotlp.RegisterTrieGRPCServer(s, &trieGRPCServer{tracesReceiver: tracesReceiver, dicts: dicts})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, s.Serve(lis))
+	}()
+	t.Cleanup(func() {
+		s.Stop()
+		wg.Wait()
+	})
+
+	cc, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, cc.Close())
+	})
+	return ptraceotlp.NewTrieGRPCClient(cc), sink
+}
+
+// agentContext returns the context of the requests of agent.
+func agentContext(agent string, seed ptraceotlp.DictionarySeed) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), headerAgentID, agent, headerDictionarySeed, seed.Hash())
+}
+
+func TestTrieGRPCExportCompressed(t *testing.T) {
+	dicts := newDictionaries(0, 0, ptraceotlp.DictionarySeed{}, zap.NewNop())
+	client, sink := newTestTrieGRPCClient(t, dicts)
+
+	c := ptraceotlp.NewTraceCompressor()
+	buf, updates, err := c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	_, err = client.ExportCompressed(agentContext("agent-1", dicts.seed), buf)
+	require.NoError(t, err)
+	c.Acknowledge(updates)
+
+	// Another agent lacks the acknowledged entries, the conflict names its dictionary version.
+	buf, _, err = c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	var header metadata.MD
+	_, err = client.ExportCompressed(agentContext("agent-2", dicts.seed), buf, grpc.Header(&header))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	agent2, ok := dicts.lookup("agent-2")
+	require.True(t, ok)
+	assert.Equal(t, []string{agent2.Epoch}, header.Get(headerDictionaryEpoch))
+	assert.Equal(t, []string{strconv.FormatUint(agent2.Version, 10)}, header.Get(headerDictionaryVersion))
+
+	_, err = client.ExportCompressed(agentContext("agent-1", dicts.seed), buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, sink.SpanCount())
+
+	_, err = client.ExportCompressed(agentContext("agent-1", dicts.seed), []byte("not a payload"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestTrieGRPCSyncDictionary(t *testing.T) {
+	dicts := newDictionaries(0, 0, ptraceotlp.DictionarySeed{}, zap.NewNop())
+	client, sink := newTestTrieGRPCClient(t, dicts)
+
+	c := ptraceotlp.NewTraceCompressor()
+	_, updates, err := c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	c.Acknowledge(updates)
+
+	// The receiver restores the snapshot of the agent, then applies the entries it sends.
+	stream, err := client.SyncDictionary(agentContext("agent-1", dicts.seed))
+	require.NoError(t, err)
+	snapshot := c.DictionarySnapshot()
+	require.NoError(t, stream.Send(ptraceotlp.DictionarySync{DictionaryVersion: snapshot.DictionaryVersion, Entries: snapshot.Entries, Snapshot: true}))
+	msg, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, snapshot.DictionaryVersion, msg.DictionaryVersion)
+
+	td := newTestTraces("POST /checkout")
+	td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().PutStr("http.route", "/checkout")
+	_, updates, err = c.MarshalTracesProto(td)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(ptraceotlp.DictionarySync{Entries: updates}))
+	msg, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Greater(t, msg.Version, snapshot.Version)
+	c.Acknowledge(updates)
+	require.NoError(t, stream.CloseSend())
+
+	buf, updates, err := c.MarshalTracesProto(td)
+	require.NoError(t, err)
+	require.Empty(t, updates)
+	_, err = client.ExportCompressed(agentContext("agent-1", dicts.seed), buf)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sink.SpanCount())
+}
+
+func TestTrieGRPCSeed(t *testing.T) {
+	seed := ptraceotlp.NewDictionarySeed([]string{"http.method"})
+	dicts := newDictionaries(0, 0, seed, zap.NewNop())
+	client, sink := newTestTrieGRPCClient(t, dicts)
+
+	buf, _, err := ptraceotlp.NewTraceCompressor().MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	_, err = client.ExportCompressed(agentContext("agent-1", ptraceotlp.DictionarySeed{}), buf)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.SyncDictionary(agentContext("agent-1", ptraceotlp.DictionarySeed{}))
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, dicts.list())
+	assert.Zero(t, sink.SpanCount())
+
+	c := ptraceotlp.NewTraceCompressor()
+	c.SetDictionarySeed(seed)
+	buf, _, err = c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	_, err = client.ExportCompressed(agentContext("agent-1", seed), buf)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sink.SpanCount())
+}
@@ -2,11 +2,12 @@ package prefix_compressed_receiver // import "go.opentelemetry.io/collector/rece
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
-	"regexp"
+	"strconv"
 
 	spb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
@@ -15,6 +16,8 @@ import (
 	"angrychow/otel/prefix-compressed-receiver/internal/logs"
 	"angrychow/otel/prefix-compressed-receiver/internal/metrics"
 	"angrychow/otel/prefix-compressed-receiver/internal/trace"
+
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
 )
 
 // Pre-computed status with code=Internal to be used in case of a marshaling error.
@@ -22,165 +25,110 @@ var fallbackMsg = []byte(`{"code": 13, "message": "failed to marshal error messa
 
 const fallbackContentType = "application/json"
 
-var attrDict = make(map[string]string)
-
-func revertSpan(iter map[string]interface{}) []map[string]interface{} {
-	ret := make([]map[string]interface{}, 0)
-	if iter["Son"] == nil {
-		return nil
-	}
-	_, ok := iter["Son"].([]interface{})
-	if !ok {
-		return nil
-	}
-	// revertTraces(iter[0]["Son"].([]map[string]interface{}))
-	for _, item := range iter["Son"].([]interface{}) {
-		// revertTraces(item[])
-		temps := revertSpan(item.(map[string]interface{}))
-		if temps == nil {
-			ret = append(ret, item.(map[string]interface{}))
-		} else {
-			for _, temp := range temps {
-				temp[item.(map[string]interface{})["AN"].(string)] = item.(map[string]interface{})["AV"]
-				ret = append(ret, temp)
-			}
-		}
-
-	}
-	// fmt.Println(ret)
-	return ret
-}
+// Headers of a 409 Conflict answer to a traces request, they carry the epoch and version of the
+// dictionary of the receiver.
+const (
+	headerDictionaryEpoch   = "X-Dictionary-Epoch"
+	headerDictionaryVersion = "X-Dictionary-Version"
+)
 
-type Attribute_ struct {
-	Key   string      `json:"key"`
-	Value interface{} `json:"value"`
-}
+// queryAgent selects the agent whose dictionary a GET on TracesDictionaryURLPath returns.
+const queryAgent = "agent"
 
-func revertTraces(iters map[string]interface{}) {
-	// iter_ := iter
-	pattern := "^attr_"
-	regExp, _ := regexp.Compile(pattern)
-	if iters["resourceSpans"] == nil {
+func hanleTracesDictionary(resp http.ResponseWriter, req *http.Request, dicts *dictionaries) {
+	if req.Method == http.MethodGet {
+		handleTracesDictionaryInspect(resp, req, dicts)
 		return
 	}
-
-	for _, resourceSpan := range iters["resourceSpans"].([]interface{}) {
-		iter := resourceSpan.(map[string]interface{})
-		resources, ok := iter["resource"].(map[string]interface{})
-		if ok {
-			attributes, ok := resources["attributes"].([]interface{})
-			if ok {
-				for _, attribute_ := range attributes {
-					fmt.Printf("Success! \n")
-					fmt.Println(attribute_)
-					attribute := attribute_.(map[string]interface{})
-					attribute["value"] = (attribute["value"].(map[string]interface{}))["Value"]
-				}
-			}
-		}
-		if iter["scopeSpans"] == nil {
-			return
-		}
-		scopeSpans, ok := iter["scopeSpans"].([]interface{})
-		if !ok {
-			fmt.Println("not array")
-			return
-		}
-		for _, scopeSpan := range scopeSpans {
-			if scopeSpan.(map[string]interface{})["spans"] == nil {
-				return
-			}
-			toffset := uint64(scopeSpan.(map[string]interface{})["tOffset"].(float64))
-			var spans_ = make([]interface{}, 0)
-			for _, span := range scopeSpan.(map[string]interface{})["spans"].([]interface{}) {
-				for _, item := range revertSpan(span.(map[string]interface{})) {
-					item["stun"] = uint64(item["stun"].(float64)) + toffset
-					item["etun"] = uint64(item["etun"].(float64)) + toffset
-					item["start_time_unix_nano"] = item["stun"]
-					item["end_time_unix_nano"] = item["etun"]
-					delete(item, "stun")
-					delete(item, "etun")
-					attributes := make([]Attribute_, 0)
-					for key := range item {
-						if regExp.MatchString(key) {
-							attributes = append(attributes, Attribute_{
-								Key: attrDict[key[5:]],
-								Value: (func() interface{} {
-									if item[key] == "NONE" {
-										return nil
-									}
-									str, ok := item[key].(string)
-									if ok {
-										return str
-									}
-									t, ok := item[key].(map[string]interface{})
-									if !ok {
-										return nil
-									}
-									return t["Value"]
-
-								})(),
-							})
-							delete(item, key)
-						}
-					}
-					if len(attributes) > 0 {
-						item["attributes"] = attributes
-					}
-					spans_ = append(spans_, item)
-				}
-			}
-			scopeSpan.(map[string]interface{})["spans"] = spans_
-		}
-	}
-}
-
-func hanleTracesDictionary(resp http.ResponseWriter, req *http.Request) {
 	enc, ok := readContentType(resp, req)
 	if !ok {
 		return
 	}
+	if err := dicts.checkSeed(req.Header.Get(headerDictionarySeed)); err != nil {
+		writeError(resp, enc, err, http.StatusBadRequest)
+		return
+	}
 
 	body, ok := readAndCloseBody(resp, req, enc)
 	if !ok {
 		return
 	}
-	var body_ []map[string]interface{}
-	json.Unmarshal(body, &body_)
-	for _, item := range body_ {
-		attrDict[item["value"].(string)] = item["key"].(string)
+	// The exporter sends a snapshot of its whole dictionary after a conflict.
+	var snapshot ptraceotlp.DictionarySnapshot
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		writeError(resp, enc, err, http.StatusBadRequest)
+		return
 	}
-	fmt.Println(string(body))
+	agent, dict, ok := readAgentDictionary(resp, req, enc, dicts)
+	if !ok {
+		return
+	}
+	dict.Restore(snapshot)
+	dicts.persist(req.Context(), agent, dict)
 	writeResponse(resp, "text/plain", http.StatusOK, []byte(`receive package`))
 }
 
-func handleTraces(resp http.ResponseWriter, req *http.Request, tracesReceiver *trace.Receiver) {
+// handleTracesDictionaryInspect answers with the dictionary of the agent named by the agent query
+// parameter, entries included, or else with a summary of the dictionary of every agent. The
+// seeded keys are left out, the headerDictionarySeed header names the seed.
+func handleTracesDictionaryInspect(resp http.ResponseWriter, req *http.Request, dicts *dictionaries) {
+	resp.Header().Set(headerDictionarySeed, dicts.seed.Hash())
+	var body interface{}
+	if query := req.URL.Query(); query.Has(queryAgent) {
+		info, ok := dicts.lookup(query.Get(queryAgent))
+		if !ok {
+			writeResponse(resp, "text/plain", http.StatusNotFound, []byte(fmt.Sprintf("no traces dictionary for agent %q", query.Get(queryAgent))))
+			return
+		}
+		body = info
+	} else {
+		body = map[string]interface{}{"agents": dicts.list()}
+	}
+	msg, err := json.Marshal(body)
+	if err != nil {
+		writeError(resp, jsEncoder, err, http.StatusInternalServerError)
+		return
+	}
+	writeResponse(resp, jsonContentType, http.StatusOK, msg)
+}
+
+func handleTraces(resp http.ResponseWriter, req *http.Request, tracesReceiver *trace.Receiver, dicts *dictionaries) {
 	enc, ok := readContentType(resp, req)
 	if !ok {
 		return
 	}
 
+	if err := dicts.checkSeed(req.Header.Get(headerDictionarySeed)); err != nil {
+		writeError(resp, enc, err, http.StatusBadRequest)
+		return
+	}
+
 	body, ok := readAndCloseBody(resp, req, enc)
 	if !ok {
 		return
 	}
 
-	// fmt.Println(string(body))
-	// fmt.Printf("\n\n\n\n\n\n")
-	var body_ map[string]interface{}
-	err := json.Unmarshal(body, &body_)
-	if err != nil {
-		writeError(resp, enc, err, http.StatusBadRequest)
+	// The references and the resource and scope fingerprints are announced by the agent, inside
+	// the trace payloads or on TracesDictionaryURLPath.
+	agent, dict, ok := readAgentDictionary(resp, req, enc, dicts)
+	if !ok {
 		return
 	}
-	revertTraces(body_)
-	body, err = json.Marshal(body_)
-	if err != nil {
-		writeError(resp, enc, err, http.StatusBadRequest)
+	before := dict.Version()
+	otlpReq, err := enc.unmarshalTrieTracesRequest(body, dict)
+	if dict.Version() != before {
+		// The payload carried new entries, or started a new epoch.
+		dicts.persist(req.Context(), agent, dict)
+	}
+	if errors.Is(err, ptraceotlp.ErrUnknownReference) {
+		// The dictionary is out of sync with the exporter, e.g. after a restart. The exporter
+		// resends its whole dictionary on a conflict and retries.
+		version := dict.Version()
+		resp.Header().Set(headerDictionaryEpoch, version.Epoch)
+		resp.Header().Set(headerDictionaryVersion, strconv.FormatUint(version.Version, 10))
+		writeError(resp, enc, err, http.StatusConflict)
 		return
 	}
-	fmt.Println(string(body))
-	otlpReq, err := enc.unmarshalTracesRequest(body)
 	if err != nil {
 		writeError(resp, enc, err, http.StatusBadRequest)
 		return
@@ -293,6 +241,18 @@ func readAndCloseBody(resp http.ResponseWriter, req *http.Request, enc encoder)
 }
 
 // writeError encodes the HTTP error inside a rpc.Status message as required by the OTLP protocol.
+// readAgentDictionary returns the agent req comes from and its dictionary, or answers with the
+// error when a new agent cannot have one.
+func readAgentDictionary(resp http.ResponseWriter, req *http.Request, enc encoder, dicts *dictionaries) (string, *ptraceotlp.Dictionary, bool) {
+	agent := agentID(req)
+	dict, err := dicts.get(agent)
+	if err != nil {
+		writeError(resp, enc, err, http.StatusTooManyRequests)
+		return "", nil, false
+	}
+	return agent, dict, true
+}
+
 func writeError(w http.ResponseWriter, encoder encoder, err error, statusCode int) {
 	s, ok := status.FromError(err)
 	if !ok {
@@ -337,6 +297,12 @@ func errorMsgToStatus(errMsg string, statusCode int) *status.Status {
 	if statusCode == http.StatusBadRequest {
 		return status.New(codes.InvalidArgument, errMsg)
 	}
+	if statusCode == http.StatusConflict {
+		return status.New(codes.FailedPrecondition, errMsg)
+	}
+	if statusCode == http.StatusTooManyRequests {
+		return status.New(codes.ResourceExhausted, errMsg)
+	}
 	return status.New(codes.Unknown, errMsg)
 }
 
@@ -0,0 +1,199 @@
+// Copyright The OpenTelemetry Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package prefix_compressed_receiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"angrychow/otel/prefix-compressed-receiver/internal/trace"
+
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+	"go.opentelemetry.io/collector/receiver/receiverhelper"
+	"go.opentelemetry.io/collector/receiver/receivertest"
+)
+
+// newTestTracesReceiver returns a traces receiver delivering to the returned sink.
+func newTestTracesReceiver(t *testing.T) (*trace.Receiver, *consumertest.TracesSink) {
+	set := receivertest.NewNopCreateSettings()
+	obsrep, err := receiverhelper.NewObsReport(receiverhelper.ObsReportSettings{
+		ReceiverID:             set.ID,
+		Transport:              "http",
+		ReceiverCreateSettings: set,
+	})
+	require.NoError(t, err)
+	sink := new(consumertest.TracesSink)
+	return trace.New(sink, obsrep), sink
+}
+
+// newTestTraces returns one span named name with an attribute, the dictionary of the agent
+// sending it needs the reference of the attribute key.
+func newTestTraces(name string) ptrace.Traces {
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "cart")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetName(name)
+	span.SetTraceID(pcommon.TraceID([16]byte{1, 2, 3}))
+	span.SetSpanID(pcommon.SpanID([8]byte{4, 5, 6}))
+	span.Attributes().PutStr("http.method", "GET")
+	return td
+}
+
+// postTraces posts payload as agent and returns the answer.
+func postTraces(tracesReceiver *trace.Receiver, dicts *dictionaries, agent string, payload []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, defaultTracesURLPath, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", pbContentType)
+	req.Header.Set(headerAgentID, agent)
+	req.Header.Set(headerDictionarySeed, dicts.seed.Hash())
+	resp := httptest.NewRecorder()
+	handleTraces(resp, req, tracesReceiver, dicts)
+	return resp
+}
+
+func TestHandleTracesPerAgent(t *testing.T) {
+	tracesReceiver, sink := newTestTracesReceiver(t)
+	dicts := newDictionaries(0, 0, ptraceotlp.DictionarySeed{}, zap.NewNop())
+
+	c := ptraceotlp.NewTraceCompressor()
+	buf, updates, err := c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	require.NotEmpty(t, updates)
+	resp := postTraces(tracesReceiver, dicts, "agent-1", buf)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	c.Acknowledge(updates)
+
+	// The acknowledged entries are left out of the next payload, only the dictionary of the
+	// agent that announced them decodes it.
+	buf, updates, err = c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	require.Empty(t, updates)
+	resp = postTraces(tracesReceiver, dicts, "agent-2", buf)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.NotEmpty(t, resp.Header().Get(headerDictionaryEpoch))
+	resp = postTraces(tracesReceiver, dicts, "agent-1", buf)
+	assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+	assert.Equal(t, 2, sink.SpanCount())
+	agent1, ok := dicts.lookup("agent-1")
+	require.True(t, ok)
+	assert.NotEmpty(t, agent1.Entries)
+	agent2, ok := dicts.lookup("agent-2")
+	require.True(t, ok)
+	assert.Empty(t, agent2.Entries)
+}
+
+func TestHandleTracesTooManyAgents(t *testing.T) {
+	tracesReceiver, sink := newTestTracesReceiver(t)
+	dicts := newDictionaries(0, 1, ptraceotlp.DictionarySeed{}, zap.NewNop())
+
+	buf, _, err := ptraceotlp.NewTraceCompressor().MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	resp := postTraces(tracesReceiver, dicts, "agent-1", buf)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	resp = postTraces(tracesReceiver, dicts, "agent-2", buf)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, 1, sink.SpanCount())
+}
+
+// getTracesDictionary gets the inspection endpoint with query and returns the answer.
+func getTracesDictionary(dicts *dictionaries, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, defaultTracesDictionaryURLPath+query, nil)
+	resp := httptest.NewRecorder()
+	hanleTracesDictionary(resp, req, dicts)
+	return resp
+}
+
+func TestHandleTracesDictionaryInspect(t *testing.T) {
+	seed := ptraceotlp.NewDictionarySeed([]string{"service.name"})
+	dicts := newDictionaries(0, 0, seed, zap.NewNop())
+	c := ptraceotlp.NewTraceCompressor()
+	c.SetDictionarySeed(seed)
+	buf, _, err := c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	tracesReceiver, _ := newTestTracesReceiver(t)
+	resp := postTraces(tracesReceiver, dicts, "agent-1", buf)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	_, err = dicts.get("agent-2")
+	require.NoError(t, err)
+
+	resp = getTracesDictionary(dicts, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, jsonContentType, resp.Header().Get("Content-Type"))
+	assert.Equal(t, seed.Hash(), resp.Header().Get(headerDictionarySeed))
+	var list struct {
+		Agents []dictionaryInfo `json:"agents"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+	require.Len(t, list.Agents, 2)
+	assert.Equal(t, "agent-1", list.Agents[0].Agent)
+	assert.Positive(t, list.Agents[0].Size)
+	assert.Empty(t, list.Agents[0].Entries)
+	assert.Equal(t, "agent-2", list.Agents[1].Agent)
+	assert.Zero(t, list.Agents[1].Size)
+
+	// A single agent comes with its entries, the seeded keys left out.
+	resp = getTracesDictionary(dicts, "?agent=agent-1")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var info dictionaryInfo
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &info))
+	assert.Equal(t, list.Agents[0].DictionaryVersion, info.DictionaryVersion)
+	assert.Len(t, info.Entries, info.Size)
+	var keys []string
+	for _, entry := range info.Entries {
+		if entry.Kind == "" {
+			keys = append(keys, entry.Key)
+		}
+	}
+	assert.Equal(t, []string{"http.method"}, keys)
+
+	resp = getTracesDictionary(dicts, "?agent=agent-3")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestHandleTracesSeed(t *testing.T) {
+	seed := ptraceotlp.NewDictionarySeed([]string{"http.method"})
+	dicts := newDictionaries(0, 0, seed, zap.NewNop())
+	tracesReceiver, sink := newTestTracesReceiver(t)
+
+	// The references of an agent without the seed mean other keys.
+	buf, _, err := ptraceotlp.NewTraceCompressor().MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, defaultTracesURLPath, bytes.NewReader(buf))
+	req.Header.Set("Content-Type", pbContentType)
+	resp := httptest.NewRecorder()
+	handleTraces(resp, req, tracesReceiver, dicts)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), "does not match the seed dictionary")
+
+	snapshot, err := json.Marshal(ptraceotlp.NewDictionary().Snapshot())
+	require.NoError(t, err)
+	req = httptest.NewRequest(http.MethodPost, defaultTracesDictionaryURLPath, bytes.NewReader(snapshot))
+	req.Header.Set("Content-Type", jsonContentType)
+	req.Header.Set(headerDictionarySeed, "other")
+	resp = httptest.NewRecorder()
+	hanleTracesDictionary(resp, req, dicts)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Empty(t, dicts.list())
+
+	c := ptraceotlp.NewTraceCompressor()
+	c.SetDictionarySeed(seed)
+	buf, _, err = c.MarshalTracesProto(newTestTraces("GET /cart"))
+	require.NoError(t, err)
+	resp = postTraces(tracesReceiver, dicts, "agent-1", buf)
+	assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal(t, 1, sink.SpanCount())
+	got := sink.AllTraces()[0].ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().AsRaw()
+	assert.Equal(t, map[string]any{"http.method": "GET"}, got)
+}
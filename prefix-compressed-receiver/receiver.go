@@ -6,6 +6,7 @@ package prefix_compressed_receiver // import "go.opentelemetry.io/collector/rece
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"sync"
@@ -20,6 +21,7 @@ import (
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/config/confighttp"
 	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/extension/experimental/storage"
 	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
 	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
 	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
@@ -41,6 +43,9 @@ type otlpReceiver struct {
 	obsrepGRPC *receiverhelper.ObsReport
 	obsrepHTTP *receiverhelper.ObsReport
 
+	// dicts holds the traces dictionaries of the agents sending to the HTTP or gRPC server.
+	dicts *dictionaries
+
 	settings *receiver.CreateSettings
 }
 
@@ -89,7 +94,9 @@ func (r *otlpReceiver) startGRPCServer(host component.Host) error {
 	}
 
 	if r.nextTraces != nil {
-		ptraceotlp.RegisterGRPCServer(r.serverGRPC, trace.New(r.nextTraces, r.obsrepGRPC))
+		grpcTracesReceiver := trace.New(r.nextTraces, r.obsrepGRPC)
+		ptraceotlp.RegisterGRPCServer(r.serverGRPC, grpcTracesReceiver)
+		ptraceotlp.RegisterTrieGRPCServer(r.serverGRPC, &trieGRPCServer{tracesReceiver: grpcTracesReceiver, dicts: r.dicts})
 	}
 
 	if r.nextMetrics != nil {
@@ -126,11 +133,12 @@ func (r *otlpReceiver) startHTTPServer(host component.Host) error {
 	httpMux := http.NewServeMux()
 	if r.nextTraces != nil {
 		httpTracesReceiver := trace.New(r.nextTraces, r.obsrepHTTP)
+		dicts := r.dicts
 		httpMux.HandleFunc(r.cfg.HTTP.TracesURLPath, func(resp http.ResponseWriter, req *http.Request) {
-			handleTraces(resp, req, httpTracesReceiver)
+			handleTraces(resp, req, httpTracesReceiver, dicts)
 		})
 		httpMux.HandleFunc(r.cfg.HTTP.TracesDictionaryURLPath, func(resp http.ResponseWriter, req *http.Request) {
-			hanleTracesDictionary(resp, req)
+			hanleTracesDictionary(resp, req, dicts)
 		})
 	}
 
@@ -170,11 +178,51 @@ func (r *otlpReceiver) startHTTPServer(host component.Host) error {
 	return nil
 }
 
+// newDictionaries returns the traces dictionaries, restored from the storage extension if one is
+// configured.
+func (r *otlpReceiver) newDictionaries(host component.Host) (*dictionaries, error) {
+	ttl, maxAgents := defaultDictionaryTTL, defaultMaxAgents
+	if r.cfg.HTTP != nil {
+		ttl, maxAgents = r.cfg.HTTP.DictionaryTTL, r.cfg.HTTP.MaxAgents
+	}
+	seed, err := r.cfg.Seed.Load()
+	if err != nil {
+		return nil, err
+	}
+	dicts := newDictionaries(ttl, maxAgents, seed, r.settings.Logger)
+	if r.cfg.StorageID == nil {
+		return dicts, nil
+	}
+	ext, ok := host.GetExtensions()[*r.cfg.StorageID]
+	if !ok {
+		return nil, fmt.Errorf("storage extension %q not found", r.cfg.StorageID)
+	}
+	storageExt, ok := ext.(storage.Extension)
+	if !ok {
+		return nil, fmt.Errorf("extension %q is not a storage extension", r.cfg.StorageID)
+	}
+	client, err := storageExt.GetClient(context.Background(), component.KindReceiver, r.settings.ID, "traces_dictionaries")
+	if err != nil {
+		return nil, err
+	}
+	if err = dicts.load(context.Background(), client); err != nil {
+		return nil, errors.Join(err, client.Close(context.Background()))
+	}
+	return dicts, nil
+}
+
 // Start runs the trace receiver on the gRPC server. Currently
 // it also enables the metrics receiver too.
 func (r *otlpReceiver) Start(ctx context.Context, host component.Host) error {
+	if r.nextTraces != nil {
+		dicts, err := r.newDictionaries(host)
+		if err != nil {
+			return err
+		}
+		r.dicts = dicts
+	}
 	if err := r.startGRPCServer(host); err != nil {
-		return err
+		return errors.Join(err, r.Shutdown(ctx))
 	}
 	if err := r.startHTTPServer(host); err != nil {
 		// It's possible that a valid GRPC server configuration was specified,
@@ -199,6 +247,9 @@ func (r *otlpReceiver) Shutdown(ctx context.Context) error {
 	}
 
 	r.shutdownWG.Wait()
+	if r.dicts != nil {
+		err = errors.Join(err, r.dicts.close(ctx))
+	}
 	return err
 }
 